@@ -0,0 +1,223 @@
+// Package audit writes a JSON line per proxied completion call, holding the
+// request and response, to a file rotated by size.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/redact"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+const (
+	defaultMaxBodySize = 1 << 20
+	defaultMaxFileSize = 100 << 20
+	defaultMaxFiles    = 5
+)
+
+// Record is the audit record of one completion call. Request and Response
+// are the bodies as received from the client and as sent back to it; a
+// streamed response is kept as its text in StreamText instead.
+type Record struct {
+	Time          time.Time       `json:"time"`
+	RequestID     string          `json:"requestId,omitempty"`
+	Client        string          `json:"client,omitempty"`
+	Protocol      string          `json:"protocol"`
+	Model         string          `json:"model,omitempty"`
+	UpstreamModel string          `json:"upstreamModel,omitempty"`
+	Upstream      string          `json:"upstream,omitempty"`
+	Stream        bool            `json:"stream"`
+	Status        int             `json:"status"`
+	Seconds       float64         `json:"seconds"`
+	Usage         *usage.Usage    `json:"usage,omitempty"`
+	Request       json.RawMessage `json:"request"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	StreamText    string          `json:"streamText,omitempty"`
+	// Truncated is set when a body or the stream text was cut to the
+	// maximum body size.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Log appends records to a file, renaming it to path.1 once it reaches the
+// maximum size and shifting older files up to path.N.
+type Log struct {
+	path        string
+	sampleRate  float64
+	maxBodySize int
+	maxFileSize int64
+	maxFiles    int
+	redactor    *redact.Redactor
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the audit file of cfg for appending, creating it if needed.
+// Bodies and stream text are redacted by redactor, unless it is nil.
+func Open(cfg config.Audit, redactor *redact.Redactor) (*Log, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("audit.path is required")
+	}
+
+	l := &Log{
+		path:        cfg.Path,
+		sampleRate:  cfg.SampleRate,
+		maxBodySize: cfg.MaxBodySize,
+		maxFileSize: cfg.MaxFileSize,
+		maxFiles:    cfg.MaxFiles,
+		redactor:    redactor,
+	}
+	if l.sampleRate == 0 {
+		l.sampleRate = 1
+	}
+	if l.maxBodySize == 0 {
+		l.maxBodySize = defaultMaxBodySize
+	}
+	if l.maxFileSize == 0 {
+		l.maxFileSize = defaultMaxFileSize
+	}
+	if l.maxFiles == 0 {
+		l.maxFiles = defaultMaxFiles
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sampled reports whether a call is to be recorded.
+func (l *Log) Sampled() bool {
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+// MaxBodySize is the number of bytes kept of each body. Callers collecting
+// a body need to keep no more than one byte beyond it.
+func (l *Log) MaxBodySize() int {
+	return l.maxBodySize
+}
+
+// Write appends a record, redacting its bodies and cutting those longer
+// than the maximum body size, and rotating the file first when the record
+// would overflow it. A record is still written when the rotation fails.
+func (l *Log) Write(record Record) error {
+	if l.redactor != nil {
+		record.Request = l.redactor.Bytes(record.Request)
+		record.Response = l.redactor.Bytes(record.Response)
+		record.StreamText = l.redactor.String(record.StreamText)
+	}
+	record.Request = l.body(record.Request, &record.Truncated)
+	record.Response = l.body(record.Response, &record.Truncated)
+	if len(record.StreamText) > l.maxBodySize {
+		record.StreamText = record.StreamText[:l.maxBodySize]
+		record.Truncated = true
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var rotateErr error
+	if l.size > 0 && l.size+int64(len(line)) > l.maxFileSize {
+		rotateErr = l.rotate()
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Join(rotateErr, fmt.Errorf("failed to write audit record: %w", err))
+	}
+	return rotateErr
+}
+
+// body returns a body as JSON: unchanged when it is valid JSON within the
+// maximum size, and as a string of its first bytes otherwise.
+func (l *Log) body(data json.RawMessage, truncated *bool) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) > l.maxBodySize {
+		data = data[:l.maxBodySize]
+		*truncated = true
+	} else if json.Valid(data) {
+		return data
+	}
+
+	quoted, _ := json.Marshal(string(data))
+	return quoted
+}
+
+func (l *Log) open() error {
+	file, size, err := openFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = size
+	return nil
+}
+
+// openFile opens path for appending, creating it if needed, and returns its
+// size.
+func openFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return file, info.Size(), nil
+}
+
+// rotate shifts the rotated files, dropping the oldest, and starts a new
+// file. The current file is only replaced once the new one is open: when a
+// file cannot be renamed or the new one opened, writing goes on to the
+// current one. Callers must hold mu.
+func (l *Log) rotate() error {
+	var err error
+	for i := l.maxFiles - 1; i > 0 && err == nil; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(l.path, l.path+".1")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	file, size, err := openFile(l.path)
+	if err != nil {
+		return err
+	}
+	previous := l.file
+	l.file = file
+	l.size = size
+	if err := previous.Close(); err != nil {
+		return fmt.Errorf("failed to close rotated audit log: %w", err)
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omegaatt36/llm-proxy/app/redact"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Failed to decode %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLog_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(config.Audit{Path: path, MaxBodySize: 24}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	records := []Record{
+		{Model: "gpt-fast", Request: json.RawMessage(`{"model":"gpt-fast"}`), Response: json.RawMessage(`{"id":"1"}`)},
+		{Model: "gpt-fast", Request: json.RawMessage(`{"model":"gpt-fast","messages":[]}`), StreamText: strings.Repeat("a", 30)},
+		{Model: "gpt-fast", Request: json.RawMessage(`{}`), Response: json.RawMessage(`Bad Gateway`)},
+	}
+	for _, record := range records {
+		if err := log.Write(record); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	written := readRecords(t, path)
+	if len(written) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(written))
+	}
+	if string(written[0].Request) != `{"model":"gpt-fast"}` || string(written[0].Response) != `{"id":"1"}` || written[0].Truncated {
+		t.Errorf("Expected the bodies unchanged, got %+v", written[0])
+	}
+	if string(written[1].Request) != `"{\"model\":\"gpt-fast\",\"mes"` || len(written[1].StreamText) != 24 || !written[1].Truncated {
+		t.Errorf("Expected the request and text cut to 24 bytes, got %s and %q", written[1].Request, written[1].StreamText)
+	}
+	if string(written[2].Response) != `"Bad Gateway"` || written[2].Truncated {
+		t.Errorf("Expected a body that is not JSON kept as a string, got %s", written[2].Response)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the file to be private, got %v, %v", info, err)
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(config.Audit{Path: path, MaxFileSize: 100, MaxFiles: 2}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+
+	for _, model := range []string{"a", "b", "c", "d"} {
+		if err := log.Write(Record{Model: model, Request: json.RawMessage(`{}`)}); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	for file, model := range map[string]string{path: "d", path + ".1": "c", path + ".2": "b"} {
+		if records := readRecords(t, file); len(records) != 1 || records[0].Model != model {
+			t.Errorf("Expected %s to hold record %s, got %+v", file, model, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 rotated files, got %v", err)
+	}
+}
+
+func TestLog_Sampled(t *testing.T) {
+	log, err := Open(config.Audit{Path: filepath.Join(t.TempDir(), "audit.jsonl"), SampleRate: 0.25}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+
+	var sampled int
+	for range 10000 {
+		if log.Sampled() {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Errorf("Expected about a quarter of calls sampled, got %d of 10000", sampled)
+	}
+}
+
+func TestLog_Redact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(config.Audit{Path: path}, redact.New())
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	record := Record{
+		Request:    json.RawMessage(`{"messages":[{"role":"user","content":"I am jane@example.com"}]}`),
+		StreamText: "Hello jane@example.com",
+	}
+	if err := log.Write(record); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	written := readRecords(t, path)[0]
+	if string(written.Request) != `{"messages":[{"role":"user","content":"I am [REDACTED:email]"}]}` {
+		t.Errorf("Expected the request redacted, got %s", written.Request)
+	}
+	if written.StreamText != "Hello [REDACTED:email]" {
+		t.Errorf("Expected the stream text redacted, got %q", written.StreamText)
+	}
+}
+
+func TestLog_RotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	log, err := Open(config.Audit{Path: path, MaxFileSize: 100, MaxFiles: 1}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+
+	if err := log.Write(Record{Model: "a", Request: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	if err := log.Write(Record{Model: "b", Request: json.RawMessage(`{}`)}); err == nil {
+		t.Error("Expected an error for the failed rotation")
+	}
+	if records := readRecords(t, path); len(records) != 2 || records[1].Model != "b" {
+		t.Fatalf("Expected writing to go on to %s, got %+v", path, records)
+	}
+
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if err := log.Write(Record{Model: "c", Request: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("Failed to write record after the rotation recovered: %v", err)
+	}
+	if records := readRecords(t, path); len(records) != 1 || records[0].Model != "c" {
+		t.Errorf("Expected %s to hold record c, got %+v", path, records)
+	}
+	if records := readRecords(t, path+".1"); len(records) != 2 {
+		t.Errorf("Expected %s.1 to hold 2 records, got %+v", path, records)
+	}
+}
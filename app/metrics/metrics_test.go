@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("requests_total", "Requests handled.", "route", "status")
+	requests.Inc("/v1/messages", "200")
+	requests.Add(2, "/v1/messages", "200")
+	requests.Inc("/v1/chat/completions", "429")
+
+	inFlight := registry.NewGauge("in_flight", "Requests in flight.")
+	inFlight.Set(3)
+
+	latency := registry.NewHistogram("latency_seconds", "Latency.\nIn seconds.", []float64{0.1, 1}, "model")
+	latency.Observe(0.05, `say "hi"`)
+	latency.Observe(0.5, `say "hi"`)
+	latency.Observe(5, `say "hi"`)
+
+	var out strings.Builder
+	if err := registry.WriteText(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{route="/v1/chat/completions",status="429"} 1
+requests_total{route="/v1/messages",status="200"} 3
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 3
+# HELP latency_seconds Latency.\nIn seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{model="say \"hi\"",le="0.1"} 1
+latency_seconds_bucket{model="say \"hi\"",le="1"} 2
+latency_seconds_bucket{model="say \"hi\"",le="+Inf"} 3
+latency_seconds_sum{model="say \"hi\""} 5.55
+latency_seconds_count{model="say \"hi\""} 3
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
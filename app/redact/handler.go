@@ -0,0 +1,72 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Handler redacts the message and attribute values of log records before
+// passing them to another handler.
+type Handler struct {
+	handler  slog.Handler
+	redactor *Redactor
+}
+
+// NewHandler returns a handler redacting records with redactor before
+// handing them to h.
+func NewHandler(h slog.Handler, redactor *Redactor) *Handler {
+	return &Handler{handler: h, redactor: redactor}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.String(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.attr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, h.attr(attr))
+	}
+	return &Handler{handler: h.handler.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{handler: h.handler.WithGroup(name), redactor: h.redactor}
+}
+
+// attr redacts the value of an attribute. Values other than strings and
+// groups are formatted as the text handler would, and replaced by the
+// redacted text only when something was redacted.
+func (h *Handler) attr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(h.redactor.String(attr.Value.String()))
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		redacted := make([]slog.Attr, 0, len(group))
+		for _, a := range group {
+			redacted = append(redacted, h.attr(a))
+		}
+		attr.Value = slog.GroupValue(redacted...)
+	case slog.KindAny:
+		text := fmt.Sprintf("%+v", attr.Value.Any())
+		if err, ok := attr.Value.Any().(error); ok {
+			text = err.Error()
+		}
+		if redacted := h.redactor.String(text); redacted != text {
+			attr.Value = slog.StringValue(redacted)
+		}
+	}
+	return attr
+}
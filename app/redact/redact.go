@@ -0,0 +1,141 @@
+// Package redact masks secrets and personal data, such as API keys, email
+// addresses, credit card numbers and JWTs, in log records and audit bodies.
+package redact
+
+import (
+	"regexp"
+	"slices"
+	"sync/atomic"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// rule replaces the matches of a pattern that pass its check.
+type rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	check       func(match string) bool
+}
+
+// builtins are the built-in rules by name, applied in this order. JWTs come
+// first so that a bearer JWT is reported as such.
+var builtins = []struct {
+	name string
+	rule rule
+}{
+	{config.RedactJWTs, rule{
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	}},
+	{config.RedactAPIKeys, rule{
+		pattern: regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}|\bAIza[A-Za-z0-9_-]{35}|\bAKIA[A-Z0-9]{16}\b|\b(?:ghp|gho|ghs|ghu|github_pat)_[A-Za-z0-9_]{20,}|(?i:\bbearer\s+)[A-Za-z0-9._~+/-]{16,}=*`),
+	}},
+	{config.RedactEmails, rule{
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	}},
+	// Card numbers are either grouped in fours, or 4-6-5 for American
+	// Express, or bare digits with a known issuer prefix and length, so that
+	// long IDs and timestamps are left alone.
+	{config.RedactCreditCards, rule{
+		pattern: regexp.MustCompile(`\b(?:\d{4}(?: \d{4}){2} \d{1,7}|\d{4}(?:-\d{4}){2}-\d{1,7}|\d{4}[ -]\d{6}[ -]\d{5}|4\d{12}(?:\d{3}){0,2}|5[1-5]\d{14}|2(?:22[1-9]|2[3-9]\d|[3-6]\d\d|7[01]\d|720)\d{12}|3[47]\d{13}|6(?:011|5\d\d)\d{12})\b`),
+		check:   luhn,
+	}},
+}
+
+func init() {
+	for i := range builtins {
+		builtins[i].rule.replacement = "[REDACTED:" + builtins[i].name + "]"
+	}
+}
+
+// Redactor applies the built-in rules and configured patterns. It starts
+// with every built-in rule, and may be reconfigured while in use.
+type Redactor struct {
+	rules atomic.Pointer[[]rule]
+}
+
+// New returns a redactor applying every built-in rule.
+func New() *Redactor {
+	r := &Redactor{}
+	if err := r.Configure(config.Redaction{}); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Configure replaces the rules with the built-in rules not disabled by cfg,
+// followed by its patterns.
+func (r *Redactor) Configure(cfg config.Redaction) error {
+	var rules []rule
+	for _, builtin := range builtins {
+		if !slices.Contains(cfg.Disable, builtin.name) {
+			rules = append(rules, builtin.rule)
+		}
+	}
+	for _, pattern := range cfg.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule{pattern: compiled, replacement: "[REDACTED]"})
+	}
+
+	r.rules.Store(&rules)
+	return nil
+}
+
+// String returns s with every match of the rules replaced.
+func (r *Redactor) String(s string) string {
+	for _, rule := range *r.rules.Load() {
+		if rule.check == nil {
+			s = rule.pattern.ReplaceAllLiteralString(s, rule.replacement)
+			continue
+		}
+		s = rule.pattern.ReplaceAllStringFunc(s, func(match string) string {
+			if !rule.check(match) {
+				return match
+			}
+			return rule.replacement
+		})
+	}
+	return s
+}
+
+// Bytes returns b with every match of the rules replaced. b is not
+// modified.
+func (r *Redactor) Bytes(b []byte) []byte {
+	for _, rule := range *r.rules.Load() {
+		if rule.check == nil {
+			b = rule.pattern.ReplaceAllLiteral(b, []byte(rule.replacement))
+			continue
+		}
+		b = rule.pattern.ReplaceAllFunc(b, func(match []byte) []byte {
+			if !rule.check(string(match)) {
+				return match
+			}
+			return []byte(rule.replacement)
+		})
+	}
+	return b
+}
+
+// luhn reports whether the digits of a number pass the Luhn checksum used by
+// credit card numbers, ignoring spaces and dashes.
+func luhn(number string) bool {
+	var sum, digits int
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return sum%10 == 0
+}
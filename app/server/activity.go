@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Request activity kept for the dashboard: counts per ten seconds over the
+// last fifteen minutes, and the latest failed requests.
+const (
+	activityInterval = 10 * time.Second
+	activityBuckets  = 90
+	recentFailures   = 50
+)
+
+// activityBucket counts the requests completed within one interval.
+type activityBucket struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+}
+
+// failedRequest is a request answered with a 4xx or 5xx status.
+type failedRequest struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Client        string    `json:"client,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	UpstreamModel string    `json:"upstreamModel,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Status        int       `json:"status"`
+	Seconds       float64   `json:"seconds"`
+}
+
+// activity records completed requests. Buckets form a ring indexed by
+// interval; a bucket is reset when its slot comes around again.
+type activity struct {
+	mu       sync.Mutex
+	buckets  [activityBuckets]activityBucket
+	failures []failedRequest
+}
+
+// record counts a completed request, keeping it when it failed.
+func (a *activity) record(info *callInfo, method, path string, status int, started, now time.Time) {
+	failed := status >= 400
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bucket := a.bucket(now)
+	bucket.Requests++
+	if !failed {
+		return
+	}
+	bucket.Errors++
+
+	info.mu.Lock()
+	failure := failedRequest{
+		Time:          now,
+		Method:        method,
+		Path:          path,
+		Client:        info.client,
+		Model:         info.model,
+		UpstreamModel: info.upstreamModel,
+		Upstream:      info.upstream,
+		Status:        status,
+		Seconds:       now.Sub(started).Seconds(),
+	}
+	info.mu.Unlock()
+
+	if len(a.failures) == recentFailures {
+		a.failures = append(a.failures[:0], a.failures[1:]...)
+	}
+	a.failures = append(a.failures, failure)
+}
+
+// bucket returns the bucket of the interval containing t, resetting a
+// stale one. The caller holds mu.
+func (a *activity) bucket(t time.Time) *activityBucket {
+	start := t.Truncate(activityInterval)
+	bucket := &a.buckets[(start.Unix()/int64(activityInterval/time.Second))%activityBuckets]
+	if !bucket.Start.Equal(start) {
+		*bucket = activityBucket{Start: start}
+	}
+	return bucket
+}
+
+// series returns the buckets of the last fifteen minutes, oldest first,
+// with empty intervals included.
+func (a *activity) series(now time.Time) []activityBucket {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	series := make([]activityBucket, 0, activityBuckets)
+	end := now.Truncate(activityInterval)
+	for i := activityBuckets - 1; i >= 0; i-- {
+		series = append(series, *a.bucket(end.Add(-time.Duration(i) * activityInterval)))
+	}
+	return series
+}
+
+// recent returns the latest failed requests, newest first.
+func (a *activity) recent() []failedRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	recent := make([]failedRequest, 0, len(a.failures))
+	for i := len(a.failures) - 1; i >= 0; i-- {
+		recent = append(recent, a.failures[i])
+	}
+	return recent
+}
@@ -0,0 +1,514 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// maxAdminBodySize bounds the size of admin request bodies.
+const maxAdminBodySize = 1 << 20
+
+// adminError is an admin request failure with the status it is answered
+// with.
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+// adminHandler serves the /admin API for inspecting and changing the
+// running proxy, and the dashboard. Changes are written to the
+// configuration file and reloaded, so that they survive a restart.
+func (p *ProxyServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/mappings", p.handleAdminMappings)
+	mux.HandleFunc("PUT /admin/mappings/{model...}", p.handleAdminSetMapping)
+	mux.HandleFunc("DELETE /admin/mappings/{model...}", p.handleAdminDeleteMapping)
+	mux.HandleFunc("GET /admin/upstreams", p.handleAdminUpstreams)
+	mux.HandleFunc("PUT /admin/upstreams/{name}", p.handleAdminSetUpstream)
+	mux.HandleFunc("DELETE /admin/upstreams/{name}", p.handleAdminDeleteUpstream)
+	mux.HandleFunc("GET /admin/keys", p.handleAdminKeys)
+	mux.HandleFunc("POST /admin/keys", p.handleAdminCreateKey)
+	mux.HandleFunc("PUT /admin/keys/{name}", p.handleAdminSetKey)
+	mux.HandleFunc("DELETE /admin/keys/{name}", p.handleAdminDeleteKey)
+	mux.HandleFunc("GET /admin/requests", p.handleAdminRequests)
+	mux.HandleFunc("GET /admin/usage", p.handleAdminUsage)
+	mux.HandleFunc("POST /admin/reload", p.handleAdminReload)
+
+	root := http.NewServeMux()
+	root.Handle("/admin/", p.authenticateAdmin(mux))
+	root.Handle("GET /admin/stats", p.authenticateStats(http.HandlerFunc(p.handleAdminStats)))
+	root.Handle("GET /dashboard/", dashboardHandler())
+	return root
+}
+
+// authenticateAdmin rejects requests without the admin token, read from the
+// current configuration so that a reload can rotate it.
+func (p *ProxyServer) authenticateAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := p.current.Load().config.Admin.Token
+		if token == "" || subtle.ConstantTimeCompare([]byte(clientKey(r)), []byte(token)) != 1 {
+			writeError(w, r, config.ProtocolOpenAI, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mappingView is the route of a local model as listed by the admin API.
+type mappingView struct {
+	Model         string   `json:"model"`
+	Target        string   `json:"target,omitempty"`
+	Upstream      string   `json:"upstream"`
+	UpstreamModel string   `json:"upstreamModel"`
+	Fallbacks     []string `json:"fallbacks,omitempty"`
+}
+
+func newMappingView(cfg *config.Config, model string) mappingView {
+	view := mappingView{Model: model, Target: cfg.ModelMappings[model], Fallbacks: cfg.Fallbacks[model]}
+	target := view.Target
+	if target == "" {
+		target = model
+	}
+	view.Upstream, view.UpstreamModel = cfg.Route(target)
+	return view
+}
+
+func (p *ProxyServer) handleAdminMappings(w http.ResponseWriter, r *http.Request) {
+	cfg := p.current.Load().config
+	models := slices.Collect(maps.Keys(cfg.ModelMappings))
+	for model := range cfg.Fallbacks {
+		if _, mapped := cfg.ModelMappings[model]; !mapped {
+			models = append(models, model)
+		}
+	}
+	slices.Sort(models)
+
+	mappings := make([]mappingView, 0, len(models))
+	for _, model := range models {
+		mappings = append(mappings, newMappingView(cfg, model))
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{"mappings": mappings})
+}
+
+// handleAdminSetMapping maps a local model to a target. Fallbacks are
+// replaced when given, and removed when given as an empty list.
+func (p *ProxyServer) handleAdminSetMapping(w http.ResponseWriter, r *http.Request) {
+	model := r.PathValue("model")
+	var body struct {
+		Target    string    `json:"target"`
+		Fallbacks *[]string `json:"fallbacks"`
+	}
+	if err := decodeAdminJSON(r, &body); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if body.Target == "" {
+		writeAdminError(w, r, &adminError{http.StatusBadRequest, "target is required"})
+		return
+	}
+
+	cfg, err := p.editConfig(func(editor *config.Editor) error {
+		if err := editor.SetValue("modelMappings", model, body.Target); err != nil {
+			return err
+		}
+		switch {
+		case body.Fallbacks == nil:
+			return nil
+		case len(*body.Fallbacks) == 0:
+			_, err := editor.RemoveValue("fallbacks", model)
+			return err
+		default:
+			return editor.SetValue("fallbacks", model, *body.Fallbacks)
+		}
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newMappingView(cfg, model))
+}
+
+// handleAdminDeleteMapping removes the mapping and fallbacks of a local
+// model.
+func (p *ProxyServer) handleAdminDeleteMapping(w http.ResponseWriter, r *http.Request) {
+	model := r.PathValue("model")
+	_, err := p.editConfig(func(editor *config.Editor) error {
+		mapped, err := editor.RemoveValue("modelMappings", model)
+		if err != nil {
+			return err
+		}
+		withFallbacks, err := editor.RemoveValue("fallbacks", model)
+		if err != nil {
+			return err
+		}
+		if !mapped && !withFallbacks {
+			return &adminError{http.StatusNotFound, fmt.Sprintf("model %s is not mapped", model)}
+		}
+		return nil
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ProxyServer) handleAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	upstreams := p.current.Load().config.AllUpstreams()
+	for i := range upstreams {
+		upstreams[i] = maskUpstream(upstreams[i])
+	}
+	writeConfigJSON(w, r, http.StatusOK, "upstreams", upstreams)
+}
+
+// handleAdminSetUpstream adds an upstream or replaces the settings of an
+// existing one, keeping its position. Keys sent back masked, as listed,
+// keep their current value.
+func (p *ProxyServer) handleAdminSetUpstream(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var u config.Upstream
+	if err := decodeConfigBody(r, &u); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if u.Name != "" && u.Name != name {
+		writeAdminError(w, r, &adminError{http.StatusBadRequest, "name does not match the path"})
+		return
+	}
+	u.Name = name
+
+	current := p.current.Load().config
+	if name == config.DefaultUpstreamName && current.UpstreamURL != "" {
+		writeAdminError(w, r, &adminError{http.StatusConflict, "the default upstream is configured by upstreamURL"})
+		return
+	}
+	effective := byName(current.Upstreams, func(u config.Upstream) string { return u.Name })[name]
+
+	cfg, err := p.editConfig(func(editor *config.Editor) error {
+		var written config.Upstream
+		if _, err := editor.Entry("upstreams", name, &written); err != nil {
+			return err
+		}
+		u.APIKey = keepSecret(u.APIKey, effective.APIKey, written.APIKey)
+		for i := range u.Endpoints {
+			if i < len(effective.Endpoints) && i < len(written.Endpoints) {
+				u.Endpoints[i].APIKey = keepSecret(u.Endpoints[i].APIKey, effective.Endpoints[i].APIKey, written.Endpoints[i].APIKey)
+			}
+		}
+		return editor.SetEntry("upstreams", name, u)
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	u = byName(cfg.Upstreams, func(u config.Upstream) string { return u.Name })[name]
+	writeConfigJSON(w, r, http.StatusOK, "", maskUpstream(u))
+}
+
+func (p *ProxyServer) handleAdminDeleteUpstream(w http.ResponseWriter, r *http.Request) {
+	p.deleteEntry(w, r, "upstreams", r.PathValue("name"))
+}
+
+func (p *ProxyServer) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	clients := slices.Clone(p.current.Load().config.Clients)
+	for i := range clients {
+		clients[i].Key = config.MaskSecret(clients[i].Key)
+	}
+	writeConfigJSON(w, r, http.StatusOK, "keys", clients)
+}
+
+// handleAdminCreateKey adds a client, generating its key unless one is
+// given, and answers with the key. It is only shown this once.
+func (p *ProxyServer) handleAdminCreateKey(w http.ResponseWriter, r *http.Request) {
+	var c config.Client
+	if err := decodeConfigBody(r, &c); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if c.Name == "" {
+		writeAdminError(w, r, &adminError{http.StatusBadRequest, "name is required"})
+		return
+	}
+	if c.Key == "" {
+		c.Key = config.NewKey()
+	}
+
+	_, err := p.editConfig(func(editor *config.Editor) error {
+		if exists, err := editor.Entry("clients", c.Name, &config.Client{}); err != nil || exists {
+			if exists {
+				err = &adminError{http.StatusConflict, fmt.Sprintf("client %s already exists", c.Name)}
+			}
+			return err
+		}
+		return editor.AddEntry("clients", c)
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	writeConfigJSON(w, r, http.StatusCreated, "", c)
+}
+
+// handleAdminSetKey replaces the settings of a client. An empty or masked
+// key keeps the current one.
+func (p *ProxyServer) handleAdminSetKey(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var c config.Client
+	if err := decodeConfigBody(r, &c); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if c.Name != "" && c.Name != name {
+		writeAdminError(w, r, &adminError{http.StatusBadRequest, "name does not match the path"})
+		return
+	}
+	c.Name = name
+	effective := byName(p.current.Load().config.Clients, func(c config.Client) string { return c.Name })[name]
+
+	cfg, err := p.editConfig(func(editor *config.Editor) error {
+		var written config.Client
+		exists, err := editor.Entry("clients", name, &written)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &adminError{http.StatusNotFound, fmt.Sprintf("client %s does not exist", name)}
+		}
+		if c.Key == "" {
+			c.Key = written.Key
+		}
+		c.Key = keepSecret(c.Key, effective.Key, written.Key)
+		return editor.SetEntry("clients", name, c)
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	c = byName(cfg.Clients, func(c config.Client) string { return c.Name })[name]
+	c.Key = config.MaskSecret(c.Key)
+	writeConfigJSON(w, r, http.StatusOK, "", c)
+}
+
+func (p *ProxyServer) handleAdminDeleteKey(w http.ResponseWriter, r *http.Request) {
+	p.deleteEntry(w, r, "clients", r.PathValue("name"))
+}
+
+// deleteEntry removes a named entry of a configuration section.
+func (p *ProxyServer) deleteEntry(w http.ResponseWriter, r *http.Request, section, name string) {
+	_, err := p.editConfig(func(editor *config.Editor) error {
+		removed, err := editor.RemoveEntry(section, name)
+		if err == nil && !removed {
+			err = &adminError{http.StatusNotFound, fmt.Sprintf("%s has no entry named %s", section, name)}
+		}
+		return err
+	})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ProxyServer) handleAdminRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, map[string]any{"requests": p.inFlight.list(time.Now())})
+}
+
+// usageView is a usage summary with its cost, as listed by the admin API.
+type usageView struct {
+	usage.Summary
+	Cost float64 `json:"cost"`
+}
+
+// handleAdminUsage answers usage totals per client, model and upstream,
+// filtered by the since, until, client and model query parameters. Times
+// are dates (2006-01-02) or RFC 3339 timestamps.
+func (p *ProxyServer) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := usage.Filter{Client: query.Get("client"), Model: query.Get("model")}
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, value)
+		}
+		if err != nil {
+			writeAdminError(w, r, &adminError{http.StatusBadRequest, fmt.Sprintf("invalid %s: %q", bound.name, value)})
+			return
+		}
+		*bound.time = t
+	}
+
+	summaries, err := p.usageStore.Summarize(r.Context(), filter)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	cfg := p.current.Load().config
+	views := make([]usageView, 0, len(summaries))
+	var total usageView
+	for _, s := range summaries {
+		view := usageView{Summary: s, Cost: s.Cost(cfg.Price(s.UpstreamModel, s.Model))}
+		views = append(views, view)
+
+		total.Requests += s.Requests
+		total.Usage = total.Usage.Add(s.Usage)
+		total.Cost += view.Cost
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"usage": views,
+		"total": map[string]any{"requests": total.Requests, "usage": total.Usage, "cost": total.Cost},
+	})
+}
+
+// handleAdminReload reloads the configuration file, as SIGHUP does.
+func (p *ProxyServer) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	p.editMu.Lock()
+	defer p.editMu.Unlock()
+
+	if err := p.ReloadFile(); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// editConfig applies an edit to the configuration file, saves it and
+// reloads the result. An edit leaving the configuration invalid is
+// rejected without touching the file.
+func (p *ProxyServer) editConfig(edit func(editor *config.Editor) error) (*config.Config, error) {
+	p.editMu.Lock()
+	defer p.editMu.Unlock()
+
+	if p.configPath == "" {
+		return nil, &adminError{http.StatusConflict, "the configuration comes from the environment and cannot be edited"}
+	}
+	editor, err := config.Edit(p.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := edit(editor); err != nil {
+		return nil, err
+	}
+	cfg, err := editor.Save()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// keepSecret returns the secret to write for a submitted one: the written
+// value, which may be a ${NAME} reference, when the submitted secret is the
+// masked effective one.
+func keepSecret(submitted, effective, written string) string {
+	if effective != "" && submitted == config.MaskSecret(effective) {
+		return written
+	}
+	return submitted
+}
+
+func maskUpstream(u config.Upstream) config.Upstream {
+	u.APIKey = config.MaskSecret(u.APIKey)
+	u.Endpoints = slices.Clone(u.Endpoints)
+	for i := range u.Endpoints {
+		u.Endpoints[i].APIKey = config.MaskSecret(u.Endpoints[i].APIKey)
+	}
+	return u
+}
+
+// decodeAdminJSON decodes a JSON request body, rejecting unknown fields.
+func decodeAdminJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &adminError{http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+// decodeConfigBody decodes a configuration entry from a JSON or YAML
+// request body, with the field names of the configuration file.
+func decodeConfigBody(r *http.Request, v any) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBodySize))
+	if err != nil {
+		return &adminError{http.StatusBadRequest, "failed to read request body"}
+	}
+	if err := yaml.UnmarshalWithOptions(data, v, yaml.Strict()); err != nil {
+		message := err.Error()
+		var yamlErr yaml.Error
+		if errors.As(err, &yamlErr) {
+			message = yamlErr.GetMessage()
+		}
+		return &adminError{http.StatusBadRequest, "invalid request body: " + message}
+	}
+	return nil
+}
+
+// writeAdminError answers an admin request failure: 422 for an invalid
+// configuration, listing every problem.
+func writeAdminError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var adminErr *adminError
+	var validationErr *config.ValidationError
+	switch {
+	case errors.As(err, &adminErr):
+		status = adminErr.status
+	case errors.As(err, &validationErr):
+		status = http.StatusUnprocessableEntity
+	default:
+		slog.ErrorContext(r.Context(), "Admin request failed", "error", err)
+	}
+	writeError(w, r, config.ProtocolOpenAI, status, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
+	}
+}
+
+// writeConfigJSON answers configuration entries with the field names of the
+// configuration file and without empty fields, so that a listed entry can
+// be sent back as it is. A list is wrapped in an object under key.
+func writeConfigJSON(w http.ResponseWriter, r *http.Request, status int, key string, v any) {
+	data, err := yaml.MarshalWithOptions(v, yaml.JSON(), yaml.OmitEmpty())
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if key == "" {
+		writeJSON(w, r, status, json.RawMessage(data))
+		return
+	}
+	writeJSON(w, r, status, map[string]json.RawMessage{key: data})
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestProxyServer_Admin(t *testing.T) {
+	t.Setenv("TEST_OPENAI_KEY", "sk-openai-secret")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(`# Proxy settings
+upstreams:
+  - name: openai
+    baseURL: "https://api.openai.com"
+    apiKey: "${TEST_OPENAI_KEY}"
+modelMappings:
+  gpt-fast: openai/gpt-4o-mini
+clients:
+  - name: alice
+    key: "sk-proxy-alice"
+admin:
+  port: "4001"
+  token: "admin-token"
+`), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	store := usage.NewMemoryStore()
+	proxy, err := NewProxyServer(cfg, &MockHTTPClient{}, WithConfigFile(path), WithUsageStore(store))
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	handler := proxy.adminHandler()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("requires the token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/admin/mappings", nil)
+		req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("mappings", func(t *testing.T) {
+		w := do("PUT", "/admin/mappings/claude-fast", `{"target": "openai/gpt-4.1-mini", "fallbacks": ["gpt-4o-mini"]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if route := proxy.current.Load().resolveRoute("claude-fast"); route.model != "gpt-4.1-mini" {
+			t.Errorf("Expected the mapping to be reloaded, got %s", route.model)
+		}
+
+		w = do("GET", "/admin/mappings", "")
+		var listed struct {
+			Mappings []mappingView `json:"mappings"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+			t.Fatalf("Failed to decode mappings: %v", err)
+		}
+		if len(listed.Mappings) != 2 || listed.Mappings[0].Model != "claude-fast" || listed.Mappings[0].Fallbacks[0] != "gpt-4o-mini" {
+			t.Errorf("Expected two mappings, got %+v", listed.Mappings)
+		}
+
+		// An edit leaving the configuration invalid is rejected.
+		before, _ := os.ReadFile(path)
+		w = do("PUT", "/admin/mappings/claude-fast", `{"target": "openai/gpt-4.1-mini", "fallbacks": [""]}`)
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "must not be empty") {
+			t.Errorf("Expected status 422 for an invalid edit, got %d: %s", w.Code, w.Body.String())
+		}
+		if after, _ := os.ReadFile(path); string(after) != string(before) {
+			t.Errorf("Expected the file to be unchanged, got:\n%s", after)
+		}
+
+		if w := do("DELETE", "/admin/mappings/claude-fast", ""); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+		if w := do("DELETE", "/admin/mappings/claude-fast", ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("upstreams", func(t *testing.T) {
+		w := do("GET", "/admin/upstreams", "")
+		if strings.Contains(w.Body.String(), "sk-openai-secret") || !strings.Contains(w.Body.String(), `"apiKey":"****cret"`) {
+			t.Errorf("Expected the upstream key to be masked, got %s", w.Body.String())
+		}
+
+		w = do("PUT", "/admin/upstreams/openai", `{"baseURL": "https://eu.api.openai.com", "apiKey": "****cret", "strategy": "least-in-flight"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		data, _ := os.ReadFile(path)
+		if !strings.Contains(string(data), "${TEST_OPENAI_KEY}") || !strings.Contains(string(data), "https://eu.api.openai.com") {
+			t.Errorf("Expected the key reference to be kept and the URL changed, got:\n%s", data)
+		}
+		if !strings.Contains(string(data), "# Proxy settings") {
+			t.Errorf("Expected comments to be kept, got:\n%s", data)
+		}
+
+		if w := do("PUT", "/admin/upstreams/openai", `{"baseURL": "https://api.openai.com", "retries": 3}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an unknown field, got %d", w.Code)
+		}
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		w := do("POST", "/admin/keys", `{"name": "bob", "models": ["gpt-*"]}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var created config.Client
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatalf("Failed to decode key: %v", err)
+		}
+		if !strings.HasPrefix(created.Key, "sk-proxy-") {
+			t.Errorf("Expected a generated key, got %q", created.Key)
+		}
+		if w := do("POST", "/admin/keys", `{"name": "bob"}`); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for an existing client, got %d", w.Code)
+		}
+
+		w = do("PUT", "/admin/keys/bob", `{"team": "", "models": ["claude-*"]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		reloaded := proxy.current.Load().config.Clients
+		if len(reloaded) != 2 || reloaded[1].Key != created.Key || reloaded[1].Models[0] != "claude-*" {
+			t.Errorf("Expected bob's models changed and key kept, got %+v", reloaded)
+		}
+
+		w = do("GET", "/admin/keys", "")
+		if strings.Contains(w.Body.String(), created.Key) {
+			t.Errorf("Expected keys to be masked, got %s", w.Body.String())
+		}
+
+		if w := do("DELETE", "/admin/keys/bob", ""); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+		if w := do("PUT", "/admin/keys/bob", `{"models": []}`); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		record := usage.Record{
+			Time:     time.Now(),
+			Client:   "alice",
+			Model:    "gpt-fast",
+			Upstream: "openai",
+			Usage:    usage.Usage{InputTokens: 100, OutputTokens: 20},
+		}
+		if err := store.Record(context.Background(), record); err != nil {
+			t.Fatalf("Failed to record usage: %v", err)
+		}
+
+		w := do("GET", "/admin/usage?client=alice&since=2000-01-01", "")
+		var report struct {
+			Total struct {
+				Requests int         `json:"requests"`
+				Usage    usage.Usage `json:"usage"`
+			} `json:"total"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode usage: %v", err)
+		}
+		if report.Total.Requests != 1 || report.Total.Usage.InputTokens != 100 {
+			t.Errorf("Expected one request with 100 input tokens, got %+v", report.Total)
+		}
+
+		if w := do("GET", "/admin/usage?since=yesterday", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an invalid time, got %d", w.Code)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte(`upstreamURL: "https://api.example.com"
+admin:
+  port: "4001"
+  token: "rotated-token"
+`), 0o600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if w := do("POST", "/admin/reload", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := do("GET", "/admin/mappings", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the rotated token to be required, got %d", w.Code)
+		}
+	})
+}
+
+func TestProxyServer_InFlightRequests(t *testing.T) {
+	proxy, err := NewProxyServer(&config.Config{UpstreamURL: "https://api.example.com"}, &MockHTTPClient{})
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	handler := chainMiddleware(proxy.observe, proxy.track)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callInfoFromContext(r.Context()).setRoute("gpt-fast", route{upstream: proxy.current.Load().defaultUpstream, model: "gpt-4o-mini"}, true, true)
+		close(arrived)
+		<-release
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	}()
+	<-arrived
+
+	requests := proxy.inFlight.list(time.Now())
+	if len(requests) != 1 || requests[0].Model != "gpt-fast" || requests[0].Upstream != "default" || !requests[0].Stream {
+		t.Errorf("Expected the streamed request to be listed, got %+v", requests)
+	}
+
+	close(release)
+	<-done
+	if requests := proxy.inFlight.list(time.Now()); len(requests) != 0 {
+		t.Errorf("Expected no requests in flight, got %+v", requests)
+	}
+}
+
+func TestProxyServer_Dashboard(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", Budget: &config.Budget{HardLimit: 10}},
+		},
+		Admin: config.Admin{Port: "4001", Token: "admin-token", DashboardToken: "dashboard-token"},
+	}
+	proxy, err := NewProxyServer(cfg, &MockHTTPClient{})
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	handler := proxy.adminHandler()
+
+	proxied := chainMiddleware(proxy.observe, proxy.authenticate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callInfoFromContext(r.Context()).setRoute("gpt-fast", route{upstream: proxy.current.Load().defaultUpstream, model: "gpt-4o-mini"}, false, true)
+		if r.URL.Query().Has("fail") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	for _, target := range []string{"/v1/chat/completions", "/v1/chat/completions?fail"} {
+		req := httptest.NewRequest("POST", target, nil)
+		req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+		proxied.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/admin/stats", nil)
+		req.Header.Set("Authorization", "Bearer dashboard-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var stats struct {
+			RequestsPerMinute int              `json:"requestsPerMinute"`
+			ErrorRate         float64          `json:"errorRate"`
+			Series            []activityBucket `json:"series"`
+			Keys              []keySpend       `json:"keys"`
+			Failures          []failedRequest  `json:"failures"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		if stats.RequestsPerMinute != 2 || stats.ErrorRate != 0.5 {
+			t.Errorf("Expected 2 requests with half failed, got %d and %g", stats.RequestsPerMinute, stats.ErrorRate)
+		}
+		var counted int
+		for _, bucket := range stats.Series {
+			counted += bucket.Requests
+		}
+		if len(stats.Series) != activityBuckets || counted != 2 {
+			t.Errorf("Expected %d buckets counting 2 requests, got %d counting %d", activityBuckets, len(stats.Series), counted)
+		}
+		if len(stats.Keys) != 1 || stats.Keys[0].Client != "alice" || stats.Keys[0].Budget == nil || stats.Keys[0].Budget.HardLimit != 10 {
+			t.Errorf("Expected alice's budget, got %+v", stats.Keys)
+		}
+		if len(stats.Failures) != 1 || stats.Failures[0].Status != http.StatusBadGateway || stats.Failures[0].Client != "alice" || stats.Failures[0].UpstreamModel != "gpt-4o-mini" {
+			t.Errorf("Expected the failed request, got %+v", stats.Failures)
+		}
+	})
+
+	t.Run("dashboard token is read-only", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/admin/keys", nil)
+		req.Header.Set("Authorization", "Bearer dashboard-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/admin/stats") {
+			t.Errorf("Expected the dashboard page, got %d", w.Code)
+		}
+	})
+}
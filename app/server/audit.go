@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/audit"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+)
+
+// auditCall collects the audit record of a sampled completion call while it
+// is handled. Bodies and stream text are kept up to one byte beyond the
+// limit, so that the audit log can tell they were cut.
+type auditCall struct {
+	record audit.Record
+	limit  int
+	text   strings.Builder
+}
+
+func withAuditCall(ctx context.Context, call *auditCall) context.Context {
+	return context.WithValue(ctx, auditCallContextKey, call)
+}
+
+// auditCallFromContext returns the audit record of the request, or nil when
+// the request is not audited.
+func auditCallFromContext(ctx context.Context) *auditCall {
+	call, _ := ctx.Value(auditCallContextKey).(*auditCall)
+	return call
+}
+
+// setRoute records the model routing of the call.
+func (c *auditCall) setRoute(model string, route route, stream bool) {
+	if c == nil {
+		return
+	}
+	c.record.Model = model
+	c.record.UpstreamModel = route.model
+	c.record.Upstream = route.upstream.name
+	c.record.Stream = stream
+}
+
+// setUsage records the token usage of the call.
+func (c *auditCall) setUsage(u usage.Usage) {
+	if c == nil {
+		return
+	}
+	c.record.Usage = &u
+}
+
+// addText appends text streamed to the client.
+func (c *auditCall) addText(text string) {
+	if c == nil || c.text.Len() > c.limit {
+		return
+	}
+	c.text.WriteString(text[:min(len(text), c.limit+1-c.text.Len())])
+}
+
+// auditWriter keeps the status and, unless it is a stream of events, the
+// body of the response.
+type auditWriter struct {
+	http.ResponseWriter
+	call   *auditCall
+	status int
+	stream bool
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+		w.stream = isEventStream(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.stream && w.body.Len() <= w.call.limit {
+		w.body.Write(b[:min(len(b), w.call.limit+1-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (w *auditWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// startAudit begins the audit record of a completion call when an audit log
+// is configured and samples the call. It returns the writer and request to
+// handle the call with, and a function writing the record once the call is
+// done.
+func (p *ProxyServer) startAudit(w http.ResponseWriter, r *http.Request, clientProtocol string, body []byte) (http.ResponseWriter, *http.Request, func()) {
+	if p.auditLog == nil || !p.auditLog.Sampled() {
+		return w, r, func() {}
+	}
+
+	startsAt := time.Now()
+	limit := p.auditLog.MaxBodySize()
+	call := &auditCall{
+		record: audit.Record{Time: startsAt, Protocol: clientProtocol, Request: body[:min(len(body), limit+1)]},
+		limit:  limit,
+	}
+	writer := &auditWriter{ResponseWriter: w, call: call}
+	r = r.WithContext(withAuditCall(r.Context(), call))
+
+	return writer, r, func() {
+		record := call.record
+		record.RequestID = requestIDFromContext(r.Context())
+		record.Client = clientName(r.Context())
+		record.Status = writer.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.Seconds = time.Since(startsAt).Seconds()
+		if writer.stream {
+			record.StreamText = call.text.String()
+		} else {
+			record.Response = writer.body.Bytes()
+		}
+
+		if err := p.auditLog.Write(record); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write audit record", "error", err)
+		}
+	}
+}
+
+// eventText returns the text carried by an upstream stream event: the
+// content delta of the first choice of a chat completions chunk, or the text
+// delta of a messages event.
+func eventText(data []byte) string {
+	var event struct {
+		Choices []struct {
+			Index int `json:"index"`
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Delta struct {
+			Text string `json:"text"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return ""
+	}
+
+	text := event.Delta.Text
+	for _, choice := range event.Choices {
+		if choice.Index == 0 {
+			text += choice.Delta.Content
+		}
+	}
+	return text
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// client is a caller identified by its virtual API key.
+type client struct {
+	name   string
+	team   string
+	models []string
+}
+
+// allows reports whether the caller may use a local model name.
+func (c *client) allows(model string) bool {
+	if len(c.models) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey int
+
+const (
+	clientContextKey contextKey = iota
+	rateReservationContextKey
+	callInfoContextKey
+	stateContextKey
+	auditCallContextKey
+	requestIDContextKey
+)
+
+// newClients indexes clients by the SHA-256 digest of their key, so that
+// lookups do not compare secrets byte by byte.
+func newClients(cfgs []config.Client) (map[[sha256.Size]byte]*client, error) {
+	clients := make(map[[sha256.Size]byte]*client, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("client name is required")
+		}
+		if cfg.Key == "" {
+			return nil, fmt.Errorf("key is required for client %s", cfg.Name)
+		}
+
+		for _, pattern := range cfg.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid model pattern %q for client %s: %w", pattern, cfg.Name, err)
+			}
+		}
+
+		digest := sha256.Sum256([]byte(cfg.Key))
+		if _, exists := clients[digest]; exists {
+			return nil, fmt.Errorf("duplicate key for client %s", cfg.Name)
+		}
+		clients[digest] = &client{name: cfg.Name, team: cfg.Team, models: cfg.Models}
+	}
+	return clients, nil
+}
+
+func withClient(ctx context.Context, c *client) context.Context {
+	return context.WithValue(ctx, clientContextKey, c)
+}
+
+// clientFromContext returns the authenticated caller, or nil when client
+// authentication is disabled.
+func clientFromContext(ctx context.Context) *client {
+	c, _ := ctx.Value(clientContextKey).(*client)
+	return c
+}
+
+// clientName returns the name of the authenticated caller, or an empty
+// string when client authentication is disabled.
+func clientName(ctx context.Context) string {
+	if c := clientFromContext(ctx); c != nil {
+		return c.name
+	}
+	return ""
+}
+
+// clientKey returns the API key presented by the caller, accepting both the
+// OpenAI-style Authorization header and the Anthropic-style x-api-key header.
+func clientKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// protocolForPath returns the protocol whose error shape suits the request
+// path.
+func protocolForPath(path string) string {
+	if strings.HasPrefix(path, "/v1/messages") {
+		return config.ProtocolAnthropic
+	}
+	return config.ProtocolOpenAI
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+const (
+	defaultBreakerMinRequests = 10
+	defaultBreakerWindow      = time.Minute
+	defaultBreakerCoolDown    = 30 * time.Second
+)
+
+// errCircuitOpen is returned for calls to an upstream whose circuit breaker
+// is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops calls to an upstream once the failure rate within a
+// window crosses a threshold. After a cool-down, a single probe call is let
+// through in the half-open state: its success closes the breaker, its
+// failure opens it again. A nil breaker always allows calls.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	failureRate float64
+	minRequests int
+	window      time.Duration
+	coolDown    time.Duration
+
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+
+	// onChange is called with the new state on every transition, with mu
+	// held.
+	onChange func(breakerState)
+}
+
+func newCircuitBreaker(cfg config.CircuitBreaker, now time.Time) (*circuitBreaker, error) {
+	if cfg.FailureRate == 0 {
+		return nil, nil
+	}
+	if cfg.FailureRate < 0 || cfg.FailureRate > 1 {
+		return nil, fmt.Errorf("circuit breaker failureRate must be between 0 and 1, got %g", cfg.FailureRate)
+	}
+	if cfg.MinRequests < 0 || cfg.Window < 0 || cfg.CoolDown < 0 {
+		return nil, fmt.Errorf("circuit breaker settings must not be negative")
+	}
+
+	b := &circuitBreaker{
+		failureRate: cfg.FailureRate,
+		minRequests: cfg.MinRequests,
+		window:      cfg.Window,
+		coolDown:    cfg.CoolDown,
+		windowStart: now,
+	}
+	if b.minRequests == 0 {
+		b.minRequests = defaultBreakerMinRequests
+	}
+	if b.window == 0 {
+		b.window = defaultBreakerWindow
+	}
+	if b.coolDown == 0 {
+		b.coolDown = defaultBreakerCoolDown
+	}
+	return b, nil
+}
+
+// transition changes the state. Callers must hold mu.
+func (b *circuitBreaker) transition(state breakerState, now time.Time) {
+	b.state = state
+	b.requests, b.failures = 0, 0
+	b.windowStart = now
+	b.probing = false
+	if state == breakerOpen {
+		b.openedAt = now
+	}
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+// refresh moves an open breaker to half-open once the cool-down is over.
+// Callers must hold mu.
+func (b *circuitBreaker) refresh(now time.Time) {
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.coolDown {
+		b.transition(breakerHalfOpen, now)
+	}
+}
+
+// allow reports whether a call may be sent. In the half-open state only one
+// probe is in flight at a time; its outcome must be reported through
+// record or cancel.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh(now)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// sendThroughBreaker sends an upstream call unless the upstream's circuit
+// breaker is open, reporting the outcome of the call to the breaker.
+func (p *ProxyServer) sendThroughBreaker(ctx context.Context, u *upstream, newRequest func(e *endpoint) (*http.Request, error)) (*http.Response, error) {
+	if !u.breaker.allow(time.Now()) {
+		return nil, fmt.Errorf("upstream %s: %w", u.name, errCircuitOpen)
+	}
+
+	resp, err := p.send(u, newRequest)
+	if err != nil && ctx.Err() != nil {
+		u.breaker.cancel()
+	} else {
+		u.breaker.record(err != nil || resp.StatusCode >= http.StatusInternalServerError, time.Now())
+	}
+	return resp, err
+}
+
+// record reports the outcome of an allowed call.
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.transition(breakerOpen, now)
+		} else {
+			b.transition(breakerClosed, now)
+		}
+	case breakerClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.requests, b.failures = 0, 0
+			b.windowStart = now
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.failureRate {
+			b.transition(breakerOpen, now)
+		}
+	}
+}
+
+// cancel reports an allowed call that ended without an outcome, such as one
+// abandoned by the client.
+func (b *circuitBreaker) cancel() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// currentState returns the state, moving to half-open when the cool-down is
+// over.
+func (b *circuitBreaker) currentState(now time.Time) breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refresh(now)
+	return b.state
+}
+
+// upstreamHealth is the health of one upstream reported by /health.
+type upstreamHealth struct {
+	Name    string `json:"name"`
+	Circuit string `json:"circuit"`
+}
+
+// writeBreakerHealth reports the breaker state of the upstreams. The status
+// is "degraded" while any breaker is not closed; the proxy itself still
+// answers 200 so that it is not restarted for an upstream outage.
+func writeBreakerHealth(w http.ResponseWriter, r *http.Request, upstreams []*upstream) {
+	health := struct {
+		Status    string           `json:"status"`
+		Upstreams []upstreamHealth `json:"upstreams"`
+	}{Status: "ok"}
+
+	now := time.Now()
+	for _, u := range upstreams {
+		state := u.breaker.currentState(now)
+		if state != breakerClosed {
+			health.Status = "degraded"
+		}
+		health.Upstreams = append(health.Upstreams, upstreamHealth{Name: u.name, Circuit: state.String()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
+	}
+}
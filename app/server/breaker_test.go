@@ -0,0 +1,174 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b, err := newCircuitBreaker(config.CircuitBreaker{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, CoolDown: 10 * time.Second}, now)
+	if err != nil {
+		t.Fatalf("Failed to create circuit breaker: %v", err)
+	}
+
+	for _, failed := range []bool{true, false, true} {
+		if !b.allow(now) {
+			t.Fatal("Expected closed breaker to allow calls")
+		}
+		b.record(failed, now)
+	}
+	if state := b.currentState(now); state != breakerClosed {
+		t.Fatalf("Expected breaker to stay closed below minRequests, got %s", state)
+	}
+
+	b.record(false, now)
+	if state := b.currentState(now); state != breakerOpen {
+		t.Fatalf("Expected breaker to open at 50%% failures, got %s", state)
+	}
+	if b.allow(now.Add(5 * time.Second)) {
+		t.Error("Expected open breaker to reject calls during the cool-down")
+	}
+
+	probeAt := now.Add(10 * time.Second)
+	if !b.allow(probeAt) {
+		t.Fatal("Expected half-open breaker to allow a probe")
+	}
+	if b.allow(probeAt) {
+		t.Error("Expected half-open breaker to allow a single probe")
+	}
+
+	b.record(true, probeAt)
+	if state := b.currentState(probeAt); state != breakerOpen {
+		t.Fatalf("Expected failed probe to reopen the breaker, got %s", state)
+	}
+
+	probeAt = probeAt.Add(10 * time.Second)
+	if !b.allow(probeAt) {
+		t.Fatal("Expected half-open breaker to allow a probe")
+	}
+	b.cancel()
+	if !b.allow(probeAt) {
+		t.Fatal("Expected a cancelled probe to let another probe through")
+	}
+	b.record(false, probeAt)
+	if state := b.currentState(probeAt); state != breakerClosed {
+		t.Errorf("Expected successful probe to close the breaker, got %s", state)
+	}
+
+	if b, err := newCircuitBreaker(config.CircuitBreaker{}, now); b != nil || err != nil {
+		t.Errorf("Expected no breaker without a failure rate, got %v, %v", b, err)
+	}
+	if _, err := newCircuitBreaker(config.CircuitBreaker{FailureRate: 1.5}, now); err == nil {
+		t.Error("Expected error for failure rate above 1")
+	}
+}
+
+func TestProxyServer_CircuitBreaker(t *testing.T) {
+	var calls int
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       io.NopCloser(strings.NewReader(`{"error": {"message": "down"}}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL:    "https://api.example.com",
+		CircuitBreaker: config.CircuitBreaker{FailureRate: 1, MinRequests: 2, CoolDown: time.Hour},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": []}`))
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, req)
+		return recorder
+	}
+
+	for range 2 {
+		if recorder := send(); recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected upstream 503 to be relayed, got %d", recorder.Code)
+		}
+	}
+
+	recorder := send()
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "Upstream default is unavailable") {
+		t.Errorf("Expected open breaker to fail fast, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("Expected open breaker to skip the upstream, got %d calls", calls)
+	}
+
+	health := httptest.NewRecorder()
+	proxy.HandleHealth(health, httptest.NewRequest("GET", "/health", nil))
+	if health.Code != http.StatusOK || !strings.Contains(health.Body.String(), `"circuit":"open"`) || !strings.Contains(health.Body.String(), `"status":"degraded"`) {
+		t.Errorf("Expected health to report the open breaker, got %d: %s", health.Code, health.Body.String())
+	}
+
+	metrics := httptest.NewRecorder()
+	proxy.HandleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `llm_proxy_circuit_breaker_state{upstream="default"} 1`) {
+		t.Errorf("Expected metrics to report the open breaker, got:\n%s", metrics.Body.String())
+	}
+}
+
+func TestProxyServer_CircuitBreakerOtherEndpoints(t *testing.T) {
+	var calls int
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusBadGateway,
+				Body:       io.NopCloser(strings.NewReader(`{"error": {"message": "down"}}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL:    "https://api.example.com",
+		CircuitBreaker: config.CircuitBreaker{FailureRate: 1, MinRequests: 2, CoolDown: time.Hour},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	models := httptest.NewRecorder()
+	proxy.HandleModels(models, httptest.NewRequest("GET", "/v1/models", nil))
+	embeddings := httptest.NewRecorder()
+	proxy.HandleDefault(embeddings, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "text-embedding-3-small"}`)))
+	if models.Code != http.StatusBadGateway || embeddings.Code != http.StatusBadGateway {
+		t.Fatalf("Expected upstream 502s to be relayed, got %d and %d", models.Code, embeddings.Code)
+	}
+	if state := proxy.state(t.Context()).defaultUpstream.breaker.currentState(time.Now()); state != breakerOpen {
+		t.Fatalf("Expected failures of other endpoints to open the breaker, got %s", state)
+	}
+
+	models = httptest.NewRecorder()
+	proxy.HandleModels(models, httptest.NewRequest("GET", "/v1/models", nil))
+	embeddings = httptest.NewRecorder()
+	proxy.HandleDefault(embeddings, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "text-embedding-3-small"}`)))
+	if models.Code != http.StatusServiceUnavailable || embeddings.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected open breaker to fail fast, got %d and %d", models.Code, embeddings.Code)
+	}
+	if calls != 2 {
+		t.Errorf("Expected open breaker to skip the upstream, got %d calls", calls)
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// budget tracks the dollar spend of a key or team in the current window.
+type budget struct {
+	mu        sync.Mutex
+	scope     string
+	window    string
+	softLimit float64
+	hardLimit float64
+	start     time.Time
+	spent     float64
+
+	// loaded is set once the spend recorded before the budget was created
+	// has been charged to it.
+	loaded bool
+}
+
+func newBudget(scope string, cfg config.Budget, now time.Time) (*budget, error) {
+	if cfg.Window == "" {
+		cfg.Window = config.BudgetWindowMonthly
+	}
+	if cfg.Window != config.BudgetWindowDaily && cfg.Window != config.BudgetWindowMonthly {
+		return nil, fmt.Errorf("invalid budget window %q for %s", cfg.Window, scope)
+	}
+	if cfg.SoftLimit < 0 || cfg.HardLimit < 0 {
+		return nil, fmt.Errorf("budget limits for %s must not be negative", scope)
+	}
+
+	return &budget{
+		scope:     scope,
+		window:    cfg.Window,
+		softLimit: cfg.SoftLimit,
+		hardLimit: cfg.HardLimit,
+		start:     windowStart(cfg.Window, now),
+	}, nil
+}
+
+// windowStart returns the start of the UTC day or month containing now.
+func windowStart(window string, now time.Time) time.Time {
+	now = now.UTC()
+	if window == config.BudgetWindowDaily {
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// windowEnd returns the start of the window following the one beginning at
+// start.
+func windowEnd(window string, start time.Time) time.Time {
+	if window == config.BudgetWindowDaily {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// roll starts a new window, forgetting the spend, once now has left the
+// current one. Callers must hold mu.
+func (b *budget) roll(now time.Time) {
+	if start := windowStart(b.window, now); start.After(b.start) {
+		b.start = start
+		b.spent = 0
+	}
+}
+
+// add charges a cost to the window containing now.
+func (b *budget) add(cost float64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(now)
+	b.spent += cost
+}
+
+// budgetStatus is the state of a budget when a request is admitted.
+type budgetStatus struct {
+	scope     string
+	spent     float64
+	softLimit float64
+	hardLimit float64
+	reset     time.Time
+}
+
+func (s budgetStatus) exceeded() bool {
+	return s.hardLimit > 0 && s.spent >= s.hardLimit
+}
+
+func (s budgetStatus) warning() bool {
+	return s.softLimit > 0 && s.spent >= s.softLimit
+}
+
+func (b *budget) status(now time.Time) budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(now)
+	return budgetStatus{
+		scope:     b.scope,
+		spent:     b.spent,
+		softLimit: b.softLimit,
+		hardLimit: b.hardLimit,
+		reset:     windowEnd(b.window, b.start),
+	}
+}
+
+// newBudgets returns the budgets of client keys by client name and of teams
+// by team name.
+func newBudgets(cfg *config.Config, now time.Time) (map[string]*budget, map[string]*budget, error) {
+	teamBudgets := make(map[string]*budget)
+	teams := make(map[string]bool, len(cfg.Teams))
+	for _, t := range cfg.Teams {
+		if t.Name == "" {
+			return nil, nil, fmt.Errorf("team name is required")
+		}
+		if teams[t.Name] {
+			return nil, nil, fmt.Errorf("duplicate team name: %s", t.Name)
+		}
+		teams[t.Name] = true
+
+		if t.Budget == nil {
+			continue
+		}
+		b, err := newBudget("team "+t.Name, *t.Budget, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		teamBudgets[t.Name] = b
+	}
+
+	keyBudgets := make(map[string]*budget)
+	for _, c := range cfg.Clients {
+		if c.Team != "" && !teams[c.Team] {
+			return nil, nil, fmt.Errorf("unknown team %s for client %s", c.Team, c.Name)
+		}
+
+		if c.Budget == nil {
+			continue
+		}
+		b, err := newBudget("API key "+c.Name, *c.Budget, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyBudgets[c.Name] = b
+	}
+
+	return keyBudgets, teamBudgets, nil
+}
+
+// budgetsFor returns the budgets a client's spend counts against.
+func (s *proxyState) budgetsFor(name, team string) []*budget {
+	var budgets []*budget
+	if b, ok := s.keyBudgets[name]; ok {
+		budgets = append(budgets, b)
+	}
+	if b, ok := s.teamBudgets[team]; ok {
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// price returns the price of a call. Unpriced models cost nothing.
+func (s *proxyState) price(upstreamModel, model string) config.Price {
+	return s.config.Price(upstreamModel, model)
+}
+
+// loadSpend charges the usage already recorded in the current windows to
+// budgets that were not loaded yet, so that spend survives a restart with a
+// persistent store and a reload changing a budget.
+func (s *proxyState) loadSpend(ctx context.Context, store usage.Store, now time.Time) error {
+	var pending []*budget
+	for _, budgets := range []map[string]*budget{s.keyBudgets, s.teamBudgets} {
+		for _, b := range budgets {
+			if !b.loaded {
+				pending = append(pending, b)
+			}
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	teams := make(map[string]string, len(s.config.Clients))
+	for _, c := range s.config.Clients {
+		teams[c.Name] = c.Team
+	}
+
+	for _, window := range []string{config.BudgetWindowDaily, config.BudgetWindowMonthly} {
+		summaries, err := store.Summarize(ctx, usage.Filter{Since: windowStart(window, now)})
+		if err != nil {
+			return fmt.Errorf("failed to load spend: %w", err)
+		}
+
+		for _, summary := range summaries {
+			cost := summary.Cost(s.price(summary.UpstreamModel, summary.Model))
+			for _, b := range s.budgetsFor(summary.Client, teams[summary.Client]) {
+				if b.window == window && !b.loaded {
+					b.add(cost, now)
+				}
+			}
+		}
+	}
+
+	for _, b := range pending {
+		b.loaded = true
+	}
+	return nil
+}
+
+// checkBudget refuses the request with 402 once a budget of the caller is
+// exhausted, and warns through the X-Budget-Warning header once a soft limit
+// is crossed. It reports whether the request may proceed.
+func (p *ProxyServer) checkBudget(w http.ResponseWriter, r *http.Request, protocol string) bool {
+	c := clientFromContext(r.Context())
+	if c == nil {
+		return true
+	}
+
+	now := time.Now()
+	for _, b := range p.state(r.Context()).budgetsFor(c.name, c.team) {
+		status := b.status(now)
+		if status.exceeded() {
+			w.Header().Set("Retry-After", retryAfterSeconds(status.reset.Sub(now)))
+			writeError(w, r, protocol, http.StatusPaymentRequired, fmt.Sprintf(
+				"Budget of $%.2f exceeded for %s, resets at %s",
+				status.hardLimit, status.scope, status.reset.Format(time.RFC3339),
+			))
+			return false
+		}
+		if status.warning() {
+			w.Header().Add("X-Budget-Warning", fmt.Sprintf(
+				"$%.2f of $%.2f soft limit spent for %s",
+				status.spent, status.softLimit, status.scope,
+			))
+		}
+	}
+	return true
+}
+
+// chargeBudgets adds the cost of a completed call to the caller's budgets.
+func (p *ProxyServer) chargeBudgets(ctx context.Context, c *client, route route, model string, u usage.Usage) {
+	if c == nil {
+		return
+	}
+
+	state := p.state(ctx)
+	cost := u.Cost(state.price(route.model, model))
+	if cost == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, b := range state.budgetsFor(c.name, c.team) {
+		b.add(cost, now)
+	}
+}
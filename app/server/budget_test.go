@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestBudget_Window(t *testing.T) {
+	now := time.Date(2025, 3, 31, 23, 30, 0, 0, time.UTC)
+	b, err := newBudget("test", config.Budget{Window: config.BudgetWindowDaily, HardLimit: 1}, now)
+	if err != nil {
+		t.Fatalf("Failed to create budget: %v", err)
+	}
+
+	b.add(1, now)
+	status := b.status(now)
+	if !status.exceeded() {
+		t.Fatalf("Expected budget to be exceeded, got %+v", status)
+	}
+	if expected := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC); !status.reset.Equal(expected) {
+		t.Errorf("Expected reset at %s, got %s", expected, status.reset)
+	}
+
+	if status := b.status(now.Add(time.Hour)); status.exceeded() || status.spent != 0 {
+		t.Errorf("Expected spend to reset in the next window, got %+v", status)
+	}
+
+	if _, err := newBudget("test", config.Budget{Window: "weekly"}, now); err == nil {
+		t.Error("Expected error for invalid window")
+	}
+}
+
+func TestProxyServer_Budget(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"model":"gpt-4o","usage":{"prompt_tokens":1000,"completion_tokens":1000}}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", Team: "research", Budget: &config.Budget{SoftLimit: 0.01}},
+			{Name: "bob", Key: "sk-proxy-bob", Team: "research"},
+			{Name: "carol", Key: "sk-proxy-carol"},
+		},
+		Teams: []config.Team{
+			{Name: "research", Budget: &config.Budget{Window: config.BudgetWindowDaily, HardLimit: 0.04}},
+		},
+		Prices: map[string]config.Price{
+			"gpt-4o": {Input: 5, Output: 10},
+		},
+	}
+
+	// A previous run already spent $0.015 of the team budget.
+	store := usage.NewMemoryStore()
+	if err := store.Record(context.Background(), usage.Record{
+		Time:   time.Now(),
+		Client: "bob",
+		Model:  "gpt-4o",
+		Usage:  usage.Usage{InputTokens: 1000, OutputTokens: 1000},
+	}); err != nil {
+		t.Fatalf("Failed to record usage: %v", err)
+	}
+
+	proxy, err := NewProxyServer(config, mockClient, WithUsageStore(store))
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	handler := proxy.authenticate(http.HandlerFunc(proxy.HandleChatCompletions))
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": []}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := send("sk-proxy-alice")
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected first request to pass, got %d", first.Code)
+	}
+	if warning := first.Header().Get("X-Budget-Warning"); warning != "" {
+		t.Errorf("Expected no budget warning before the soft limit, got %s", warning)
+	}
+
+	second := send("sk-proxy-alice")
+	if second.Code != http.StatusOK {
+		t.Fatalf("Expected second request to pass, got %d", second.Code)
+	}
+	if warning := second.Header().Get("X-Budget-Warning"); !strings.Contains(warning, "API key alice") {
+		t.Errorf("Expected budget warning for API key alice, got %q", warning)
+	}
+
+	// The team has now spent $0.045 of its $0.04 hard limit.
+	refused := send("sk-proxy-bob")
+	if refused.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected team budget to refuse request, got %d", refused.Code)
+	}
+	if !strings.Contains(refused.Body.String(), "team research") {
+		t.Errorf("Expected error to name team research, got %s", refused.Body.String())
+	}
+	if refused.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	if other := send("sk-proxy-carol"); other.Code != http.StatusOK {
+		t.Errorf("Expected client outside the team to pass, got %d", other.Code)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"embed"
+	"io/fs"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// topModels bounds the number of models listed by /admin/stats.
+const topModels = 10
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the static dashboard page. The page holds no
+// data; it asks for a token and reads /admin/stats with it.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServerFS(files))
+}
+
+// authenticateStats accepts the admin token or the read-only dashboard
+// token.
+func (p *ProxyServer) authenticateStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := p.current.Load().config.Admin
+		key := []byte(clientKey(r))
+		for _, token := range []string{admin.Token, admin.DashboardToken} {
+			if token != "" && subtle.ConstantTimeCompare(key, []byte(token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeError(w, r, config.ProtocolOpenAI, http.StatusUnauthorized, "Invalid admin token")
+	})
+}
+
+// modelStats is the traffic of a local model over the last day.
+type modelStats struct {
+	Model    string  `json:"model"`
+	Requests int     `json:"requests"`
+	Tokens   int     `json:"tokens"`
+	Cost     float64 `json:"cost"`
+}
+
+// keySpend is the month-to-date spend of a client key, with its budget
+// when it has one.
+type keySpend struct {
+	Client   string     `json:"client"`
+	Requests int        `json:"requests"`
+	Cost     float64    `json:"cost"`
+	Budget   *budgetUse `json:"budget,omitempty"`
+}
+
+// budgetUse is the state of a key budget in its current window.
+type budgetUse struct {
+	Window    string    `json:"window"`
+	Spent     float64   `json:"spent"`
+	SoftLimit float64   `json:"softLimit,omitempty"`
+	HardLimit float64   `json:"hardLimit,omitempty"`
+	Reset     time.Time `json:"reset"`
+}
+
+// handleAdminStats answers the figures shown by the dashboard: requests and
+// errors per ten seconds over the last fifteen minutes, the busiest models
+// of the last day, the spend of each key this month and the latest failed
+// requests.
+func (p *ProxyServer) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	state := p.current.Load()
+	cfg := state.config
+
+	series := p.activity.series(now)
+	var lastMinute, lastFiveMinutes activityBucket
+	for i, bucket := range series {
+		if i >= len(series)-int(time.Minute/activityInterval) {
+			lastMinute.Requests += bucket.Requests
+		}
+		if i >= len(series)-int(5*time.Minute/activityInterval) {
+			lastFiveMinutes.Requests += bucket.Requests
+			lastFiveMinutes.Errors += bucket.Errors
+		}
+	}
+	var errorRate float64
+	if lastFiveMinutes.Requests > 0 {
+		errorRate = float64(lastFiveMinutes.Errors) / float64(lastFiveMinutes.Requests)
+	}
+
+	daily, err := p.usageStore.Summarize(r.Context(), usage.Filter{Since: now.Add(-24 * time.Hour)})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	byModel := make(map[string]*modelStats)
+	for _, s := range daily {
+		stats, ok := byModel[s.Model]
+		if !ok {
+			stats = &modelStats{Model: s.Model}
+			byModel[s.Model] = stats
+		}
+		stats.Requests += s.Requests
+		stats.Tokens += s.InputTokens + s.OutputTokens
+		stats.Cost += s.Cost(cfg.Price(s.UpstreamModel, s.Model))
+	}
+	models := make([]modelStats, 0, len(byModel))
+	for _, stats := range byModel {
+		models = append(models, *stats)
+	}
+	slices.SortFunc(models, func(a, b modelStats) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Model, b.Model))
+	})
+	models = models[:min(len(models), topModels)]
+
+	monthly, err := p.usageStore.Summarize(r.Context(), usage.Filter{Since: windowStart(config.BudgetWindowMonthly, now)})
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	byClient := make(map[string]*keySpend)
+	for _, c := range cfg.Clients {
+		byClient[c.Name] = &keySpend{Client: c.Name}
+	}
+	for _, s := range monthly {
+		spend, ok := byClient[s.Client]
+		if !ok {
+			spend = &keySpend{Client: s.Client}
+			byClient[s.Client] = spend
+		}
+		spend.Requests += s.Requests
+		spend.Cost += s.Cost(cfg.Price(s.UpstreamModel, s.Model))
+	}
+	spends := make([]keySpend, 0, len(byClient))
+	for name, spend := range byClient {
+		if b, ok := state.keyBudgets[name]; ok {
+			status := b.status(now)
+			spend.Budget = &budgetUse{
+				Window:    b.window,
+				Spent:     status.spent,
+				SoftLimit: status.softLimit,
+				HardLimit: status.hardLimit,
+				Reset:     status.reset,
+			}
+		}
+		spends = append(spends, *spend)
+	}
+	slices.SortFunc(spends, func(a, b keySpend) int {
+		return cmp.Or(cmp.Compare(b.Cost, a.Cost), cmp.Compare(a.Client, b.Client))
+	})
+
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"time":              now,
+		"requestsPerMinute": lastMinute.Requests,
+		"errorRate":         errorRate,
+		"inFlight":          len(p.inFlight.list(now)),
+		"series":            series,
+		"models":            models,
+		"keys":              spends,
+		"failures":          p.activity.recent(),
+	})
+}
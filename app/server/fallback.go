@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// fallbackHeader names the fallback route that served a request when the
+// mapped model failed.
+const fallbackHeader = "X-Fallback-Model"
+
+// contextLengthErrors are fragments of the error messages providers answer
+// with when a prompt does not fit the model's context window.
+var contextLengthErrors = [][]byte{
+	[]byte("context_length_exceeded"),
+	[]byte("context length"),
+	[]byte("context window"),
+	[]byte("maximum context"),
+	[]byte("prompt is too long"),
+	[]byte("too many tokens"),
+}
+
+// validateFallbacks checks that every fallback chain lists targets.
+func validateFallbacks(cfg *config.Config) error {
+	for model, targets := range cfg.Fallbacks {
+		for _, target := range targets {
+			if target == "" {
+				return fmt.Errorf("empty fallback for model %s", model)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveRoutes returns the mapped route of a local model name followed by
+// its fallbacks, in the order they are tried.
+func (s *proxyState) resolveRoutes(model string) []route {
+	routes := []route{s.resolveRoute(model)}
+	for _, target := range s.fallbacks[model] {
+		routes = append(routes, s.targetRoute(target))
+	}
+	return routes
+}
+
+// shouldFallback reports whether a failed upstream response warrants trying
+// the next route: server errors, including overload, and prompts exceeding
+// the model's context length.
+func shouldFallback(statusCode int, body []byte) bool {
+	if statusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusRequestEntityTooLarge {
+		return false
+	}
+
+	body = bytes.ToLower(body)
+	for _, fragment := range contextLengthErrors {
+		if bytes.Contains(body, fragment) {
+			return true
+		}
+	}
+	return false
+}
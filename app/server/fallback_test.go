@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestProxyServer_Fallback(t *testing.T) {
+	type reply struct {
+		status int
+		body   string
+		err    error
+	}
+
+	tests := []struct {
+		name             string
+		replies          map[string]reply
+		expectedStatus   int
+		expectedFallback string
+		expectedCalls    []string
+	}{
+		{
+			name: "mapped model serves",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions": {status: http.StatusOK},
+			},
+			expectedStatus: http.StatusOK,
+			expectedCalls:  []string{"a:claude-4-sonnet"},
+		},
+		{
+			name: "overloaded upstream falls back",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions": {status: statusOverloaded, body: `{"error": {"message": "Overloaded"}}`},
+				"https://b.example.com/v1/chat/completions": {status: http.StatusOK},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedFallback: "provider-b/claude-sonnet-4",
+			expectedCalls:    []string{"a:claude-4-sonnet", "b:claude-sonnet-4"},
+		},
+		{
+			name: "context length error falls back",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions": {status: http.StatusBadRequest, body: `{"error": {"code": "context_length_exceeded"}}`},
+				"https://b.example.com/v1/chat/completions": {status: http.StatusOK},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedFallback: "provider-b/claude-sonnet-4",
+			expectedCalls:    []string{"a:claude-4-sonnet", "b:claude-sonnet-4"},
+		},
+		{
+			name: "connection failure falls back",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions": {err: errors.New("connection refused")},
+				"https://b.example.com/v1/chat/completions": {status: http.StatusOK},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedFallback: "provider-b/claude-sonnet-4",
+			expectedCalls:    []string{"a:claude-4-sonnet", "b:claude-sonnet-4"},
+		},
+		{
+			name: "client error does not fall back",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions": {status: http.StatusBadRequest, body: `{"error": {"message": "Invalid messages"}}`},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedCalls:  []string{"a:claude-4-sonnet"},
+		},
+		{
+			name: "last error is relayed when every model fails",
+			replies: map[string]reply{
+				"https://a.example.com/v1/chat/completions":   {status: http.StatusInternalServerError},
+				"https://b.example.com/v1/chat/completions":   {status: http.StatusServiceUnavailable},
+				"https://api.example.com/v1/chat/completions": {status: http.StatusBadGateway},
+			},
+			expectedStatus: http.StatusBadGateway,
+			expectedCalls:  []string{"a:claude-4-sonnet", "b:claude-sonnet-4", "api:claude-3-5-sonnet"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					var body struct {
+						Model string `json:"model"`
+					}
+					if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+						t.Fatalf("Failed to decode upstream request: %v", err)
+					}
+					calls = append(calls, strings.Split(req.URL.Host, ".")[0]+":"+body.Model)
+
+					r := tt.replies[req.URL.String()]
+					if r.err != nil {
+						return nil, r.err
+					}
+					if r.body == "" {
+						r.body = `{"model": "` + body.Model + `", "choices": []}`
+					}
+					return &http.Response{
+						StatusCode: r.status,
+						Body:       io.NopCloser(strings.NewReader(r.body)),
+						Header:     make(http.Header),
+					}, nil
+				},
+			}
+
+			config := &config.Config{
+				UpstreamURL: "https://api.example.com",
+				Upstreams: []config.Upstream{
+					{Name: "provider-a", BaseURL: "https://a.example.com"},
+					{Name: "provider-b", BaseURL: "https://b.example.com"},
+				},
+				ModelMappings: map[string]string{
+					"claude-sonnet": "provider-a/claude-4-sonnet",
+				},
+				Fallbacks: map[string][]string{
+					"claude-sonnet": {"provider-b/claude-sonnet-4", "claude-3-5-sonnet"},
+				},
+			}
+
+			proxy, err := NewProxyServer(config, mockClient)
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude-sonnet", "messages": []}`))
+			recorder := httptest.NewRecorder()
+			proxy.HandleChatCompletions(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, recorder.Code)
+			}
+			if fallback := recorder.Header().Get(fallbackHeader); fallback != tt.expectedFallback {
+				t.Errorf("Expected fallback header %q, got %q", tt.expectedFallback, fallback)
+			}
+			if strings.Join(calls, ",") != strings.Join(tt.expectedCalls, ",") {
+				t.Errorf("Expected calls %v, got %v", tt.expectedCalls, calls)
+			}
+			if recorder.Code == http.StatusOK && !strings.Contains(recorder.Body.String(), `"model":"claude-sonnet"`) {
+				t.Errorf("Expected response to report the local model, got %s", recorder.Body.String())
+			}
+		})
+	}
+}
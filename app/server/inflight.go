@@ -0,0 +1,105 @@
+package server
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// inFlightRequest is a request being served.
+type inFlightRequest struct {
+	id      uint64
+	method  string
+	path    string
+	client  string
+	started time.Time
+	info    *callInfo
+}
+
+// inFlightRequests lists the requests being served, for the admin API.
+type inFlightRequests struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]*inFlightRequest
+}
+
+func newInFlightRequests() *inFlightRequests {
+	return &inFlightRequests{requests: make(map[uint64]*inFlightRequest)}
+}
+
+func (t *inFlightRequests) add(req *inFlightRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	req.id = t.nextID
+	t.requests[req.id] = req
+}
+
+func (t *inFlightRequests) remove(req *inFlightRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, req.id)
+}
+
+// inFlightView is an in-flight request as listed by the admin API.
+type inFlightView struct {
+	ID            uint64    `json:"id"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Client        string    `json:"client,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	UpstreamModel string    `json:"upstreamModel,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Stream        bool      `json:"stream"`
+	Started       time.Time `json:"started"`
+	Seconds       float64   `json:"seconds"`
+}
+
+// list returns the requests in flight, oldest first.
+func (t *inFlightRequests) list(now time.Time) []inFlightView {
+	t.mu.Lock()
+	requests := make([]*inFlightRequest, 0, len(t.requests))
+	for _, req := range t.requests {
+		requests = append(requests, req)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(requests, func(a, b *inFlightRequest) int { return cmp.Compare(a.id, b.id) })
+	views := make([]inFlightView, 0, len(requests))
+	for _, req := range requests {
+		view := inFlightView{
+			ID:      req.id,
+			Method:  req.method,
+			Path:    req.path,
+			Client:  req.client,
+			Started: req.started,
+			Seconds: now.Sub(req.started).Seconds(),
+		}
+		if info := req.info; info != nil {
+			info.mu.Lock()
+			view.Model, view.UpstreamModel, view.Upstream, view.Stream = info.model, info.upstreamModel, info.upstream, info.stream
+			info.mu.Unlock()
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// track lists each request as in flight until it is answered.
+func (p *ProxyServer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &inFlightRequest{
+			method:  r.Method,
+			path:    r.URL.Path,
+			client:  clientName(r.Context()),
+			started: time.Now(),
+			info:    callInfoFromContext(r.Context()),
+		}
+		p.inFlight.add(req)
+		defer p.inFlight.remove(req)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/metrics"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+)
+
+// callLabels are the labels shared by the per-call metrics.
+var callLabels = []string{"route", "model", "upstream_model", "upstream"}
+
+// proxyMetrics are the metrics the proxy exposes on /metrics.
+type proxyMetrics struct {
+	registry          *metrics.Registry
+	requests          *metrics.CounterVec
+	duration          *metrics.HistogramVec
+	timeToFirstToken  *metrics.HistogramVec
+	upstreamResponses *metrics.CounterVec
+	tokens            *metrics.CounterVec
+	circuitState      *metrics.GaugeVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	registry := metrics.NewRegistry()
+	return &proxyMetrics{
+		registry: registry,
+		requests: registry.NewCounter("llm_proxy_requests_total",
+			"Requests handled by the proxy, by response status.",
+			append(callLabels, "status")...),
+		duration: registry.NewHistogram("llm_proxy_request_duration_seconds",
+			"Time to handle a request, including the whole streamed response.",
+			[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+			callLabels...),
+		timeToFirstToken: registry.NewHistogram("llm_proxy_time_to_first_token_seconds",
+			"Time until the first bytes of a streamed response were sent to the client.",
+			[]float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+			callLabels...),
+		upstreamResponses: registry.NewCounter("llm_proxy_upstream_responses_total",
+			"Responses received from upstreams, by status code.",
+			append(callLabels, "code")...),
+		tokens: registry.NewCounter("llm_proxy_tokens_total",
+			"Tokens reported by upstreams, by type: input, output, cache_read or cache_write.",
+			append(callLabels, "type")...),
+		circuitState: registry.NewGauge("llm_proxy_circuit_breaker_state",
+			"Circuit breaker state per upstream: 0 closed, 1 open, 2 half-open.",
+			"upstream"),
+	}
+}
+
+// callInfo describes the upstream call behind a request. The handler fills
+// it in for the middleware that observes the request. The admin API reads
+// it while the request is in flight, under mu.
+type callInfo struct {
+	mu            sync.Mutex
+	route         string
+	client        string
+	model         string
+	upstreamModel string
+	upstream      string
+	stream        bool
+	knownModel    bool
+}
+
+// labels returns the call labels followed by extra. Models the
+// configuration does not name are labelled "other", so that callers cannot
+// create series at will.
+func (c *callInfo) labels(extra ...string) []string {
+	model, upstreamModel := c.model, c.upstreamModel
+	if model != "" && !c.knownModel {
+		model, upstreamModel = "other", "other"
+	}
+	return append([]string{c.route, model, upstreamModel, c.upstream}, extra...)
+}
+
+// setRoute records the model routing of the call, where known reports
+// whether the configuration names the model.
+func (c *callInfo) setRoute(model string, route route, stream, known bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.model = model
+	c.upstreamModel = route.model
+	c.upstream = route.upstream.name
+	c.stream = stream
+	c.knownModel = known
+}
+
+// knownModel reports whether the configuration names a local model, in its
+// model mappings, fallbacks, model rate limits or prices.
+func (s *proxyState) knownModel(model string) bool {
+	_, mapped := s.modelMappings[model]
+	_, fallback := s.fallbacks[model]
+	_, limited := s.config.ModelRateLimits[model]
+	_, priced := s.config.Prices[model]
+	return mapped || fallback || limited || priced
+}
+
+// setClient records the authenticated caller.
+func (c *callInfo) setClient(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = name
+}
+
+func withCallInfo(ctx context.Context, c *callInfo) context.Context {
+	return context.WithValue(ctx, callInfoContextKey, c)
+}
+
+// callInfoFromContext returns the call description of the request, or nil
+// outside the observe middleware.
+func callInfoFromContext(ctx context.Context) *callInfo {
+	c, _ := ctx.Value(callInfoContextKey).(*callInfo)
+	return c
+}
+
+// routeLabel maps a request path to a bounded set of route label values.
+func routeLabel(path string) string {
+	switch path {
+	case "/v1/chat/completions", "/v1/messages", "/v1/models", "/health", "/metrics":
+		return path
+	default:
+		return "other"
+	}
+}
+
+// observe records request counts, latency and time to first token.
+func (p *ProxyServer) observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startsAt := time.Now()
+
+		info := &callInfo{route: routeLabel(r.URL.Path)}
+		wrappedWriter := &wrappedWriter{ResponseWriter: w}
+
+		next.ServeHTTP(wrappedWriter, r.WithContext(withCallInfo(r.Context(), info)))
+
+		status := wrappedWriter.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if info.route != "/health" && info.route != "/metrics" {
+			p.activity.record(info, r.Method, r.URL.Path, status, startsAt, time.Now())
+		}
+
+		p.metrics.requests.Inc(info.labels(strconv.Itoa(status))...)
+		p.metrics.duration.Observe(time.Since(startsAt).Seconds(), info.labels()...)
+		if info.stream && status == http.StatusOK && !wrappedWriter.firstWrite.IsZero() {
+			p.metrics.timeToFirstToken.Observe(wrappedWriter.firstWrite.Sub(startsAt).Seconds(), info.labels()...)
+		}
+	})
+}
+
+// observeUpstreamResponse counts an upstream response status code.
+func (p *ProxyServer) observeUpstreamResponse(ctx context.Context, statusCode int) {
+	if info := callInfoFromContext(ctx); info != nil {
+		p.metrics.upstreamResponses.Inc(info.labels(strconv.Itoa(statusCode))...)
+	}
+}
+
+// observeUsage counts the tokens of a completed call.
+func (p *ProxyServer) observeUsage(ctx context.Context, u usage.Usage) {
+	info := callInfoFromContext(ctx)
+	if info == nil {
+		return
+	}
+
+	for _, count := range []struct {
+		kind   string
+		tokens int
+	}{
+		{"input", u.InputTokens},
+		{"output", u.OutputTokens},
+		{"cache_read", u.CacheReadTokens},
+		{"cache_write", u.CacheWriteTokens},
+	} {
+		if count.tokens > 0 {
+			p.metrics.tokens.Add(float64(count.tokens), info.labels(count.kind)...)
+		}
+	}
+}
+
+// HandleMetrics serves the metrics in the Prometheus text format.
+func (p *ProxyServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	p.metrics.registry.ServeHTTP(w, r)
+}
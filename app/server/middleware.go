@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/sha256"
 	"log/slog"
 	"net/http"
 	"time"
@@ -11,6 +12,7 @@ type middleware func(http.Handler) http.Handler
 type wrappedWriter struct {
 	http.ResponseWriter
 	statusCode int
+	firstWrite time.Time
 }
 
 func (w *wrappedWriter) WriteHeader(statusCode int) {
@@ -18,6 +20,24 @@ func (w *wrappedWriter) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (w *wrappedWriter) Write(b []byte) (int, error) {
+	if w.firstWrite.IsZero() && len(b) > 0 {
+		w.firstWrite = time.Now()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (w *wrappedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func chainMiddleware(middlewares ...middleware) middleware {
 	return func(next http.Handler) http.Handler {
 		for index := len(middlewares) - 1; index >= 0; index-- {
@@ -49,3 +69,83 @@ func logging(next http.Handler) http.Handler {
 		)
 	})
 }
+
+// authenticate rejects requests without a valid client key and tags the
+// request context with the caller. Health checks and metrics scrapes are
+// always allowed.
+func (p *ProxyServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients := p.state(r.Context()).clients
+		if len(clients) == 0 || r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientKey(r)
+		if key == "" {
+			writeError(w, r, protocolForPath(r.URL.Path), http.StatusUnauthorized, "Missing API key")
+			return
+		}
+
+		c, ok := clients[sha256.Sum256([]byte(key))]
+		if !ok {
+			writeError(w, r, protocolForPath(r.URL.Path), http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		callInfoFromContext(r.Context()).setClient(c.name)
+		next.ServeHTTP(w, r.WithContext(withClient(r.Context(), c)))
+	})
+}
+
+// rateLimit throttles requests per client key and per model, answering 429
+// with Retry-After once any applicable limit is exhausted.
+func (p *ProxyServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := p.state(r.Context())
+		if len(state.keyLimiters) == 0 && len(state.modelLimiters) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var limiters []*rateLimiter
+		if c := clientFromContext(r.Context()); c != nil {
+			if limiter, ok := state.keyLimiters[c.name]; ok {
+				limiters = append(limiters, limiter)
+			}
+		}
+
+		model, tokens := peekRequest(r)
+		if limiter, ok := state.modelLimiters[model]; ok {
+			limiters = append(limiters, limiter)
+		}
+
+		if len(limiters) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		statuses := make([]rateLimitStatus, 0, len(limiters))
+		for _, limiter := range limiters {
+			status := limiter.take(tokens, now)
+			statuses = append(statuses, status)
+			if status.allowed {
+				continue
+			}
+
+			for _, admitted := range statuses[:len(statuses)-1] {
+				admitted.limiter.refund(tokens)
+			}
+
+			setRateLimitHeaders(w.Header(), statuses)
+			w.Header().Set("Retry-After", retryAfterSeconds(status.retryAfter))
+			writeError(w, r, protocolForPath(r.URL.Path), http.StatusTooManyRequests, rateLimitMessage(limiter.scope))
+			return
+		}
+
+		setRateLimitHeaders(w.Header(), statuses)
+		reservation := &rateReservation{limiters: limiters, tokens: tokens}
+		next.ServeHTTP(w, r.WithContext(withRateReservation(r.Context(), reservation)))
+	})
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestProxyServer_Authenticate(t *testing.T) {
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice"},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	var seenClient string
+	handler := proxy.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenClient = clientName(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name              string
+		path              string
+		header            map[string]string
+		expectedStatus    int
+		expectedClient    string
+		expectedErrorType string
+	}{
+		{
+			name:           "bearer token",
+			path:           "/v1/chat/completions",
+			header:         map[string]string{"Authorization": "Bearer sk-proxy-alice"},
+			expectedStatus: http.StatusOK,
+			expectedClient: "alice",
+		},
+		{
+			name:           "x-api-key header",
+			path:           "/v1/messages",
+			header:         map[string]string{"X-Api-Key": "sk-proxy-alice"},
+			expectedStatus: http.StatusOK,
+			expectedClient: "alice",
+		},
+		{
+			name:              "missing key on chat completions",
+			path:              "/v1/chat/completions",
+			expectedStatus:    http.StatusUnauthorized,
+			expectedErrorType: "openai",
+		},
+		{
+			name:              "invalid key on messages",
+			path:              "/v1/messages",
+			header:            map[string]string{"X-Api-Key": "sk-wrong"},
+			expectedStatus:    http.StatusUnauthorized,
+			expectedErrorType: "anthropic",
+		},
+		{
+			name:           "health check without key",
+			path:           "/health",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seenClient = ""
+
+			req := httptest.NewRequest("POST", tt.path, nil)
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if seenClient != tt.expectedClient {
+				t.Errorf("Expected client %q, got %q", tt.expectedClient, seenClient)
+			}
+
+			if tt.expectedErrorType == "" {
+				return
+			}
+
+			var body map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode error body: %v", err)
+			}
+			errorDetail, _ := body["error"].(map[string]any)
+			if errorDetail["type"] != "authentication_error" {
+				t.Errorf("Expected authentication_error, got %v", errorDetail["type"])
+			}
+			if tt.expectedErrorType == "anthropic" && body["type"] != "error" {
+				t.Errorf("Expected Anthropic error shape, got %v", body)
+			}
+			if tt.expectedErrorType == "openai" && body["type"] != nil {
+				t.Errorf("Expected OpenAI error shape, got %v", body)
+			}
+		})
+	}
+}
+
+func TestProxyServer_AuthenticateDisabled(t *testing.T) {
+	proxy, err := NewProxyServer(&config.Config{UpstreamURL: "https://api.example.com"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	handler := proxy.authenticate(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status code %d without configured clients, got %d", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var forwarded string
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			forwarded = req.Header.Get("X-Request-ID")
+			header := make(http.Header)
+			header.Set("X-Request-ID", "upstream-id")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("OK")),
+				Header:     header,
+			}, nil
+		},
+	}
+
+	proxy, err := NewProxyServer(&config.Config{UpstreamURL: "https://api.example.com"}, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	handler := requestID(http.HandlerFunc(proxy.HandleDefault))
+
+	tests := []struct {
+		name       string
+		id         string
+		expectedID string
+	}{
+		{name: "client ID", id: "req-123", expectedID: "req-123"},
+		{name: "missing ID"},
+		{name: "ID with spaces", id: "req 123"},
+		{name: "ID too long", id: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = ""
+
+			req := httptest.NewRequest("GET", "/v1/files", nil)
+			if tt.id != "" {
+				req.Header.Set("X-Request-ID", tt.id)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			echoed := w.Header().Values("X-Request-ID")
+			if len(echoed) != 1 {
+				t.Fatalf("Expected a single request ID in the response, got %v", echoed)
+			}
+			if tt.expectedID != "" && echoed[0] != tt.expectedID {
+				t.Errorf("Expected request ID %q, got %q", tt.expectedID, echoed[0])
+			}
+			if tt.expectedID == "" && (echoed[0] == tt.id || !validRequestID(echoed[0])) {
+				t.Errorf("Expected a generated request ID, got %q", echoed[0])
+			}
+			if forwarded != echoed[0] {
+				t.Errorf("Expected request ID %q forwarded upstream, got %q", echoed[0], forwarded)
+			}
+		})
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(withRequestID(context.Background(), "req-123"), "Handled request")
+	logger.Info("Started")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Failed to decode record %q: %v", lines[0], err)
+	}
+	if record["request_id"] != "req-123" || record["component"] != "test" {
+		t.Errorf("Expected the request ID added to the record, got %v", record)
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("Expected no request ID outside of a request, got %s", lines[1])
+	}
+}
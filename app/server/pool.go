@@ -0,0 +1,231 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+const defaultBenchDuration = time.Minute
+
+// endpoint is one base URL and key of an upstream.
+type endpoint struct {
+	baseURL *url.URL
+	apiKey  string
+	weight  int
+
+	// Guarded by the pool's mu.
+	inFlight     int
+	current      int
+	last429      time.Time
+	benchedUntil time.Time
+}
+
+func (e *endpoint) path(path string) string {
+	base := *e.baseURL
+	return base.JoinPath(path).String()
+}
+
+// endpointPool spreads the calls to an upstream over its endpoints, leaving
+// out endpoints benched after answering 401 or 429.
+type endpointPool struct {
+	mu            sync.Mutex
+	strategy      string
+	benchDuration time.Duration
+	endpoints     []*endpoint
+}
+
+func newEndpointPool(cfg config.Upstream) (*endpointPool, error) {
+	switch cfg.Strategy {
+	case "", config.StrategyRoundRobin, config.StrategyLeastInFlight, config.StrategyLeastRecent429:
+	default:
+		return nil, fmt.Errorf("invalid strategy for %s: %s", cfg.Name, cfg.Strategy)
+	}
+	if cfg.BenchDuration < 0 {
+		return nil, fmt.Errorf("benchDuration for %s must not be negative", cfg.Name)
+	}
+
+	endpointCfgs := cfg.Endpoints
+	if len(endpointCfgs) == 0 {
+		endpointCfgs = []config.Endpoint{{}}
+	}
+
+	pool := &endpointPool{
+		strategy:      cfg.Strategy,
+		benchDuration: cfg.BenchDuration,
+	}
+	if pool.strategy == "" {
+		pool.strategy = config.StrategyRoundRobin
+	}
+	if pool.benchDuration == 0 {
+		pool.benchDuration = defaultBenchDuration
+	}
+
+	for _, endpointCfg := range endpointCfgs {
+		rawURL := endpointCfg.BaseURL
+		if rawURL == "" {
+			rawURL = cfg.BaseURL
+		}
+		baseURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream URL for %s: %w", cfg.Name, err)
+		}
+
+		apiKey := endpointCfg.APIKey
+		if apiKey == "" {
+			apiKey = cfg.APIKey
+		}
+
+		if endpointCfg.Weight < 0 {
+			return nil, fmt.Errorf("endpoint weight for %s must not be negative", cfg.Name)
+		}
+		weight := endpointCfg.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		pool.endpoints = append(pool.endpoints, &endpoint{baseURL: baseURL, apiKey: apiKey, weight: weight})
+	}
+
+	return pool, nil
+}
+
+// acquire selects the endpoint for a call and counts it in flight until
+// release. When every endpoint is benched, the one whose bench ends first
+// is used.
+func (p *endpointPool) acquire(now time.Time) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !now.Before(e.benchedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		soonest := p.endpoints[0]
+		for _, e := range p.endpoints[1:] {
+			if e.benchedUntil.Before(soonest.benchedUntil) {
+				soonest = e
+			}
+		}
+		candidates = append(candidates, soonest)
+	}
+
+	switch p.strategy {
+	case config.StrategyLeastInFlight:
+		candidates = leastBy(candidates, func(a, b *endpoint) int {
+			// Compare in-flight calls per unit of weight.
+			return a.inFlight*b.weight - b.inFlight*a.weight
+		})
+	case config.StrategyLeastRecent429:
+		candidates = leastBy(candidates, func(a, b *endpoint) int {
+			return a.last429.Compare(b.last429)
+		})
+	}
+
+	e := weightedRoundRobin(candidates)
+	e.inFlight++
+	return e
+}
+
+// leastBy returns the endpoints comparing lowest.
+func leastBy(endpoints []*endpoint, cmp func(a, b *endpoint) int) []*endpoint {
+	least := endpoints[:1]
+	for _, e := range endpoints[1:] {
+		switch c := cmp(e, least[0]); {
+		case c < 0:
+			least = []*endpoint{e}
+		case c == 0:
+			least = append(least, e)
+		}
+	}
+	return least
+}
+
+// weightedRoundRobin picks an endpoint with the smooth weighted round-robin
+// algorithm, which interleaves endpoints in proportion to their weights.
+// Callers must hold the pool's mu.
+func weightedRoundRobin(endpoints []*endpoint) *endpoint {
+	var total int
+	var best *endpoint
+	for _, e := range endpoints {
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// release ends a call counted in flight by acquire.
+func (p *endpointPool) release(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.inFlight--
+}
+
+// report benches an endpoint that answered 401 or 429. A 429 asking to
+// retry later benches it until then.
+func (p *endpointPool) report(e *endpoint, statusCode int, header http.Header, now time.Time) {
+	if statusCode != http.StatusUnauthorized && statusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	bench := p.benchDuration
+	if statusCode == http.StatusTooManyRequests {
+		if after, ok := retryAfter(header, now); ok {
+			bench = after
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if statusCode == http.StatusTooManyRequests {
+		e.last429 = now
+	}
+	e.benchedUntil = now.Add(bench)
+}
+
+// releasingBody releases a pooled endpoint once a response body is closed,
+// so that streamed calls count as in flight until they end.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// send calls an endpoint of the upstream, keeping it counted in flight
+// until the response body is closed.
+func (p *ProxyServer) send(u *upstream, newRequest func(e *endpoint) (*http.Request, error)) (*http.Response, error) {
+	e := u.pool.acquire(time.Now())
+
+	req, err := newRequest(e)
+	if err != nil {
+		u.pool.release(e)
+		return nil, err
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		u.pool.release(e)
+		return nil, err
+	}
+
+	u.pool.report(e, resp.StatusCode, resp.Header, time.Now())
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { u.pool.release(e) }}
+	return resp, nil
+}
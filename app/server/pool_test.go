@@ -0,0 +1,220 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestEndpointPool_Acquire(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		upstream config.Upstream
+		prepare  func(pool *endpointPool)
+		release  bool
+		expected string
+	}{
+		{
+			name: "weighted round-robin",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Endpoints: []config.Endpoint{{APIKey: "a", Weight: 2}, {APIKey: "b"}},
+			},
+			release:  true,
+			expected: "abaaba",
+		},
+		{
+			name: "least in flight",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Strategy:  config.StrategyLeastInFlight,
+				Endpoints: []config.Endpoint{{APIKey: "a", Weight: 2}, {APIKey: "b"}},
+			},
+			expected: "ababaa",
+		},
+		{
+			name: "least in flight after release",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Strategy:  config.StrategyLeastInFlight,
+				Endpoints: []config.Endpoint{{APIKey: "a"}, {APIKey: "b"}},
+			},
+			prepare: func(pool *endpointPool) {
+				pool.acquire(now)
+				pool.release(pool.acquire(now))
+			},
+			expected: "bb",
+		},
+		{
+			name: "least recent 429",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Strategy:  config.StrategyLeastRecent429,
+				Endpoints: []config.Endpoint{{APIKey: "a"}, {APIKey: "b"}, {APIKey: "c"}},
+			},
+			prepare: func(pool *endpointPool) {
+				pool.endpoints[0].last429 = now.Add(-time.Hour)
+				pool.endpoints[1].last429 = now.Add(-2 * time.Hour)
+			},
+			release:  true,
+			expected: "ccc",
+		},
+		{
+			name: "benched endpoint skipped",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Endpoints: []config.Endpoint{{APIKey: "a"}, {APIKey: "b"}},
+			},
+			prepare: func(pool *endpointPool) {
+				pool.report(pool.endpoints[0], http.StatusUnauthorized, nil, now)
+			},
+			release:  true,
+			expected: "bbb",
+		},
+		{
+			name: "all benched",
+			upstream: config.Upstream{
+				Name:      "openai",
+				Endpoints: []config.Endpoint{{APIKey: "a"}, {APIKey: "b"}},
+			},
+			prepare: func(pool *endpointPool) {
+				pool.report(pool.endpoints[0], http.StatusTooManyRequests, http.Header{"Retry-After": []string{"10"}}, now)
+				pool.report(pool.endpoints[1], http.StatusTooManyRequests, http.Header{"Retry-After": []string{"5"}}, now)
+			},
+			release:  true,
+			expected: "bb",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := newEndpointPool(tt.upstream)
+			if err != nil {
+				t.Fatalf("Failed to create endpoint pool: %v", err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(pool)
+			}
+
+			var keys string
+			for range len(tt.expected) {
+				e := pool.acquire(now)
+				keys += e.apiKey
+				if tt.release {
+					pool.release(e)
+				}
+			}
+			if keys != tt.expected {
+				t.Errorf("Expected endpoints %q, got %q", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestEndpointPool_Report(t *testing.T) {
+	now := time.Now()
+	pool, err := newEndpointPool(config.Upstream{
+		Name:          "openai",
+		BaseURL:       "https://api.openai.com",
+		Endpoints:     []config.Endpoint{{APIKey: "a"}, {APIKey: "b", BaseURL: "https://eu.openai.com"}},
+		BenchDuration: 30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create endpoint pool: %v", err)
+	}
+
+	a, b := pool.endpoints[0], pool.endpoints[1]
+	if a.baseURL.String() != "https://api.openai.com" || b.baseURL.String() != "https://eu.openai.com" {
+		t.Errorf("Expected endpoint base URLs to default to the upstream's, got %s and %s", a.baseURL, b.baseURL)
+	}
+
+	pool.report(a, http.StatusInternalServerError, nil, now)
+	if !a.benchedUntil.IsZero() {
+		t.Errorf("Expected 500 not to bench the endpoint, got benched until %s", a.benchedUntil)
+	}
+
+	pool.report(a, http.StatusUnauthorized, nil, now)
+	if expected := now.Add(30 * time.Second); !a.benchedUntil.Equal(expected) || !a.last429.IsZero() {
+		t.Errorf("Expected 401 to bench until %s, got %s (last 429 %s)", expected, a.benchedUntil, a.last429)
+	}
+
+	pool.report(b, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"120"}}, now)
+	if expected := now.Add(2 * time.Minute); !b.benchedUntil.Equal(expected) || !b.last429.Equal(now) {
+		t.Errorf("Expected 429 to bench until %s, got %s (last 429 %s)", expected, b.benchedUntil, b.last429)
+	}
+
+	for _, upstream := range []config.Upstream{
+		{Name: "openai", Strategy: "random"},
+		{Name: "openai", Endpoints: []config.Endpoint{{Weight: -1}}},
+		{Name: "openai", BenchDuration: -time.Second},
+	} {
+		if _, err := newEndpointPool(upstream); err == nil {
+			t.Errorf("Expected error for %+v", upstream)
+		}
+	}
+}
+
+func TestProxyServer_EndpointPool(t *testing.T) {
+	var keys []string
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			key := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			keys = append(keys, key)
+
+			status := http.StatusOK
+			if key == "sk-revoked" {
+				status = http.StatusUnauthorized
+			}
+			return &http.Response{
+				StatusCode: status,
+				Body:       io.NopCloser(strings.NewReader(`{"model": "gpt-4o"}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{
+				Name:    "default",
+				BaseURL: "https://api.example.com",
+				Endpoints: []config.Endpoint{
+					{APIKey: "sk-revoked"},
+					{APIKey: "sk-valid"},
+				},
+			},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	var codes []int
+	for range 3 {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": []}`))
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, req)
+		codes = append(codes, recorder.Code)
+	}
+
+	if strings.Join(keys, ",") != "sk-revoked,sk-valid,sk-valid" {
+		t.Errorf("Expected the revoked key to be benched after its 401, got keys %v", keys)
+	}
+	if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusOK || codes[2] != http.StatusOK {
+		t.Errorf("Expected status codes [401 200 200], got %v", codes)
+	}
+	for _, e := range proxy.current.Load().defaultUpstream.pool.endpoints {
+		if e.inFlight != 0 {
+			t.Errorf("Expected no calls in flight once responses were written, got %d", e.inFlight)
+		}
+	}
+}
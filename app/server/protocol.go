@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+
+	"github.com/omegaatt36/llm-proxy/app/translate"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// endpointPath returns the completion endpoint of a protocol.
+func endpointPath(protocol string) string {
+	if protocol == config.ProtocolAnthropic {
+		return "/v1/messages"
+	}
+	return "/v1/chat/completions"
+}
+
+// anthropicVersion is sent to Anthropic upstreams when the client, speaking
+// the OpenAI protocol, did not provide one.
+const anthropicVersion = "2023-06-01"
+
+// translateRequest converts a request body from the client's protocol to the
+// other protocol.
+func translateRequest(clientProtocol string, body []byte) ([]byte, error) {
+	switch clientProtocol {
+	case config.ProtocolAnthropic:
+		return translate.MessagesToChatRequest(body)
+	case config.ProtocolOpenAI:
+		return translate.ChatToMessagesRequest(body)
+	default:
+		return nil, fmt.Errorf("unsupported translation from %s", clientProtocol)
+	}
+}
+
+// translateResponse converts a non-streaming response body from the
+// upstream's protocol to the other protocol.
+func translateResponse(upstreamProtocol string, body []byte) ([]byte, error) {
+	switch upstreamProtocol {
+	case config.ProtocolOpenAI:
+		return translate.ChatToMessagesResponse(body)
+	case config.ProtocolAnthropic:
+		return translate.MessagesToChatResponse(body)
+	default:
+		return nil, fmt.Errorf("unsupported translation from %s", upstreamProtocol)
+	}
+}
+
+// newStreamConverter returns the converter for a stream from an upstream
+// speaking upstreamProtocol, reporting the client's model name.
+func newStreamConverter(upstreamProtocol, model string, req map[string]any) translate.StreamConverter {
+	if upstreamProtocol == config.ProtocolAnthropic {
+		includeUsage := false
+		if options, ok := req["stream_options"].(map[string]any); ok {
+			includeUsage, _ = options["include_usage"].(bool)
+		}
+		return translate.NewMessagesToChatStream(model, includeUsage)
+	}
+	return translate.NewChatToMessagesStream(model)
+}
+
+// translateStream relays an upstream stream through a converter, flushing
+// after every upstream event.
+func translateStream(ctx context.Context, w http.ResponseWriter, body io.Reader, converter translate.StreamConverter) {
+	flusher, _ := w.(http.Flusher)
+
+	write := func(events []translate.Event) bool {
+		for _, event := range events {
+			if err := translate.WriteEvent(w, event); err != nil {
+				return false
+			}
+		}
+		if flusher != nil && len(events) > 0 {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	reader := translate.NewEventReader(body)
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				slog.ErrorContext(ctx, "Failed to read upstream stream", "error", err)
+			}
+			break
+		}
+		if !write(converter.Convert(event)) {
+			return
+		}
+	}
+
+	write(converter.Finish())
+}
+
+// requestStreamUsage asks an OpenAI upstream to end the stream with a usage
+// chunk, reporting whether the client did not ask for it itself and the
+// chunk must be hidden from it.
+func requestStreamUsage(req map[string]any) bool {
+	options, _ := req["stream_options"].(map[string]any)
+	if includeUsage, _ := options["include_usage"].(bool); includeUsage {
+		return false
+	}
+
+	options = maps.Clone(options)
+	if options == nil {
+		options = make(map[string]any)
+	}
+	options["include_usage"] = true
+	req["stream_options"] = options
+	return true
+}
+
+// hiddenUsageStream drops the usage-only chunk of a chat completions stream.
+type hiddenUsageStream struct {
+	translate.StreamConverter
+}
+
+func (s hiddenUsageStream) Convert(event translate.Event) []translate.Event {
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if err := json.Unmarshal(event.Data, &chunk); err == nil && len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null" {
+		return nil
+	}
+	return s.StreamConverter.Convert(event)
+}
+
+// errorBody returns an error body shaped for the given protocol.
+func errorBody(protocol string, status int, message string) []byte {
+	if protocol == config.ProtocolAnthropic {
+		return translate.AnthropicErrorBody(status, message)
+	}
+	return translate.OpenAIErrorBody(status, message)
+}
+
+// writeError writes a JSON error response shaped for the given protocol.
+func writeError(w http.ResponseWriter, r *http.Request, protocol string, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(errorBody(protocol, status, message)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// tokenBucket refills continuously at rate units per second up to capacity.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		tokens:   float64(perMinute),
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long until n units are available. Requests larger than
+// the bucket only wait for a full bucket.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	n = math.Min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reset returns how long until the bucket is full again.
+func (b *tokenBucket) reset() time.Duration {
+	return time.Duration((b.capacity - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter enforces a requests-per-minute and a tokens-per-minute limit,
+// either of which may be unset.
+type rateLimiter struct {
+	mu       sync.Mutex
+	scope    string
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+func newRateLimiter(scope string, cfg config.RateLimit, now time.Time) *rateLimiter {
+	if cfg.RequestsPerMinute <= 0 && cfg.TokensPerMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		scope:    scope,
+		requests: newTokenBucket(cfg.RequestsPerMinute, now),
+		tokens:   newTokenBucket(cfg.TokensPerMinute, now),
+	}
+}
+
+// rateLimitStatus is the state of a limiter after an admission attempt.
+type rateLimitStatus struct {
+	limiter    *rateLimiter
+	allowed    bool
+	retryAfter time.Duration
+
+	limitRequests     int
+	remainingRequests int
+	resetRequests     time.Duration
+	limitTokens       int
+	remainingTokens   int
+	resetTokens       time.Duration
+}
+
+// take admits one request estimated at the given number of tokens, consuming
+// from both buckets only when both have capacity.
+func (l *rateLimiter) take(tokens int, now time.Time) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := rateLimitStatus{limiter: l, allowed: true}
+
+	if l.requests != nil {
+		l.requests.refill(now)
+		status.retryAfter = max(status.retryAfter, l.requests.wait(1))
+	}
+	if l.tokens != nil {
+		l.tokens.refill(now)
+		status.retryAfter = max(status.retryAfter, l.tokens.wait(float64(tokens)))
+	}
+
+	if status.retryAfter > 0 {
+		status.allowed = false
+	} else {
+		if l.requests != nil {
+			l.requests.tokens--
+		}
+		if l.tokens != nil {
+			l.tokens.tokens -= float64(tokens)
+		}
+	}
+
+	if l.requests != nil {
+		status.limitRequests = int(l.requests.capacity)
+		status.remainingRequests = max(0, int(l.requests.tokens))
+		status.resetRequests = l.requests.reset()
+	}
+	if l.tokens != nil {
+		status.limitTokens = int(l.tokens.capacity)
+		status.remainingTokens = max(0, int(l.tokens.tokens))
+		status.resetTokens = l.tokens.reset()
+	}
+
+	return status
+}
+
+// refund returns an admitted request to the buckets.
+func (l *rateLimiter) refund(tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.requests != nil {
+		l.requests.tokens = math.Min(l.requests.capacity, l.requests.tokens+1)
+	}
+	if l.tokens != nil {
+		l.tokens.tokens = math.Min(l.tokens.capacity, l.tokens.tokens+float64(tokens))
+	}
+}
+
+// adjust adds tokens back to the token bucket, or removes them when
+// negative. The bucket may go into debt when a call used more tokens than
+// estimated.
+func (l *rateLimiter) adjust(tokens int) {
+	if l.tokens == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens.tokens = math.Min(l.tokens.capacity, l.tokens.tokens+float64(tokens))
+}
+
+// rateReservation is the token estimate charged to the limiters of an
+// admitted request, settled once the actual usage is known.
+type rateReservation struct {
+	limiters []*rateLimiter
+	tokens   int
+}
+
+func (r *rateReservation) settle(actual int) {
+	for _, limiter := range r.limiters {
+		limiter.adjust(r.tokens - actual)
+	}
+}
+
+// cancel returns the request to the limiters when it ends without a
+// completion, refused by the proxy or failed upstream.
+func (r *rateReservation) cancel() {
+	for _, limiter := range r.limiters {
+		limiter.refund(r.tokens)
+	}
+}
+
+func withRateReservation(ctx context.Context, r *rateReservation) context.Context {
+	return context.WithValue(ctx, rateReservationContextKey, r)
+}
+
+func rateReservationFromContext(ctx context.Context) *rateReservation {
+	r, _ := ctx.Value(rateReservationContextKey).(*rateReservation)
+	return r
+}
+
+func newRateLimiters(cfg *config.Config, now time.Time) (map[string]*rateLimiter, map[string]*rateLimiter) {
+	keyLimiters := make(map[string]*rateLimiter)
+	for _, c := range cfg.Clients {
+		if c.RateLimit == nil {
+			continue
+		}
+		if limiter := newRateLimiter("API key "+c.Name, *c.RateLimit, now); limiter != nil {
+			keyLimiters[c.Name] = limiter
+		}
+	}
+
+	modelLimiters := make(map[string]*rateLimiter)
+	for model, limit := range cfg.ModelRateLimits {
+		if limiter := newRateLimiter("model "+model, limit, now); limiter != nil {
+			modelLimiters[model] = limiter
+		}
+	}
+
+	return keyLimiters, modelLimiters
+}
+
+// rateLimitedRequest is the part of a completion request needed to estimate
+// its token cost before it is sent.
+type rateLimitedRequest struct {
+	Model               string `json:"model"`
+	MaxTokens           int    `json:"max_tokens"`
+	MaxCompletionTokens int    `json:"max_completion_tokens"`
+}
+
+// estimateTokens approximates the tokens a request consumes as four bytes of
+// request body per prompt token plus the requested completion tokens.
+func estimateTokens(body []byte, req rateLimitedRequest) int {
+	return len(body)/4 + max(req.MaxTokens, req.MaxCompletionTokens)
+}
+
+// peekRequest reads the model and token estimate of a completion request,
+// leaving the body readable for the handler.
+func peekRequest(r *http.Request) (string, int) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return "", 0
+	}
+	if r.URL.Path != "/v1/chat/completions" && r.URL.Path != "/v1/messages" {
+		return "", 0
+	}
+
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", 0
+	}
+
+	var req rateLimitedRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", 0
+	}
+	return req.Model, estimateTokens(body, req)
+}
+
+// setRateLimitHeaders reports the most constrained limits in the OpenAI
+// x-ratelimit-* header format.
+func setRateLimitHeaders(header http.Header, statuses []rateLimitStatus) {
+	var requests, tokens *rateLimitStatus
+	for i := range statuses {
+		status := &statuses[i]
+		if status.limitRequests > 0 && (requests == nil || status.remainingRequests < requests.remainingRequests) {
+			requests = status
+		}
+		if status.limitTokens > 0 && (tokens == nil || status.remainingTokens < tokens.remainingTokens) {
+			tokens = status
+		}
+	}
+
+	if requests != nil {
+		header.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(requests.limitRequests))
+		header.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(requests.remainingRequests))
+		header.Set("X-Ratelimit-Reset-Requests", formatReset(requests.resetRequests))
+	}
+	if tokens != nil {
+		header.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(tokens.limitTokens))
+		header.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(tokens.remainingTokens))
+		header.Set("X-Ratelimit-Reset-Tokens", formatReset(tokens.resetTokens))
+	}
+}
+
+func formatReset(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for Retry-After.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+func rateLimitMessage(scope string) string {
+	return fmt.Sprintf("Rate limit exceeded for %s", scope)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestRateLimiter_Take(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter("test", config.RateLimit{RequestsPerMinute: 2, TokensPerMinute: 600}, now)
+
+	if status := limiter.take(100, now); !status.allowed || status.remainingRequests != 1 || status.remainingTokens != 500 {
+		t.Fatalf("Expected first request to be admitted with 1/500 remaining, got %+v", status)
+	}
+
+	status := limiter.take(550, now)
+	if status.allowed {
+		t.Fatal("Expected request exceeding the token budget to be rejected")
+	}
+	if status.retryAfter != 5*time.Second {
+		t.Errorf("Expected retry after 5s for 50 missing tokens at 10/s, got %s", status.retryAfter)
+	}
+	if status.remainingRequests != 1 {
+		t.Errorf("Expected rejected request not to consume the request bucket, got %d remaining", status.remainingRequests)
+	}
+
+	if status := limiter.take(550, now.Add(5*time.Second)); !status.allowed {
+		t.Errorf("Expected request to be admitted after refill, got %+v", status)
+	}
+
+	if status := limiter.take(1, now.Add(5*time.Second)); status.allowed {
+		t.Error("Expected third request within the minute to be rejected")
+	}
+}
+
+func TestProxyServer_RateLimit(t *testing.T) {
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", RateLimit: &config.RateLimit{RequestsPerMinute: 1}},
+			{Name: "bob", Key: "sk-proxy-bob"},
+		},
+		ModelRateLimits: map[string]config.RateLimit{
+			"claude-opus": {RequestsPerMinute: 2},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	handler := chainMiddleware(proxy.authenticate, proxy.rateLimit)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(key, path, model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model": "`+model+`"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := send("sk-proxy-alice", "/v1/chat/completions", "gpt-4o")
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected first request to pass, got %d", first.Code)
+	}
+	if first.Header().Get("X-Ratelimit-Limit-Requests") != "1" || first.Header().Get("X-Ratelimit-Remaining-Requests") != "0" {
+		t.Errorf("Expected rate limit headers 1/0, got %v", first.Header())
+	}
+
+	second := send("sk-proxy-alice", "/v1/messages", "gpt-4o")
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected key limit to reject second request, got %d", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+	if !strings.Contains(second.Body.String(), "rate_limit_error") || !strings.Contains(second.Body.String(), `"type":"error"`) {
+		t.Errorf("Expected Anthropic-shaped rate limit error, got %s", second.Body.String())
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := send("sk-proxy-bob", "/v1/chat/completions", "claude-opus").Code; code != expected {
+			t.Errorf("Model-limited request %d: expected %d, got %d", i, expected, code)
+		}
+	}
+
+	if code := send("sk-proxy-bob", "/v1/chat/completions", "gpt-4o").Code; code != http.StatusOK {
+		t.Errorf("Expected unlimited model to pass, got %d", code)
+	}
+}
+
+func TestProxyServer_RateLimitRefund(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", Models: []string{"gpt-fast"}, RateLimit: &config.RateLimit{RequestsPerMinute: 1}},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	handler := chainMiddleware(proxy.authenticate, proxy.rateLimit)(http.HandlerFunc(proxy.HandleChatCompletions))
+
+	send := func(model string) int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "messages": []}`))
+		req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	tests := []struct {
+		name           string
+		model          string
+		expectedStatus int
+	}{
+		{name: "disallowed model", model: "gpt-4o", expectedStatus: http.StatusForbidden},
+		{name: "disallowed model again", model: "gpt-4o", expectedStatus: http.StatusForbidden},
+		{name: "upstream failure", model: "gpt-fast", expectedStatus: http.StatusBadGateway},
+		{name: "upstream failure again", model: "gpt-fast", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		if code := send(tt.model); code != tt.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", tt.name, tt.expectedStatus, code)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// restartSections are the configuration sections bound when the proxy
+// starts, whose changes only apply after a restart.
+var restartSections = []string{"port", "usage", "tracing", "admin.port", "audit", "logFormat"}
+
+// Reload validates a new configuration and swaps it in. On error the
+// current configuration stays in place. Requests already in flight finish
+// on the configuration they started with.
+func (p *ProxyServer) Reload(cfg *config.Config) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	now := time.Now()
+	previous := p.current.Load()
+	state, err := newProxyState(cfg, previous, p.metrics, now)
+	if err != nil {
+		return err
+	}
+	if err := state.loadSpend(context.Background(), p.usageStore, now); err != nil {
+		return err
+	}
+	if p.redactor != nil {
+		if err := p.redactor.Configure(cfg.Redaction); err != nil {
+			return err
+		}
+	}
+	p.current.Store(state)
+	if p.logLevel != nil {
+		p.logLevel.Set(cfg.Level())
+	}
+
+	changes := diffConfig(previous.config, cfg)
+	if len(changes) == 0 {
+		slog.Info("Configuration reloaded without changes")
+		return nil
+	}
+	for _, change := range changes {
+		if slices.Contains(restartSections, change.section) {
+			slog.Warn("Configuration change requires a restart", "change", change)
+			continue
+		}
+		slog.Info("Configuration changed", "change", change)
+	}
+	return nil
+}
+
+// ReloadFile loads the configuration file, or the environment without one,
+// and reloads it.
+func (p *ProxyServer) ReloadFile() error {
+	cfg, err := config.Load(p.configPath)
+	if err != nil {
+		return err
+	}
+	return p.Reload(cfg)
+}
+
+// configChange is one difference between two configurations.
+type configChange struct {
+	section string
+	name    string
+	action  string
+}
+
+// String returns the change as "section[name] action", naming the entry but
+// none of its values, so that keys are not logged.
+func (c configChange) String() string {
+	if c.name == "" {
+		return c.section + " " + c.action
+	}
+	return fmt.Sprintf("%s[%s] %s", c.section, c.name, c.action)
+}
+
+// LogValue logs the change as its string form.
+func (c configChange) LogValue() slog.Value {
+	return slog.StringValue(c.String())
+}
+
+// diffConfig lists the entries added, removed or changed between two
+// configurations.
+func diffConfig(before, after *config.Config) []configChange {
+	var changes []configChange
+	for _, section := range []struct {
+		name          string
+		before, after any
+	}{
+		{"port", before.Port, after.Port},
+		{"retry", before.Retry, after.Retry},
+		{"circuitBreaker", before.CircuitBreaker, after.CircuitBreaker},
+		{"usage", before.Usage, after.Usage},
+		{"tracing", before.Tracing, after.Tracing},
+		{"admin.port", before.Admin.Port, after.Admin.Port},
+		{"admin.token", before.Admin.Token, after.Admin.Token},
+		{"admin.dashboardToken", before.Admin.DashboardToken, after.Admin.DashboardToken},
+		{"audit", before.Audit, after.Audit},
+		{"redaction", before.Redaction, after.Redaction},
+		{"logLevel", before.LogLevel, after.LogLevel},
+		{"logFormat", before.LogFormat, after.LogFormat},
+	} {
+		if !reflect.DeepEqual(section.before, section.after) {
+			changes = append(changes, configChange{section: section.name, action: "changed"})
+		}
+	}
+
+	upstreamName := func(u config.Upstream) string { return u.Name }
+	clientName := func(c config.Client) string { return c.Name }
+	teamName := func(t config.Team) string { return t.Name }
+
+	changes = append(changes, diffEntries("upstreams", byName(before.AllUpstreams(), upstreamName), byName(after.AllUpstreams(), upstreamName))...)
+	changes = append(changes, diffEntries("modelMappings", before.ModelMappings, after.ModelMappings)...)
+	changes = append(changes, diffEntries("fallbacks", before.Fallbacks, after.Fallbacks)...)
+	changes = append(changes, diffEntries("clients", byName(before.Clients, clientName), byName(after.Clients, clientName))...)
+	changes = append(changes, diffEntries("modelRateLimits", before.ModelRateLimits, after.ModelRateLimits)...)
+	changes = append(changes, diffEntries("teams", byName(before.Teams, teamName), byName(after.Teams, teamName))...)
+	changes = append(changes, diffEntries("prices", before.Prices, after.Prices)...)
+	return changes
+}
+
+// diffEntries compares the entries of a section by name, in name order.
+func diffEntries[T any](section string, before, after map[string]T) []configChange {
+	names := slices.Sorted(maps.Keys(before))
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var changes []configChange
+	for _, name := range names {
+		b, inBefore := before[name]
+		a, inAfter := after[name]
+		switch {
+		case !inBefore:
+			changes = append(changes, configChange{section: section, name: name, action: "added"})
+		case !inAfter:
+			changes = append(changes, configChange{section: section, name: name, action: "removed"})
+		case !reflect.DeepEqual(b, a):
+			changes = append(changes, configChange{section: section, name: name, action: "changed"})
+		}
+	}
+	return changes
+}
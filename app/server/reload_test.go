@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestProxyServer_Reload(t *testing.T) {
+	var mu sync.Mutex
+	var models []string
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			var body map[string]any
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			mu.Lock()
+			models = append(models, body["model"].(string))
+			mu.Unlock()
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"model": "upstream-model"}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	initial := &config.Config{
+		UpstreamURL:   "https://api.example.com",
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4o-mini"},
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", RateLimit: &config.RateLimit{RequestsPerMinute: 10}},
+			{Name: "bob", Key: "sk-proxy-bob", RateLimit: &config.RateLimit{RequestsPerMinute: 10}},
+		},
+	}
+
+	proxy, err := NewProxyServer(initial, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	previous := proxy.current.Load()
+
+	// A request pinned to the initial configuration before the reload.
+	arrived, release := make(chan struct{}), make(chan struct{})
+	handler := proxy.pinState(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		proxy.HandleChatCompletions(w, r)
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-fast", "messages": []}`))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-arrived
+
+	reloaded := &config.Config{
+		UpstreamURL:   "https://api.example.com",
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4.1-mini"},
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", RateLimit: &config.RateLimit{RequestsPerMinute: 10}},
+			{Name: "bob", Key: "sk-proxy-bob", RateLimit: &config.RateLimit{RequestsPerMinute: 20}},
+		},
+	}
+	if err := proxy.Reload(reloaded); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-fast", "messages": []}`))
+	proxy.pinState(http.HandlerFunc(proxy.HandleChatCompletions)).ServeHTTP(httptest.NewRecorder(), req)
+
+	close(release)
+	<-done
+
+	if !slices.Equal(models, []string{"gpt-4.1-mini", "gpt-4o-mini"}) {
+		t.Errorf("Expected the in-flight request on the old mapping and the new one on the new mapping, got %v", models)
+	}
+
+	current := proxy.current.Load()
+	if current.defaultUpstream != previous.defaultUpstream {
+		t.Error("Expected the unchanged upstream to be carried over")
+	}
+	if current.keyLimiters["alice"] != previous.keyLimiters["alice"] {
+		t.Error("Expected the unchanged rate limiter to be carried over")
+	}
+	if current.keyLimiters["bob"] == previous.keyLimiters["bob"] {
+		t.Error("Expected the changed rate limiter to be replaced")
+	}
+
+	invalid := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Fallbacks:   map[string][]string{"gpt-fast": {""}},
+	}
+	if err := proxy.Reload(invalid); err == nil {
+		t.Error("Expected error for invalid configuration")
+	}
+	if proxy.current.Load() != current {
+		t.Error("Expected invalid configuration to leave the current one in place")
+	}
+}
+
+func TestProxyServer_ReloadLog(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	proxy, err := NewProxyServer(&config.Config{
+		UpstreamURL:   "https://api.example.com",
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4o-mini"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	err = proxy.Reload(&config.Config{
+		Port:          "5000",
+		UpstreamURL:   "https://api.example.com",
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4.1-mini"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	var changes []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Level  string `json:"level"`
+			Change string `json:"change"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode record %q: %v", line, err)
+		}
+		changes = append(changes, record.Level+" "+record.Change)
+	}
+
+	expected := []string{"WARN port changed", "INFO modelMappings[gpt-fast] changed"}
+	if !slices.Equal(changes, expected) {
+		t.Errorf("Expected logged changes %v, got %v", expected, changes)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	before := &config.Config{
+		Port:          "4000",
+		UpstreamURL:   "https://api.example.com",
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4o-mini", "claude": "claude-4-sonnet"},
+		Clients:       []config.Client{{Name: "alice", Key: "sk-proxy-alice"}},
+		Retry:         config.Retry{MaxRetries: 1},
+	}
+	after := &config.Config{
+		Port:          "5000",
+		UpstreamURL:   "https://api.example.com",
+		Upstreams:     []config.Upstream{{Name: "anthropic", BaseURL: "https://api.anthropic.com"}},
+		ModelMappings: map[string]string{"gpt-fast": "gpt-4.1-mini", "opus": "anthropic/claude-opus-4"},
+		Clients:       []config.Client{{Name: "alice", Key: "sk-proxy-rotated"}},
+		Retry:         config.Retry{MaxRetries: 1, MaxBackoff: time.Second},
+	}
+
+	var changes []string
+	for _, change := range diffConfig(before, after) {
+		changes = append(changes, change.String())
+	}
+
+	expected := []string{
+		"port changed",
+		"retry changed",
+		"upstreams[anthropic] added",
+		"modelMappings[claude] removed",
+		"modelMappings[gpt-fast] changed",
+		"modelMappings[opus] added",
+		"clients[alice] changed",
+	}
+	if !slices.Equal(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+
+	if changes := diffConfig(before, before); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
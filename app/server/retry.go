@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+
+	// statusOverloaded is the status Anthropic answers with when its API is
+	// temporarily overloaded.
+	statusOverloaded = 529
+)
+
+// retryPolicy decides how often and how long to wait before re-sending a
+// failed upstream call.
+type retryPolicy struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryPolicy(cfg config.Retry) (retryPolicy, error) {
+	if cfg.MaxRetries < 0 || cfg.InitialBackoff < 0 || cfg.MaxBackoff < 0 {
+		return retryPolicy{}, fmt.Errorf("retry settings must not be negative")
+	}
+
+	policy := retryPolicy{
+		maxRetries:     cfg.MaxRetries,
+		initialBackoff: cfg.InitialBackoff,
+		maxBackoff:     cfg.MaxBackoff,
+	}
+	if policy.initialBackoff == 0 {
+		policy.initialBackoff = defaultInitialBackoff
+	}
+	if policy.maxBackoff == 0 {
+		policy.maxBackoff = max(defaultMaxBackoff, policy.initialBackoff)
+	}
+	if policy.initialBackoff > policy.maxBackoff {
+		return retryPolicy{}, fmt.Errorf("retry initialBackoff %s exceeds maxBackoff %s", policy.initialBackoff, policy.maxBackoff)
+	}
+	return policy, nil
+}
+
+// backoff returns the wait before the retry following the given attempt:
+// an exponentially growing delay, capped at maxBackoff, of which a random
+// half is skipped so that clients do not retry in lockstep.
+func (r retryPolicy) backoff(attempt int) time.Duration {
+	d := r.initialBackoff
+	for range attempt {
+		if d >= r.maxBackoff/2 {
+			d = r.maxBackoff
+			break
+		}
+		d *= 2
+	}
+	d = min(d, r.maxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, statusOverloaded:
+		return true
+	}
+	return false
+}
+
+// isConnectionReset reports whether the upstream dropped the connection
+// before answering.
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter reads the wait an upstream asked for, from the Retry-After
+// header in seconds or as an HTTP date, or from the retry-after-ms header
+// some providers send.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, date.Sub(now)), true
+	}
+	return 0, false
+}
+
+// sendWithRetry sends an upstream call, re-sending it per the retry policy
+// while it fails with a retryable status or a connection reset. Nothing has
+// been written to the client at that point, so every attempt is safe to
+// repeat. newRequest must build a fresh request, with a fresh body, for
+// each attempt, to the endpoint of the upstream's pool selected for it.
+// Upstreams asking to wait longer than maxBackoff are not retried, and no
+// attempt is sent while the upstream's circuit breaker is open.
+func (p *ProxyServer) sendWithRetry(ctx context.Context, u *upstream, newRequest func(e *endpoint) (*http.Request, error)) (*http.Response, error) {
+	policy := p.state(ctx).retry
+
+	var retries int
+	defer func() {
+		if retries > 0 {
+			tracing.SpanFromContext(ctx).SetAttributes(tracing.Int("llm_proxy.retries", retries))
+		}
+	}()
+
+	for {
+		resp, err := p.sendThroughBreaker(ctx, u, newRequest)
+
+		if retries >= policy.maxRetries {
+			return resp, err
+		}
+
+		wait := policy.backoff(retries)
+		switch {
+		case err != nil:
+			if !isConnectionReset(err) {
+				return nil, err
+			}
+			slog.WarnContext(ctx, "Retrying upstream request", "upstream", u.name, "retry", retries+1, "wait", wait, "error", err)
+		case retryableStatus(resp.StatusCode):
+			if after, ok := retryAfter(resp.Header, time.Now()); ok {
+				if after > policy.maxBackoff {
+					return resp, nil
+				}
+				wait = after
+			}
+			slog.WarnContext(ctx, "Retrying upstream request", "upstream", u.name, "retry", retries+1, "wait", wait, "status", resp.StatusCode)
+
+			p.observeUpstreamResponse(ctx, resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			if err := resp.Body.Close(); err != nil {
+				slog.ErrorContext(ctx, "Failed to close response body", "error", err)
+			}
+		default:
+			return resp, nil
+		}
+
+		retries++
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
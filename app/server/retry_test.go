@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy, err := newRetryPolicy(config.Retry{MaxRetries: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create retry policy: %v", err)
+	}
+
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for range 20 {
+			if wait := policy.backoff(attempt); wait < ceiling/2 || wait > ceiling {
+				t.Fatalf("Expected backoff of attempt %d within [%s, %s], got %s", attempt, ceiling/2, ceiling, wait)
+			}
+		}
+	}
+
+	if _, err := newRetryPolicy(config.Retry{InitialBackoff: time.Minute, MaxBackoff: time.Second}); err == nil {
+		t.Error("Expected error for initialBackoff exceeding maxBackoff")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		header   map[string]string
+		expected time.Duration
+		ok       bool
+	}{
+		{"seconds", map[string]string{"Retry-After": "3"}, 3 * time.Second, true},
+		{"http date", map[string]string{"Retry-After": now.Add(10 * time.Second).Format(http.TimeFormat)}, 10 * time.Second, true},
+		{"milliseconds", map[string]string{"Retry-After-Ms": "250", "Retry-After": "1"}, 250 * time.Millisecond, true},
+		{"missing", nil, 0, false},
+		{"invalid", map[string]string{"Retry-After": "soon"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for key, value := range tt.header {
+				header.Set(key, value)
+			}
+			wait, ok := retryAfter(header, now)
+			if ok != tt.ok || wait != tt.expected {
+				t.Errorf("Expected %s, %v, got %s, %v", tt.expected, tt.ok, wait, ok)
+			}
+		})
+	}
+}
+
+func TestProxyServer_Retry(t *testing.T) {
+	type attempt struct {
+		status     int
+		retryAfter string
+		err        error
+	}
+
+	tests := []struct {
+		name           string
+		attempts       []attempt
+		expectedStatus int
+		expectedCalls  int
+	}{
+		{
+			name:           "retries overloaded upstream",
+			attempts:       []attempt{{status: statusOverloaded}, {status: http.StatusServiceUnavailable}, {status: http.StatusOK}},
+			expectedStatus: http.StatusOK,
+			expectedCalls:  3,
+		},
+		{
+			name:           "retries connection reset",
+			attempts:       []attempt{{err: syscall.ECONNRESET}, {status: http.StatusOK}},
+			expectedStatus: http.StatusOK,
+			expectedCalls:  2,
+		},
+		{
+			name:           "gives up after max retries",
+			attempts:       []attempt{{status: http.StatusTooManyRequests}, {status: http.StatusTooManyRequests}, {status: http.StatusTooManyRequests}, {status: http.StatusOK}},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedCalls:  3,
+		},
+		{
+			name:           "does not wait beyond max backoff",
+			attempts:       []attempt{{status: http.StatusTooManyRequests, retryAfter: "60"}, {status: http.StatusOK}},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedCalls:  1,
+		},
+		{
+			name:           "does not retry client errors",
+			attempts:       []attempt{{status: http.StatusBadRequest}, {status: http.StatusOK}},
+			expectedStatus: http.StatusBadRequest,
+			expectedCalls:  1,
+		},
+		{
+			name:           "does not retry other network errors",
+			attempts:       []attempt{{err: errors.New("no such host")}, {status: http.StatusOK}},
+			expectedStatus: http.StatusBadGateway,
+			expectedCalls:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					body, _ := io.ReadAll(req.Body)
+					if !strings.Contains(string(body), `"upstream-model"`) {
+						t.Errorf("Expected every attempt to carry the full body, got %s", body)
+					}
+
+					a := tt.attempts[calls]
+					calls++
+					if a.err != nil {
+						return nil, a.err
+					}
+
+					header := make(http.Header)
+					if a.retryAfter != "" {
+						header.Set("Retry-After", a.retryAfter)
+					}
+					return &http.Response{
+						StatusCode: a.status,
+						Body:       io.NopCloser(strings.NewReader(`{"model": "upstream-model"}`)),
+						Header:     header,
+					}, nil
+				},
+			}
+
+			config := &config.Config{
+				UpstreamURL: "https://api.example.com",
+				ModelMappings: map[string]string{
+					"local-model": "upstream-model",
+				},
+				Retry: config.Retry{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+			}
+
+			proxy, err := NewProxyServer(config, mockClient)
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "local-model", "messages": []}`))
+			recorder := httptest.NewRecorder()
+			proxy.HandleChatCompletions(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, recorder.Code)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("Expected %d upstream calls, got %d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/omegaatt36/llm-proxy/app/audit"
+	"github.com/omegaatt36/llm-proxy/app/redact"
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/app/translate"
+	"github.com/omegaatt36/llm-proxy/app/usage"
 	"github.com/omegaatt36/llm-proxy/config"
 )
 
@@ -19,11 +28,72 @@ type HTTPClient interface {
 }
 
 type ProxyServer struct {
-	port           string
-	upstreamURL    *url.URL
-	upstreamAPIKey string
-	modelMappings  map[string]string
-	httpClient     HTTPClient
+	port       string
+	adminPort  string
+	configPath string
+	current    atomic.Pointer[proxyState]
+	reloadMu   sync.Mutex
+	editMu     sync.Mutex
+	logLevel   *slog.LevelVar
+	redactor   *redact.Redactor
+	usageStore usage.Store
+	metrics    *proxyMetrics
+	inFlight   *inFlightRequests
+	activity   *activity
+	auditLog   *audit.Log
+	tracer     *tracing.Tracer
+	httpClient HTTPClient
+}
+
+// Option configures optional dependencies of a ProxyServer.
+type Option func(*ProxyServer)
+
+// WithUsageStore sets the store usage records are written to. The default is
+// an in-memory store.
+func WithUsageStore(store usage.Store) Option {
+	return func(p *ProxyServer) {
+		p.usageStore = store
+	}
+}
+
+// WithTracer sets the tracer recording spans of proxied requests. Tracing
+// is disabled without one.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(p *ProxyServer) {
+		p.tracer = tracer
+	}
+}
+
+// WithRedactor sets the redactor of log and audit records, reconfigured on
+// reload.
+func WithRedactor(redactor *redact.Redactor) Option {
+	return func(p *ProxyServer) {
+		p.redactor = redactor
+	}
+}
+
+// WithAuditLog sets the log completion calls are audited to. Calls are not
+// audited without one.
+func WithAuditLog(log *audit.Log) Option {
+	return func(p *ProxyServer) {
+		p.auditLog = log
+	}
+}
+
+// WithConfigFile sets the configuration file that ReloadFile reads and that
+// changes made through the admin API are written to. Without one, the
+// configuration comes from the environment and cannot be edited.
+func WithConfigFile(path string) Option {
+	return func(p *ProxyServer) {
+		p.configPath = path
+	}
+}
+
+// WithLogLevel sets the level that reloads update from logLevel.
+func WithLogLevel(level *slog.LevelVar) Option {
+	return func(p *ProxyServer) {
+		p.logLevel = level
+	}
 }
 
 func (p *ProxyServer) Start(ctx context.Context) error {
@@ -32,42 +102,65 @@ func (p *ProxyServer) Start(ctx context.Context) error {
 	mux.HandleFunc("POST /v1/messages", p.HandleMessages)
 	mux.HandleFunc("GET /v1/models", p.HandleModels)
 	mux.HandleFunc("GET /health", p.HandleHealth)
+	mux.HandleFunc("GET /metrics", p.HandleMetrics)
 	mux.HandleFunc("/", p.HandleDefault)
 
 	server := &http.Server{
 		Addr:         ":" + p.port,
-		Handler:      chainMiddleware(logging)(mux),
+		Handler:      chainMiddleware(requestID, p.pinState, logging, p.observe, p.trace, p.authenticate, p.track, p.rateLimit)(mux),
 		ReadTimeout:  120 * time.Second,
 		WriteTimeout: 120 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
 	slog.Info("LLM Proxy server starting", "port", p.port)
-	slog.Info("Proxying to", "url", p.upstreamURL)
-
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			slog.Error("Server failed to start", "error", err)
+	for _, u := range p.current.Load().upstreamOrder {
+		for _, e := range u.pool.endpoints {
+			slog.Info("Proxying to", "upstream", u.name, "url", e.baseURL)
 		}
-	}()
+	}
+
+	servers := []*http.Server{server}
+	if p.adminPort != "" {
+		servers = append(servers, &http.Server{
+			Addr:         ":" + p.adminPort,
+			Handler:      chainMiddleware(requestID, logging)(p.adminHandler()),
+			ReadTimeout:  120 * time.Second,
+			WriteTimeout: 120 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		})
+		slog.Info("Admin API starting", "port", p.adminPort)
+	}
+
+	for _, server := range servers {
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Server failed to start", "error", err, "addr", server.Addr)
+			}
+		}()
+	}
 
 	go func() {
 		<-ctx.Done()
 		slog.Info("Shutting down server...")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			slog.Error("Server failed to shutdown", "error", err)
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("Server failed to shutdown", "error", err, "addr", server.Addr)
+			}
 		}
 	}()
 
 	return nil
 }
 
-func NewProxyServer(config *config.Config, httpClient HTTPClient) (*ProxyServer, error) {
-	upstreamURL, err := url.Parse(config.UpstreamURL)
+func NewProxyServer(config *config.Config, httpClient HTTPClient, opts ...Option) (*ProxyServer, error) {
+	now := time.Now()
+	proxyMetrics := newProxyMetrics()
+	state, err := newProxyState(config, nil, proxyMetrics, now)
 	if err != nil {
-		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+		return nil, err
 	}
 
 	if httpClient == nil {
@@ -77,22 +170,51 @@ func NewProxyServer(config *config.Config, httpClient HTTPClient) (*ProxyServer,
 	}
 
 	proxy := &ProxyServer{
-		port:           config.Port,
-		upstreamURL:    upstreamURL,
-		upstreamAPIKey: config.UpstreamAPIKey,
-		modelMappings:  config.ModelMappings,
-		httpClient:     httpClient,
+		port:       config.Port,
+		adminPort:  config.Admin.Port,
+		metrics:    proxyMetrics,
+		inFlight:   newInFlightRequests(),
+		activity:   &activity{},
+		httpClient: httpClient,
+	}
+
+	for _, opt := range opts {
+		opt(proxy)
+	}
+
+	if proxy.usageStore == nil {
+		proxy.usageStore = usage.NewMemoryStore()
 	}
 
+	if err := state.loadSpend(context.Background(), proxy.usageStore, now); err != nil {
+		return nil, err
+	}
+	proxy.current.Store(state)
+
 	return proxy, nil
 }
 
-func (p *ProxyServer) upstreamPath(path string) string {
-	u := *p.upstreamURL
-	return u.JoinPath(path).String()
+func (p *ProxyServer) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	p.handleCompletion(w, r, config.ProtocolOpenAI)
 }
 
-func (p *ProxyServer) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+func (p *ProxyServer) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	p.handleCompletion(w, r, config.ProtocolAnthropic)
+}
+
+// handleCompletion proxies a chat completions or messages request, where
+// clientProtocol is the protocol spoken by the client. Requests routed to an
+// upstream speaking the other protocol are translated in both directions.
+func (p *ProxyServer) handleCompletion(w http.ResponseWriter, r *http.Request, clientProtocol string) {
+	// A request that ends without a completion is returned to the rate
+	// limiters.
+	completed := false
+	defer func() {
+		if reservation := rateReservationFromContext(r.Context()); reservation != nil && !completed {
+			reservation.cancel()
+		}
+	}()
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
@@ -100,11 +222,14 @@ func (p *ProxyServer) HandleChatCompletions(w http.ResponseWriter, r *http.Reque
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			slog.Error("Failed to close request body", "error", err)
+			slog.ErrorContext(r.Context(), "Failed to close request body", "error", err)
 		}
 	}()
 
-	slog.Debug("Chat completions request body", "body", string(body))
+	slog.DebugContext(r.Context(), "Request body", "protocol", clientProtocol, "body", string(body))
+
+	w, r, finishAudit := p.startAudit(w, r, clientProtocol, body)
+	defer finishAudit()
 
 	var req map[string]any
 	if err := json.Unmarshal(body, &req); err != nil {
@@ -118,389 +243,552 @@ func (p *ProxyServer) HandleChatCompletions(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if c := clientFromContext(r.Context()); c != nil && !c.allows(originalModel) {
+		writeError(w, r, clientProtocol, http.StatusForbidden, fmt.Sprintf("Model %s is not allowed for this API key", originalModel))
+		return
+	}
+
+	if !p.checkBudget(w, r, clientProtocol) {
+		return
+	}
+
 	originalStream, ok := req["stream"].(bool)
 	if !ok {
 		originalStream = false
 	}
 
-	if mappedModel, exists := p.modelMappings[originalModel]; exists {
-		req["model"] = mappedModel
-		slog.Debug("Mapped model", "from", originalModel, "to", mappedModel)
-	}
+	routes := p.state(r.Context()).resolveRoutes(originalModel)
+	for i, route := range routes {
+		last := i == len(routes)-1
 
-	modifiedBody, err := json.Marshal(req)
-	if err != nil {
-		http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
-		return
-	}
+		call, err := p.callUpstream(r, clientProtocol, originalModel, route, req, originalStream)
+		if errors.Is(err, errInvalidRequest) {
+			slog.DebugContext(r.Context(), "Failed to prepare request", "upstream", route.upstream.name, "error", err)
+			writeError(w, r, clientProtocol, http.StatusBadRequest, "Invalid request format")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Upstream request failed", "upstream", route.upstream.name, "error", err)
+			if !last {
+				slog.WarnContext(r.Context(), "Falling back to next model", "model", originalModel, "failed", route.String(), "next", routes[i+1].String())
+				continue
+			}
+			if errors.Is(err, errCircuitOpen) {
+				writeError(w, r, clientProtocol, http.StatusServiceUnavailable, fmt.Sprintf("Upstream %s is unavailable", route.upstream.name))
+				return
+			}
+			writeError(w, r, clientProtocol, http.StatusBadGateway, "Upstream request failed")
+			return
+		}
 
-	proxyReq, err := http.NewRequest(r.Method, p.upstreamPath("/v1/chat/completions"), bytes.NewReader(modifiedBody))
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
-	}
+		if call.resp.StatusCode != http.StatusOK {
+			responseBody, _ := io.ReadAll(call.resp.Body)
+			call.close(r.Context())
+			slog.ErrorContext(r.Context(), "Upstream returned error", "upstream", route.upstream.name, "status", call.resp.StatusCode, "body", string(responseBody))
+			if !last && shouldFallback(call.resp.StatusCode, responseBody) {
+				slog.WarnContext(r.Context(), "Falling back to next model", "model", originalModel, "failed", route.String(), "next", routes[i+1].String())
+				continue
+			}
 
-	for key, values := range r.Header {
-		if key != "Authorization" && key != "Content-Length" {
-			for _, value := range values {
-				proxyReq.Header.Add(key, value)
+			if call.translated {
+				responseBody = errorBody(clientProtocol, call.resp.StatusCode, translate.ErrorMessage(responseBody))
+			}
+			copyResponseHeaders(w.Header(), call.resp.Header)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(call.resp.StatusCode)
+			if _, err := w.Write(responseBody); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
 			}
+			return
 		}
+
+		if i > 0 {
+			w.Header().Set(fallbackHeader, route.String())
+		}
+		completed = true
+		p.writeCompletion(w, r, clientProtocol, originalModel, originalStream, call)
+		call.close(r.Context())
+		return
+	}
+}
+
+// errInvalidRequest marks requests that cannot be prepared for an upstream.
+var errInvalidRequest = errors.New("invalid request format")
+
+// upstreamCall is an upstream response for one route, together with how the
+// request was prepared for it.
+type upstreamCall struct {
+	route            route
+	upstreamProtocol string
+	translated       bool
+	hideUsage        bool
+	req              map[string]any
+	resp             *http.Response
+	span             *tracing.Span
+}
+
+// close ends the call's span and releases the response body.
+func (c *upstreamCall) close(ctx context.Context) {
+	c.span.End()
+	if err := c.resp.Body.Close(); err != nil {
+		slog.ErrorContext(ctx, "Failed to close response body", "error", err)
 	}
+}
+
+// callUpstream sends a completion request to a route, translating it when
+// the upstream speaks another protocol. req is not modified.
+func (p *ProxyServer) callUpstream(r *http.Request, clientProtocol, originalModel string, route route, req map[string]any, stream bool) (*upstreamCall, error) {
+	req = maps.Clone(req)
+	req["model"] = route.model
+	slog.DebugContext(r.Context(), "Resolved model", "client", clientName(r.Context()), "from", originalModel, "to", route.model, "upstream", route.upstream.name)
+	callInfoFromContext(r.Context()).setRoute(originalModel, route, stream, p.state(r.Context()).knownModel(originalModel))
+	auditCallFromContext(r.Context()).setRoute(originalModel, route, stream)
 
-	if p.upstreamAPIKey != "" {
-		proxyReq.Header.Set("Authorization", "Bearer "+p.upstreamAPIKey)
+	call := &upstreamCall{
+		route:            route,
+		upstreamProtocol: route.upstream.protocolFor(clientProtocol),
+		req:              req,
 	}
+	call.translated = call.upstreamProtocol != clientProtocol
 
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("Content-Length", fmt.Sprintf("%d", len(modifiedBody)))
+	clientReq := req
+	if stream && !call.translated && clientProtocol == config.ProtocolOpenAI && !route.upstream.rejectsStreamOptions.Load() {
+		req = maps.Clone(req)
+		call.req = req
+		call.hideUsage = requestStreamUsage(req)
+	}
 
-	resp, err := p.httpClient.Do(proxyReq)
+	modifiedBody, err := json.Marshal(req)
 	if err != nil {
-		slog.Error("Upstream request failed", "error", err)
-		http.Error(w, "Upstream request failed", http.StatusBadGateway)
-		return
+		return nil, fmt.Errorf("%w: %w", errInvalidRequest, err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			slog.Error("Failed to close response body", "error", err)
-		}
-	}()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	if call.translated {
+		modifiedBody, err = translateRequest(clientProtocol, modifiedBody)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidRequest, err)
 		}
 	}
 
-	w.WriteHeader(resp.StatusCode)
+	var query string
+	if r.URL.RawQuery != "" && !call.translated {
+		query = "?" + r.URL.RawQuery
+	}
 
-	if originalStream {
-		flusher, ok := w.(http.Flusher)
-		if ok {
-			buffer := make([]byte, 1024)
-			for {
-				n, err := resp.Body.Read(buffer)
-				if n > 0 {
-					if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
-						return
-					}
-					flusher.Flush()
-				}
-				if err != nil {
-					break
-				}
-			}
-		} else {
-			if _, err := io.Copy(w, resp.Body); err != nil {
-				slog.Error("Failed to copy response body", "error", err)
+	ctx, span := p.startUpstreamSpan(r.Context(), route, call.upstreamProtocol, stream)
+
+	send := func(body []byte) (*http.Response, error) {
+		return p.sendWithRetry(ctx, route.upstream, func(e *endpoint) (*http.Request, error) {
+			span.SetAttributes(tracing.String("server.address", e.baseURL.Host))
+
+			targetURL := e.path(endpointPath(call.upstreamProtocol)) + query
+			proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
 			}
-		}
-	} else {
-		responseBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			slog.Error("Failed to read response body", "error", err)
-			return
-		}
 
-		var responseData map[string]any
-		if err := json.Unmarshal(responseBody, &responseData); err == nil {
-			if responseData["model"] == req["model"] {
-				responseData["model"] = originalModel
-				modifiedResponse, _ := json.Marshal(responseData)
-				if _, err := w.Write(modifiedResponse); err != nil {
-					slog.Error("Failed to write response", "error", err)
-				}
-				return
+			copyRequestHeaders(proxyReq.Header, r.Header)
+			tracing.Inject(ctx, proxyReq.Header)
+			route.upstream.setAuth(proxyReq.Header, e)
+			if call.upstreamProtocol == config.ProtocolAnthropic && proxyReq.Header.Get("Anthropic-Version") == "" {
+				proxyReq.Header.Set("Anthropic-Version", anthropicVersion)
 			}
+
+			proxyReq.Header.Set("Content-Type", "application/json")
+			proxyReq.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+			return proxyReq, nil
+		})
+	}
+
+	resp, err := send(modifiedBody)
+	if err == nil && call.hideUsage && resp.StatusCode == http.StatusBadRequest {
+		// Some OpenAI-compatible upstreams reject stream_options. The
+		// request is sent once more as the client sent it, and the
+		// upstream is no longer asked for usage once that succeeds.
+		slog.DebugContext(r.Context(), "Upstream rejected stream_options, retrying without", "upstream", route.upstream.name)
+		p.observeUpstreamResponse(r.Context(), resp.StatusCode)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to close response body", "error", err)
 		}
 
-		if _, err := w.Write(responseBody); err != nil {
-			slog.Error("Failed to write response", "error", err)
+		call.req = clientReq
+		call.hideUsage = false
+		if modifiedBody, err = json.Marshal(clientReq); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidRequest, err)
+		}
+		resp, err = send(modifiedBody)
+		if err == nil && resp.StatusCode != http.StatusBadRequest {
+			route.upstream.rejectsStreamOptions.Store(true)
 		}
 	}
-}
-
-func (p *ProxyServer) HandleMessages(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
 	}
-	defer func() {
-		if err := r.Body.Close(); err != nil {
-			slog.Error("Failed to close request body", "error", err)
+
+	p.observeUpstreamResponse(r.Context(), resp.StatusCode)
+	span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		span.SetError(http.StatusText(resp.StatusCode))
+	}
+
+	call.resp = resp
+	call.span = span
+	return call, nil
+}
+
+// writeCompletion relays a successful upstream response to the client,
+// translating it back to the client's protocol and model name, and records
+// its usage.
+func (p *ProxyServer) writeCompletion(w http.ResponseWriter, r *http.Request, clientProtocol, originalModel string, stream bool, call *upstreamCall) {
+	route, resp := call.route, call.resp
+	copyResponseHeaders(w.Header(), resp.Header)
+
+	if stream {
+		var converter translate.StreamConverter
+		switch {
+		case call.translated:
+			w.Header().Set("Content-Type", "text/event-stream")
+			converter = newStreamConverter(call.upstreamProtocol, originalModel, call.req)
+		case isEventStream(resp.Header):
+			converter = translate.NewModelRewriteStream(route.model, originalModel)
+			if call.hideUsage {
+				converter = hiddenUsageStream{converter}
+			}
 		}
-	}()
 
-	slog.Debug("Messages request body", "body", string(body))
+		w.WriteHeader(resp.StatusCode)
+		if converter == nil {
+			copyStream(r.Context(), w, resp.Body)
+			return
+		}
 
-	var req map[string]any
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		tap := &streamTap{StreamConverter: converter, audit: auditCallFromContext(r.Context())}
+		translateStream(r.Context(), w, resp.Body, tap)
+		finishUpstreamSpan(call.span, tap.model, tap.usage, tap.firstEvent)
+		p.recordUsage(r, route, originalModel, tap.usage)
 		return
 	}
 
-	originalModel, ok := req["model"].(string)
-	if !ok {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read response body", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 
-	slog.Debug("Received request for model", "model", originalModel)
+	callUsage, _ := usage.Parse(responseBody)
+	finishUpstreamSpan(call.span, responseModel(responseBody), callUsage, time.Time{})
 
-	originalStream, ok := req["stream"].(bool)
-	if !ok {
-		originalStream = false
+	if call.translated {
+		responseBody, err = translateResponse(call.upstreamProtocol, responseBody)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to translate response", "upstream", route.upstream.name, "error", err)
+			writeError(w, r, clientProtocol, http.StatusBadGateway, "Invalid upstream response")
+			return
+		}
 	}
 
-	if mappedModel, exists := p.modelMappings[originalModel]; exists {
-		req["model"] = mappedModel
-		slog.Debug("Mapped model", "from", originalModel, "to", mappedModel)
-	}
+	w.WriteHeader(resp.StatusCode)
 
-	modifiedBody, err := json.Marshal(req)
-	if err != nil {
-		http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
-		return
+	if _, err := w.Write(translate.RewriteModel(responseBody, route.model, originalModel)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
 	}
 
-	targetURL := p.upstreamPath("/v1/messages")
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
+	p.recordUsage(r, route, originalModel, callUsage)
+}
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
+// isEventStream reports whether a response carries server-sent events.
+func isEventStream(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+}
+
+// copyStream relays a streaming response that is not made of server-sent
+// events, flushing after every read.
+func copyStream(ctx context.Context, w http.ResponseWriter, body io.Reader) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		if _, err := io.Copy(w, body); err != nil {
+			slog.ErrorContext(ctx, "Failed to copy response body", "error", err)
+		}
 		return
 	}
 
-	for key, values := range r.Header {
-		if key != "Authorization" && key != "Content-Length" {
-			for _, value := range values {
-				proxyReq.Header.Add(key, value)
+	buffer := make([]byte, 1024)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return
 			}
+			flusher.Flush()
+		}
+		if err != nil {
+			break
 		}
 	}
+}
 
-	if p.upstreamAPIKey != "" {
-		proxyReq.Header.Set("Authorization", "Bearer "+p.upstreamAPIKey)
-	}
-
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("Content-Length", fmt.Sprintf("%d", len(modifiedBody)))
-
-	resp, err := p.httpClient.Do(proxyReq)
-	if err != nil {
-		slog.Error("Upstream request failed", "error", err)
-		http.Error(w, "Upstream request failed", http.StatusBadGateway)
-		return
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			slog.Error("Failed to close response body", "error", err)
+// copyRequestHeaders copies client headers to an upstream request. The body
+// length is set by the caller and Accept-Encoding is left to the transport
+// so that responses arrive decompressed and can be rewritten.
+func copyRequestHeaders(dst, src http.Header) {
+	for key, values := range src {
+		if key == "Content-Length" || key == "Accept-Encoding" {
+			continue
 		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		responseBody, _ := io.ReadAll(resp.Body)
-		slog.Error("Upstream returned error", "status", resp.StatusCode, "body", string(responseBody))
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		if _, err := w.Write(responseBody); err != nil {
-			slog.Error("Failed to write response", "error", err)
+		for _, value := range values {
+			dst.Add(key, value)
 		}
-		return
 	}
+}
 
-	for key, values := range resp.Header {
+// copyResponseHeaders copies upstream response headers, except for
+// Content-Length since the response body may be rewritten, and headers the
+// proxy has already set, such as its own rate limits.
+func copyResponseHeaders(dst, src http.Header) {
+	for key, values := range src {
+		if _, exists := dst[key]; exists || key == "Content-Length" {
+			continue
+		}
 		for _, value := range values {
-			w.Header().Add(key, value)
+			dst.Add(key, value)
 		}
 	}
+}
 
-	w.WriteHeader(resp.StatusCode)
+// HandleModels lists the models of every upstream, renaming upstream model
+// IDs to their local aliases. With a single upstream, a response that is not
+// a model list is relayed unchanged.
+func (p *ProxyServer) HandleModels(w http.ResponseWriter, r *http.Request) {
+	state := p.state(r.Context())
+	single := len(state.upstreamOrder) == 1
 
-	if originalStream {
-		flusher, ok := w.(http.Flusher)
-		if ok {
-			buffer := make([]byte, 1024)
-			for {
-				n, err := resp.Body.Read(buffer)
-				if n > 0 {
-					if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
-						return
-					}
-					flusher.Flush()
-				}
-				if err != nil {
-					break
-				}
+	var merged map[string]any
+	data := []any{}
+	for _, u := range state.upstreamOrder {
+		resp, body, err := p.fetchModels(r, u)
+		if err != nil {
+			if single && errors.Is(err, errCircuitOpen) {
+				http.Error(w, fmt.Sprintf("Upstream %s is unavailable", u.name), http.StatusServiceUnavailable)
+				return
 			}
-		} else {
-			if _, err := io.Copy(w, resp.Body); err != nil {
-				slog.Error("Failed to copy response body", "error", err)
+			if single {
+				http.Error(w, "Upstream request failed", http.StatusBadGateway)
+				return
 			}
+			slog.WarnContext(r.Context(), "Failed to list upstream models", "upstream", u.name, "error", err)
+			continue
 		}
-	} else {
-		responseBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			slog.Error("Failed to read response body", "error", err)
-			return
+
+		var modelsResponse map[string]any
+		var models []any
+		ok := json.Unmarshal(body, &modelsResponse) == nil
+		if ok {
+			models, ok = modelsResponse["data"].([]any)
 		}
 
-		var responseData map[string]any
-		if err := json.Unmarshal(responseBody, &responseData); err == nil {
-			if responseData["model"] == req["model"] {
-				responseData["model"] = originalModel
-				modifiedResponse, _ := json.Marshal(responseData)
-				if _, err := w.Write(modifiedResponse); err != nil {
-					slog.Error("Failed to write response", "error", err)
+		if !ok || resp.StatusCode != http.StatusOK {
+			if single {
+				copyResponseHeaders(w.Header(), resp.Header)
+				w.WriteHeader(resp.StatusCode)
+				if _, err := w.Write(body); err != nil {
+					slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
 				}
 				return
 			}
+			slog.WarnContext(r.Context(), "Unexpected upstream models response", "upstream", u.name, "status", resp.StatusCode)
+			continue
 		}
 
-		if _, err := w.Write(responseBody); err != nil {
-			slog.Error("Failed to write response", "error", err)
+		state.renameModels(u, models)
+		if c := clientFromContext(r.Context()); c != nil {
+			models = allowedModels(c, models)
 		}
+		if merged == nil {
+			merged = modelsResponse
+		}
+		data = append(data, models...)
 	}
-}
 
-func (p *ProxyServer) HandleModels(w http.ResponseWriter, r *http.Request) {
-	proxyReq, err := http.NewRequest(r.Method, p.upstreamPath("/v1/models"), nil)
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
+	if merged == nil {
+		merged = map[string]any{"object": "list"}
+	}
+	merged["data"] = data
+
+	modifiedBody, _ := json.Marshal(merged)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(modifiedBody); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
 	}
+}
+
+func (p *ProxyServer) fetchModels(r *http.Request, u *upstream) (*http.Response, []byte, error) {
+	resp, err := p.sendThroughBreaker(r.Context(), u, func(e *endpoint) (*http.Request, error) {
+		proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, e.path("/v1/models"), nil)
+		if err != nil {
+			return nil, err
+		}
 
-	for key, values := range r.Header {
-		if key != "Authorization" {
+		for key, values := range r.Header {
 			for _, value := range values {
 				proxyReq.Header.Add(key, value)
 			}
 		}
-	}
-
-	if p.upstreamAPIKey != "" {
-		proxyReq.Header.Set("Authorization", "Bearer "+p.upstreamAPIKey)
-	}
 
-	resp, err := p.httpClient.Do(proxyReq)
+		u.setAuth(proxyReq.Header, e)
+		return proxyReq, nil
+	})
 	if err != nil {
-		http.Error(w, "Upstream request failed", http.StatusBadGateway)
-		return
+		return nil, nil, err
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			slog.Error("Failed to close response body", "error", err)
+			slog.ErrorContext(r.Context(), "Failed to close response body", "error", err)
 		}
 	}()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
 
-	var modelsResponse map[string]any
-	if err := json.Unmarshal(body, &modelsResponse); err == nil {
-		if data, ok := modelsResponse["data"].([]any); ok {
-			reverseMappings := make(map[string]string)
-			for localModel, remoteModel := range p.modelMappings {
-				reverseMappings[remoteModel] = localModel
-			}
+	return resp, body, nil
+}
 
-			for _, model := range data {
-				if modelMap, ok := model.(map[string]any); ok {
-					if modelID, ok := modelMap["id"].(string); ok {
-						if localModel, exists := reverseMappings[modelID]; exists {
-							modelMap["id"] = localModel
-						}
-					}
-				}
-			}
+// renameModels replaces upstream model IDs with the local names mapped to
+// them on the given upstream.
+func (s *proxyState) renameModels(u *upstream, models []any) {
+	reverseMappings := make(map[string]string)
+	for localModel := range s.modelMappings {
+		if route := s.resolveRoute(localModel); route.upstream == u {
+			reverseMappings[route.model] = localModel
+		}
+	}
 
-			modifiedBody, _ := json.Marshal(modelsResponse)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(resp.StatusCode)
-			if _, err := w.Write(modifiedBody); err != nil {
-				slog.Error("Failed to write response", "error", err)
+	for _, model := range models {
+		if modelMap, ok := model.(map[string]any); ok {
+			if modelID, ok := modelMap["id"].(string); ok {
+				if localModel, exists := reverseMappings[modelID]; exists {
+					modelMap["id"] = localModel
+				}
 			}
-			return
 		}
 	}
+}
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+// allowedModels returns the entries of a model list the caller may use.
+func allowedModels(c *client, models []any) []any {
+	allowed := make([]any, 0, len(models))
+	for _, model := range models {
+		if modelMap, ok := model.(map[string]any); ok {
+			if modelID, ok := modelMap["id"].(string); ok && !c.allows(modelID) {
+				continue
+			}
 		}
+		allowed = append(allowed, model)
 	}
-	w.WriteHeader(resp.StatusCode)
-	if _, err := w.Write(body); err != nil {
-		slog.Error("Failed to write response", "error", err)
-	}
+	return allowed
 }
 
-func (p *ProxyServer) HandleHealth(w http.ResponseWriter, _ *http.Request) {
+// HandleHealth reports that the proxy is up. With circuit breakers
+// configured, it answers with the breaker state of every upstream instead.
+func (p *ProxyServer) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if state := p.state(r.Context()); state.defaultUpstream.breaker != nil {
+		writeBreakerHealth(w, r, state.upstreamOrder)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("OK")); err != nil {
-		slog.Error("Failed to write response", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", err)
 	}
 }
 
+// HandleDefault relays any other request to the default upstream. Keys
+// restricted to a list of models may only send requests naming one of them.
 func (p *ProxyServer) HandleDefault(w http.ResponseWriter, r *http.Request) {
-	targetURL := p.upstreamPath(r.URL.Path)
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
+	slog.DebugContext(r.Context(), "Default handler - proxying", "uri", r.URL.RequestURI())
 
-	slog.Debug("Default handler - proxying", "uri", r.URL.RequestURI())
-
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
-	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			slog.Error("Failed to close request body", "error", err)
+			slog.ErrorContext(r.Context(), "Failed to close request body", "error", err)
 		}
 	}()
 
-	for key, values := range r.Header {
-		if key != "Authorization" {
+	if c := clientFromContext(r.Context()); c != nil && len(c.models) > 0 {
+		if model := peekModel(r); !c.allows(model) {
+			writeError(w, r, config.ProtocolOpenAI, http.StatusForbidden, fmt.Sprintf("Model %q is not allowed for this API key", model))
+			return
+		}
+	}
+
+	defaultUpstream := p.state(r.Context()).defaultUpstream
+	resp, err := p.sendThroughBreaker(r.Context(), defaultUpstream, func(e *endpoint) (*http.Request, error) {
+		targetURL := e.path(r.URL.Path)
+		if r.URL.RawQuery != "" {
+			targetURL += "?" + r.URL.RawQuery
+		}
+
+		proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, values := range r.Header {
 			for _, value := range values {
 				proxyReq.Header.Add(key, value)
 			}
 		}
-	}
 
-	if p.upstreamAPIKey != "" {
-		proxyReq.Header.Set("Authorization", "Bearer "+p.upstreamAPIKey)
+		defaultUpstream.setAuth(proxyReq.Header, e)
+		return proxyReq, nil
+	})
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(w, fmt.Sprintf("Upstream %s is unavailable", defaultUpstream.name), http.StatusServiceUnavailable)
+		return
 	}
-
-	resp, err := p.httpClient.Do(proxyReq)
 	if err != nil {
 		http.Error(w, "Upstream request failed", http.StatusBadGateway)
 		return
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			slog.Error("Failed to close response body", "error", err)
+			slog.ErrorContext(r.Context(), "Failed to close response body", "error", err)
 		}
 	}()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
+	copyResponseHeaders(w.Header(), resp.Header)
 
 	w.WriteHeader(resp.StatusCode)
 	if _, err := io.Copy(w, resp.Body); err != nil {
-		slog.Error("Failed to copy response body", "error", err)
+		slog.ErrorContext(r.Context(), "Failed to copy response body", "error", err)
+	}
+}
+
+// peekModel returns the model named by a JSON request body, or an empty
+// string, leaving the body readable for the upstream request.
+func peekModel(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
 	}
+	return req.Model
 }
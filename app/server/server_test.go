@@ -2,13 +2,20 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/omegaatt36/llm-proxy/app/audit"
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/app/tracing/tracingtest"
+	"github.com/omegaatt36/llm-proxy/app/usage"
 	"github.com/omegaatt36/llm-proxy/config"
 )
 
@@ -430,3 +437,1022 @@ func TestProxyServer_WithAPIKey(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
 	}
 }
+
+func TestProxyServer_MultipleUpstreams(t *testing.T) {
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "anthropic", BaseURL: "https://anthropic.example.com", APIKey: "anthropic-key", AuthStyle: "x-api-key"},
+			{Name: "openai", BaseURL: "https://openai.example.com", APIKey: "openai-key"},
+		},
+		ModelMappings: map[string]string{
+			"claude-sonnet": "anthropic/claude-sonnet-4",
+			"gpt-fast":      "openai/gpt-4o-mini",
+		},
+	}
+
+	tests := []struct {
+		name          string
+		handler       func(p *ProxyServer) http.HandlerFunc
+		path          string
+		model         string
+		expectedHost  string
+		expectedModel string
+		checkAuth     func(t *testing.T, header http.Header)
+	}{
+		{
+			name:          "claude model routed to anthropic upstream",
+			handler:       func(p *ProxyServer) http.HandlerFunc { return p.HandleMessages },
+			path:          "/v1/messages",
+			model:         "claude-sonnet",
+			expectedHost:  "anthropic.example.com",
+			expectedModel: "claude-sonnet-4",
+			checkAuth: func(t *testing.T, header http.Header) {
+				if header.Get("X-Api-Key") != "anthropic-key" {
+					t.Errorf("Expected x-api-key 'anthropic-key', got '%s'", header.Get("X-Api-Key"))
+				}
+				if header.Get("Authorization") != "" {
+					t.Errorf("Expected no Authorization header, got '%s'", header.Get("Authorization"))
+				}
+			},
+		},
+		{
+			name:          "gpt model routed to openai upstream",
+			handler:       func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			path:          "/v1/chat/completions",
+			model:         "gpt-fast",
+			expectedHost:  "openai.example.com",
+			expectedModel: "gpt-4o-mini",
+			checkAuth: func(t *testing.T, header http.Header) {
+				if header.Get("Authorization") != "Bearer openai-key" {
+					t.Errorf("Expected Authorization 'Bearer openai-key', got '%s'", header.Get("Authorization"))
+				}
+			},
+		},
+		{
+			name:          "unmapped model goes to first upstream",
+			handler:       func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			path:          "/v1/chat/completions",
+			model:         "some-model",
+			expectedHost:  "anthropic.example.com",
+			expectedModel: "some-model",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					if req.URL.Host != tt.expectedHost {
+						t.Errorf("Expected host %s, got %s", tt.expectedHost, req.URL.Host)
+					}
+					if req.URL.Path != tt.path {
+						t.Errorf("Expected path %s, got %s", tt.path, req.URL.Path)
+					}
+					if tt.checkAuth != nil {
+						tt.checkAuth(t, req.Header)
+					}
+
+					var body map[string]any
+					if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+						t.Fatalf("Failed to decode upstream request: %v", err)
+					}
+					if body["model"] != tt.expectedModel {
+						t.Errorf("Expected upstream model %s, got %v", tt.expectedModel, body["model"])
+					}
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       io.NopCloser(strings.NewReader(`{"model": "` + tt.expectedModel + `"}`)),
+						Header:     make(http.Header),
+					}, nil
+				},
+			}
+
+			proxy, err := NewProxyServer(config, mockClient)
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			requestBody := `{"model": "` + tt.model + `", "stream": false, "messages": []}`
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(requestBody))
+			req.Header.Set("Authorization", "Bearer client-key")
+
+			recorder := httptest.NewRecorder()
+			tt.handler(proxy)(recorder, req)
+
+			resp := recorder.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			var responseData map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if responseData["model"] != tt.model {
+				t.Errorf("Expected model %s, got %v", tt.model, responseData["model"])
+			}
+		})
+	}
+}
+
+func TestProxyServer_HandleModelsMultipleUpstreams(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			id := "gpt-4o"
+			if req.URL.Host == "anthropic.example.com" {
+				id = "claude-sonnet-4"
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"object": "list", "data": [{"id": "` + id + `"}]}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "anthropic", BaseURL: "https://anthropic.example.com"},
+			{Name: "openai", BaseURL: "https://openai.example.com"},
+		},
+		ModelMappings: map[string]string{
+			"claude-sonnet": "anthropic/claude-sonnet-4",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	proxy.HandleModels(recorder, httptest.NewRequest("GET", "/v1/models", nil))
+
+	var responseData struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(recorder.Result().Body).Decode(&responseData); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	var ids []string
+	for _, model := range responseData.Data {
+		ids = append(ids, model.ID)
+	}
+	if strings.Join(ids, ",") != "claude-sonnet,gpt-4o" {
+		t.Errorf("Expected models [claude-sonnet gpt-4o], got %v", ids)
+	}
+}
+
+func TestProxyServer_HandleMessagesTranslatedToOpenAI(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "/v1/chat/completions" {
+				t.Errorf("Expected path /v1/chat/completions, got %s", req.URL.Path)
+			}
+
+			var body map[string]any
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode upstream request: %v", err)
+			}
+			if body["model"] != "gpt-4o" {
+				t.Errorf("Expected upstream model gpt-4o, got %v", body["model"])
+			}
+			messages, _ := body["messages"].([]any)
+			if len(messages) != 2 {
+				t.Errorf("Expected system and user messages, got %v", body["messages"])
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`{"id": "chatcmpl-1", "model": "gpt-4o",
+					"choices": [{"message": {"role": "assistant", "content": "Hi!"}, "finish_reason": "stop"}],
+					"usage": {"prompt_tokens": 3, "completion_tokens": 2}}`)),
+				Header: make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "openai", BaseURL: "https://openai.example.com", Protocol: "openai"},
+		},
+		ModelMappings: map[string]string{
+			"claude-sonnet": "openai/gpt-4o",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	requestBody := `{"model": "claude-sonnet", "max_tokens": 100, "system": "Be brief.", "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(requestBody))
+	recorder := httptest.NewRecorder()
+	proxy.HandleMessages(recorder, req)
+
+	resp := recorder.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var responseData map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if responseData["type"] != "message" {
+		t.Errorf("Expected type message, got %v", responseData["type"])
+	}
+	if responseData["model"] != "claude-sonnet" {
+		t.Errorf("Expected model claude-sonnet, got %v", responseData["model"])
+	}
+	if responseData["stop_reason"] != "end_turn" {
+		t.Errorf("Expected stop_reason end_turn, got %v", responseData["stop_reason"])
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsTranslatedToAnthropic(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "/v1/messages" {
+				t.Errorf("Expected path /v1/messages, got %s", req.URL.Path)
+			}
+			if req.Header.Get("X-Api-Key") != "anthropic-key" {
+				t.Errorf("Expected x-api-key 'anthropic-key', got '%s'", req.Header.Get("X-Api-Key"))
+			}
+			if req.Header.Get("Anthropic-Version") == "" {
+				t.Error("Expected anthropic-version header to be set")
+			}
+
+			var body map[string]any
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode upstream request: %v", err)
+			}
+			if body["system"] != "Be brief." {
+				t.Errorf("Expected system prompt 'Be brief.', got %v", body["system"])
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4",
+					"content": [{"type": "text", "text": "Hi!"}], "stop_reason": "max_tokens",
+					"usage": {"input_tokens": 3, "output_tokens": 2}}`)),
+				Header: make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "anthropic", BaseURL: "https://anthropic.example.com", APIKey: "anthropic-key", Protocol: "anthropic"},
+		},
+		ModelMappings: map[string]string{
+			"gpt-4o": "anthropic/claude-sonnet-4",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	requestBody := `{"model": "gpt-4o", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	recorder := httptest.NewRecorder()
+	proxy.HandleChatCompletions(recorder, req)
+
+	resp := recorder.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var responseData struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if responseData.Model != "gpt-4o" {
+		t.Errorf("Expected model gpt-4o, got %s", responseData.Model)
+	}
+	if len(responseData.Choices) != 1 || responseData.Choices[0].Message.Content != "Hi!" || responseData.Choices[0].FinishReason != "length" {
+		t.Errorf("Expected translated choice, got %+v", responseData.Choices)
+	}
+}
+
+func TestProxyServer_TranslatedUpstreamError(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Body:       io.NopCloser(strings.NewReader(`{"type": "error", "error": {"type": "rate_limit_error", "message": "Slow down"}}`)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "anthropic", BaseURL: "https://anthropic.example.com", Protocol: "anthropic"},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "messages": [{"role": "user", "content": "Hi"}]}`))
+	recorder := httptest.NewRecorder()
+	proxy.HandleChatCompletions(recorder, req)
+
+	resp := recorder.Result()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status code %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	var responseData struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if responseData.Error.Message != "Slow down" || responseData.Error.Type != "rate_limit_error" {
+		t.Errorf("Expected OpenAI-shaped rate limit error, got %+v", responseData.Error)
+	}
+}
+
+func TestProxyServer_HandleMessagesStreamTranslatedToOpenAI(t *testing.T) {
+	upstreamStream := `data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`
+
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			var body map[string]any
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode upstream request: %v", err)
+			}
+			if options, _ := body["stream_options"].(map[string]any); options["include_usage"] != true {
+				t.Errorf("Expected stream_options.include_usage, got %v", body["stream_options"])
+			}
+
+			header := make(http.Header)
+			header.Set("Content-Type", "text/event-stream")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(upstreamStream)),
+				Header:     header,
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "openai", BaseURL: "https://openai.example.com", Protocol: "openai"},
+		},
+		ModelMappings: map[string]string{
+			"claude-sonnet": "openai/gpt-4o",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	requestBody := `{"model": "claude-sonnet", "max_tokens": 100, "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(requestBody))
+	recorder := httptest.NewRecorder()
+	proxy.HandleMessages(recorder, req)
+
+	resp := recorder.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{
+		"event: message_start",
+		`"model":"claude-sonnet"`,
+		`"text":"Hi"`,
+		`"stop_reason":"end_turn"`,
+		"event: message_stop",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected stream to contain %s, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestProxyServer_StreamModelRewrite(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        func(p *ProxyServer) http.HandlerFunc
+		upstreamStream string
+		unexpected     string
+		expected       []string
+	}{
+		{
+			name:    "chat completions stream",
+			handler: func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			upstreamStream: "data: {\"id\":\"chatcmpl-1\",\"model\":\"upstream-model\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+				"data: [DONE]\n\n",
+			unexpected: "upstream-model",
+			expected:   []string{`"model":"local-model"`, "data: [DONE]"},
+		},
+		{
+			name:    "messages stream",
+			handler: func(p *ProxyServer) http.HandlerFunc { return p.HandleMessages },
+			upstreamStream: "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"upstream-model\"}}\n\n" +
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+			unexpected: "upstream-model",
+			expected:   []string{"event: message_start", `"model":"local-model"`, "event: message_stop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockHTTPClient{
+				DoFunc: func(_ *http.Request) (*http.Response, error) {
+					header := make(http.Header)
+					header.Set("Content-Type", "text/event-stream; charset=utf-8")
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       io.NopCloser(strings.NewReader(tt.upstreamStream)),
+						Header:     header,
+					}, nil
+				},
+			}
+
+			config := &config.Config{
+				UpstreamURL: "https://api.example.com",
+				ModelMappings: map[string]string{
+					"local-model": "upstream-model",
+				},
+			}
+
+			proxy, err := NewProxyServer(config, mockClient)
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"model": "local-model", "stream": true, "messages": []}`))
+			recorder := httptest.NewRecorder()
+			tt.handler(proxy)(recorder, req)
+
+			body := recorder.Body.String()
+			if strings.Contains(body, tt.unexpected) {
+				t.Errorf("Expected stream not to contain %s, got:\n%s", tt.unexpected, body)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Expected stream to contain %s, got:\n%s", expected, body)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyServer_AllowedModels(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			body := `{"model": "claude-sonnet-4"}`
+			if req.URL.Path == "/v1/models" {
+				body = `{"object": "list", "data": [{"id": "claude-sonnet-4"}, {"id": "claude-opus-4"}, {"id": "gpt-4o"}]}`
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		Clients: []config.Client{
+			{Name: "alice", Key: "sk-proxy-alice", Models: []string{"claude-sonnet*"}},
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	handler := proxy.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/models":
+			proxy.HandleModels(w, r)
+		case "/v1/messages":
+			proxy.HandleMessages(w, r)
+		case "/v1/chat/completions":
+			proxy.HandleChatCompletions(w, r)
+		default:
+			proxy.HandleDefault(w, r)
+		}
+	}))
+
+	tests := []struct {
+		name           string
+		path           string
+		model          string
+		expectedStatus int
+	}{
+		{name: "allowed model", path: "/v1/messages", model: "claude-sonnet-4", expectedStatus: http.StatusOK},
+		{name: "disallowed model on messages", path: "/v1/messages", model: "claude-opus-4", expectedStatus: http.StatusForbidden},
+		{name: "disallowed model on chat completions", path: "/v1/chat/completions", model: "gpt-4o", expectedStatus: http.StatusForbidden},
+		{name: "allowed model on other endpoints", path: "/v1/embeddings", model: "claude-sonnet-4", expectedStatus: http.StatusOK},
+		{name: "disallowed model on other endpoints", path: "/v1/completions", model: "gpt-4o", expectedStatus: http.StatusForbidden},
+		{name: "missing model on other endpoints", path: "/v1/responses", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"model": "`+tt.model+`", "messages": []}`))
+			req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, recorder.Code)
+			}
+			if tt.expectedStatus == http.StatusForbidden && !strings.Contains(recorder.Body.String(), "permission_error") {
+				t.Errorf("Expected permission_error body, got %s", recorder.Body.String())
+			}
+		})
+	}
+
+	t.Run("models list is filtered", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/v1/models", nil)
+		req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		var responseData struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&responseData); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(responseData.Data) != 1 || responseData.Data[0].ID != "claude-sonnet-4" {
+			t.Errorf("Expected only claude-sonnet-4, got %+v", responseData.Data)
+		}
+	})
+}
+
+func TestProxyServer_RecordUsage(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       func(p *ProxyServer) http.HandlerFunc
+		request       string
+		contentType   string
+		response      string
+		checkUpstream func(t *testing.T, body map[string]any)
+		unexpected    string
+		expected      usage.Usage
+	}{
+		{
+			name:        "chat completions",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			request:     `{"model": "local-model", "messages": []}`,
+			contentType: "application/json",
+			response:    `{"model":"upstream-model","choices":[],"usage":{"prompt_tokens":100,"completion_tokens":20,"prompt_tokens_details":{"cached_tokens":40}}}`,
+			expected:    usage.Usage{InputTokens: 60, OutputTokens: 20, CacheReadTokens: 40},
+		},
+		{
+			name:        "messages stream",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleMessages },
+			request:     `{"model": "local-model", "stream": true, "messages": []}`,
+			contentType: "text/event-stream",
+			response: "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"upstream-model\",\"usage\":{\"input_tokens\":10,\"cache_creation_input_tokens\":5,\"output_tokens\":1}}}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":30}}\n\n" +
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+			expected: usage.Usage{InputTokens: 10, OutputTokens: 30, CacheWriteTokens: 5},
+		},
+		{
+			name:        "chat completions stream without usage requested",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			request:     `{"model": "local-model", "stream": true, "messages": []}`,
+			contentType: "text/event-stream",
+			response: "data: {\"model\":\"upstream-model\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+				"data: {\"model\":\"upstream-model\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3}}\n\n" +
+				"data: [DONE]\n\n",
+			checkUpstream: func(t *testing.T, body map[string]any) {
+				options, _ := body["stream_options"].(map[string]any)
+				if options["include_usage"] != true {
+					t.Errorf("Expected upstream request to include usage, got %v", body["stream_options"])
+				}
+			},
+			unexpected: "prompt_tokens",
+			expected:   usage.Usage{InputTokens: 7, OutputTokens: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					if tt.checkUpstream != nil {
+						var body map[string]any
+						if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+							t.Fatalf("Failed to decode upstream request: %v", err)
+						}
+						tt.checkUpstream(t, body)
+					}
+
+					header := make(http.Header)
+					header.Set("Content-Type", tt.contentType)
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       io.NopCloser(strings.NewReader(tt.response)),
+						Header:     header,
+					}, nil
+				},
+			}
+
+			config := &config.Config{
+				UpstreamURL: "https://api.example.com",
+				ModelMappings: map[string]string{
+					"local-model": "upstream-model",
+				},
+			}
+
+			store := usage.NewMemoryStore()
+			proxy, err := NewProxyServer(config, mockClient, WithUsageStore(store))
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.request))
+			recorder := httptest.NewRecorder()
+			tt.handler(proxy)(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", recorder.Code)
+			}
+			if tt.unexpected != "" && strings.Contains(recorder.Body.String(), tt.unexpected) {
+				t.Errorf("Expected response not to contain %s, got:\n%s", tt.unexpected, recorder.Body.String())
+			}
+
+			summaries, err := store.Summarize(context.Background(), usage.Filter{})
+			if err != nil {
+				t.Fatalf("Failed to summarize usage: %v", err)
+			}
+			if len(summaries) != 1 {
+				t.Fatalf("Expected 1 usage summary, got %d", len(summaries))
+			}
+
+			summary := summaries[0]
+			if summary.Model != "local-model" || summary.UpstreamModel != "upstream-model" || summary.Upstream != "default" {
+				t.Errorf("Expected usage for local-model via default/upstream-model, got %+v", summary)
+			}
+			if summary.Usage != tt.expected {
+				t.Errorf("Expected usage %+v, got %+v", tt.expected, summary.Usage)
+			}
+		})
+	}
+}
+
+func TestProxyServer_StreamOptionsRejected(t *testing.T) {
+	var withOptions, withoutOptions int
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			var body map[string]any
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode upstream request: %v", err)
+			}
+			if _, ok := body["stream_options"]; ok {
+				withOptions++
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Body:       io.NopCloser(strings.NewReader(`{"error": {"message": "Unrecognized request argument supplied: stream_options"}}`)),
+					Header:     make(http.Header),
+				}, nil
+			}
+
+			withoutOptions++
+			header := make(http.Header)
+			header.Set("Content-Type", "text/event-stream")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n")),
+				Header:     header,
+			}, nil
+		},
+	}
+
+	proxy, err := NewProxyServer(&config.Config{UpstreamURL: "https://api.example.com"}, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	for i := range 2 {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "stream": true, "messages": []}`))
+		recorder := httptest.NewRecorder()
+		proxy.HandleChatCompletions(recorder, req)
+
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"content":"Hi"`) {
+			t.Fatalf("Request %d: expected the stream relayed, got %d: %s", i, recorder.Code, recorder.Body.String())
+		}
+	}
+	if withOptions != 1 || withoutOptions != 2 {
+		t.Errorf("Expected stream_options to be dropped after the first rejection, got %d requests with and %d without", withOptions, withoutOptions)
+	}
+}
+
+func TestProxyServer_Metrics(t *testing.T) {
+	mockClient := &MockHTTPClient{
+		DoFunc: func(_ *http.Request) (*http.Response, error) {
+			header := make(http.Header)
+			header.Set("Content-Type", "text/event-stream")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader("data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+					"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3}}\n\n" +
+					"data: [DONE]\n\n")),
+				Header: header,
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		ModelMappings: map[string]string{
+			"local-model": "upstream-model",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", proxy.HandleChatCompletions)
+	mux.HandleFunc("GET /metrics", proxy.HandleMetrics)
+	handler := chainMiddleware(proxy.observe)(mux)
+
+	for _, model := range []string{"local-model", "made-up-1", "made-up-2"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "stream": true, "messages": []}`))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Expected text/plain content type, got %s", contentType)
+	}
+
+	labels := `route="/v1/chat/completions",model="local-model",upstream_model="upstream-model",upstream="default"`
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`llm_proxy_requests_total{` + labels + `,status="200"} 1`,
+		`llm_proxy_request_duration_seconds_count{` + labels + `} 1`,
+		`llm_proxy_time_to_first_token_seconds_count{` + labels + `} 1`,
+		`llm_proxy_upstream_responses_total{` + labels + `,code="200"} 1`,
+		`llm_proxy_tokens_total{` + labels + `,type="input"} 7`,
+		`llm_proxy_tokens_total{` + labels + `,type="output"} 3`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", expected, body)
+		}
+	}
+
+	other := `llm_proxy_requests_total{route="/v1/chat/completions",model="other",upstream_model="other",upstream="default",status="200"} 2`
+	if !strings.Contains(body, other) || strings.Contains(body, "made-up") {
+		t.Errorf("Expected unknown models to be counted as other, got:\n%s", body)
+	}
+}
+
+func TestProxyServer_Tracing(t *testing.T) {
+	collector := tracingtest.NewCollector()
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	exporter := tracing.NewOTLPExporter(config.Tracing{Endpoint: collectorServer.URL}, nil)
+
+	var upstreamTraceparent string
+	mockClient := &MockHTTPClient{
+		DoFunc: func(req *http.Request) (*http.Response, error) {
+			upstreamTraceparent = req.Header.Get("Traceparent")
+			header := make(http.Header)
+			header.Set("Content-Type", "text/event-stream")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"upstream-model-20250101\",\"usage\":{\"input_tokens\":10,\"output_tokens\":1}}}\n\n" +
+					"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":5}}\n\n" +
+					"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")),
+				Header: header,
+			}, nil
+		},
+	}
+
+	config := &config.Config{
+		UpstreamURL: "https://api.example.com",
+		ModelMappings: map[string]string{
+			"local-model": "upstream-model",
+		},
+	}
+
+	proxy, err := NewProxyServer(config, mockClient, WithTracer(tracing.NewTracer(exporter)))
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	handler := chainMiddleware(proxy.observe, proxy.trace)(http.HandlerFunc(proxy.HandleMessages))
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "local-model", "stream": true, "messages": []}`))
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down exporter: %v", err)
+	}
+
+	spans := collector.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	client, server := spans[0], spans[1]
+	if client.Kind != tracing.SpanKindClient || server.Kind != tracing.SpanKindServer {
+		t.Fatalf("Expected client span ended before server span, got %+v", spans)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected server span to continue the caller's trace, got %+v", server)
+	}
+	if client.TraceID != server.TraceID || client.ParentSpanID != server.SpanID {
+		t.Errorf("Expected client span to be a child of the server span, got %+v", client)
+	}
+	if expected := "00-" + client.TraceID + "-" + client.SpanID + "-01"; upstreamTraceparent != expected {
+		t.Errorf("Expected upstream traceparent %s, got %s", expected, upstreamTraceparent)
+	}
+
+	if server.Attributes["gen_ai.request.model"] != "local-model" {
+		t.Errorf("Expected server span request model local-model, got %v", server.Attributes["gen_ai.request.model"])
+	}
+
+	expected := map[string]any{
+		"gen_ai.request.model":       "upstream-model",
+		"gen_ai.response.model":      "upstream-model-20250101",
+		"gen_ai.usage.input_tokens":  int64(10),
+		"gen_ai.usage.output_tokens": int64(5),
+		"llm_proxy.upstream":         "default",
+	}
+	for key, value := range expected {
+		if client.Attributes[key] != value {
+			t.Errorf("Expected client span attribute %s=%v, got %v", key, value, client.Attributes[key])
+		}
+	}
+	if _, ok := client.Attributes["gen_ai.response.time_to_first_chunk"].(float64); !ok {
+		t.Errorf("Expected time to first chunk attribute, got %v", client.Attributes)
+	}
+}
+
+func TestProxyServer_Audit(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     func(p *ProxyServer) http.HandlerFunc
+		request     string
+		status      int
+		contentType string
+		response    string
+		expected    audit.Record
+	}{
+		{
+			name:        "chat completions",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			request:     `{"model":"local-model","messages":[]}`,
+			status:      http.StatusOK,
+			contentType: "application/json",
+			response:    `{"model":"upstream-model","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":2}}`,
+			expected: audit.Record{
+				Status:   http.StatusOK,
+				Usage:    &usage.Usage{InputTokens: 10, OutputTokens: 2},
+				Response: json.RawMessage(`{"choices":[],"model":"local-model","usage":{"prompt_tokens":10,"completion_tokens":2}}`),
+			},
+		},
+		{
+			name:        "chat completions stream",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			request:     `{"model":"local-model","stream":true,"messages":[]}`,
+			status:      http.StatusOK,
+			contentType: "text/event-stream",
+			response: "data: {\"model\":\"upstream-model\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+				"data: {\"model\":\"upstream-model\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+				"data: [DONE]\n\n",
+			expected: audit.Record{Status: http.StatusOK, Stream: true, StreamText: "Hello"},
+		},
+		{
+			name:        "messages stream",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleMessages },
+			request:     `{"model":"local-model","stream":true,"messages":[]}`,
+			status:      http.StatusOK,
+			contentType: "text/event-stream",
+			response: "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"upstream-model\",\"usage\":{\"input_tokens\":10,\"output_tokens\":1}}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi there\"}}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":3}}\n\n",
+			expected: audit.Record{
+				Status:     http.StatusOK,
+				Stream:     true,
+				Usage:      &usage.Usage{InputTokens: 10, OutputTokens: 3},
+				StreamText: "Hi there",
+			},
+		},
+		{
+			name:        "upstream error",
+			handler:     func(p *ProxyServer) http.HandlerFunc { return p.HandleChatCompletions },
+			request:     `{"model":"local-model","messages":[]}`,
+			status:      http.StatusBadRequest,
+			contentType: "application/json",
+			response:    `{"error":{"message":"bad request"}}`,
+			expected:    audit.Record{Status: http.StatusBadRequest, Response: json.RawMessage(`{"error":{"message":"bad request"}}`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockHTTPClient{
+				DoFunc: func(req *http.Request) (*http.Response, error) {
+					header := make(http.Header)
+					header.Set("Content-Type", tt.contentType)
+					return &http.Response{
+						StatusCode: tt.status,
+						Body:       io.NopCloser(strings.NewReader(tt.response)),
+						Header:     header,
+					}, nil
+				},
+			}
+
+			cfg := &config.Config{
+				UpstreamURL:   "https://api.example.com",
+				ModelMappings: map[string]string{"local-model": "upstream-model"},
+				Clients:       []config.Client{{Name: "alice", Key: "sk-proxy-alice"}},
+			}
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			auditLog, err := audit.Open(config.Audit{Path: path}, nil)
+			if err != nil {
+				t.Fatalf("Failed to open audit log: %v", err)
+			}
+			defer auditLog.Close()
+
+			proxy, err := NewProxyServer(cfg, mockClient, WithAuditLog(auditLog))
+			if err != nil {
+				t.Fatalf("Failed to create proxy server: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.request))
+			req.Header.Set("Authorization", "Bearer sk-proxy-alice")
+			proxy.authenticate(tt.handler(proxy)).ServeHTTP(httptest.NewRecorder(), req)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read audit log: %v", err)
+			}
+			var record audit.Record
+			if err := json.Unmarshal(data, &record); err != nil {
+				t.Fatalf("Failed to decode audit record %q: %v", data, err)
+			}
+
+			if record.Client != "alice" || record.Model != "local-model" || record.UpstreamModel != "upstream-model" || record.Upstream != "default" {
+				t.Errorf("Expected alice's call of local-model via default/upstream-model, got %+v", record)
+			}
+			if string(record.Request) != tt.request {
+				t.Errorf("Expected request %s, got %s", tt.request, record.Request)
+			}
+			if record.Status != tt.expected.Status || record.Stream != tt.expected.Stream || record.StreamText != tt.expected.StreamText {
+				t.Errorf("Expected status %d, stream %v and text %q, got %d, %v and %q",
+					tt.expected.Status, tt.expected.Stream, tt.expected.StreamText, record.Status, record.Stream, record.StreamText)
+			}
+			if string(record.Response) != string(tt.expected.Response) {
+				t.Errorf("Expected response %s, got %s", tt.expected.Response, record.Response)
+			}
+			if tt.expected.Usage != nil && (record.Usage == nil || *record.Usage != *tt.expected.Usage) {
+				t.Errorf("Expected usage %+v, got %+v", tt.expected.Usage, record.Usage)
+			}
+		})
+	}
+}
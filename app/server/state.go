@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// proxyState is everything the proxy builds from its configuration. Reloads
+// replace it as a whole; a request is served by the state that was current
+// when it arrived, so that requests in flight finish on the configuration
+// they started with.
+type proxyState struct {
+	config          *config.Config
+	upstreams       map[string]*upstream
+	upstreamOrder   []*upstream
+	defaultUpstream *upstream
+	modelMappings   map[string]string
+	fallbacks       map[string][]string
+	clients         map[[sha256.Size]byte]*client
+	keyLimiters     map[string]*rateLimiter
+	modelLimiters   map[string]*rateLimiter
+	keyBudgets      map[string]*budget
+	teamBudgets     map[string]*budget
+	retry           retryPolicy
+}
+
+// newProxyState validates a configuration and builds the state serving it.
+// Upstreams, rate limiters and budgets whose configuration is unchanged
+// from the previous state, if any, are carried over with their endpoint
+// pools, circuit breakers, buckets and spend.
+func newProxyState(cfg *config.Config, previous *proxyState, metrics *proxyMetrics, now time.Time) (*proxyState, error) {
+	var previousCfg config.Config
+	if previous != nil {
+		previousCfg = *previous.config
+	}
+	previousUpstreams := byName(previousCfg.AllUpstreams(), func(u config.Upstream) string { return u.Name })
+	breakerUnchanged := previous != nil && previousCfg.CircuitBreaker == cfg.CircuitBreaker
+
+	upstreams := make(map[string]*upstream)
+	var upstreamOrder []*upstream
+	for _, upstreamCfg := range cfg.AllUpstreams() {
+		if _, exists := upstreams[upstreamCfg.Name]; exists {
+			return nil, fmt.Errorf("duplicate upstream name: %s", upstreamCfg.Name)
+		}
+
+		u, err := newUpstream(upstreamCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if previousUpstreamCfg, ok := previousUpstreams[u.name]; ok && breakerUnchanged && reflect.DeepEqual(previousUpstreamCfg, upstreamCfg) {
+			u = previous.upstreams[u.name]
+		} else if u.breaker, err = newCircuitBreaker(cfg.CircuitBreaker, now); err != nil {
+			return nil, err
+		} else if u.breaker != nil {
+			name := u.name
+			u.breaker.onChange = func(state breakerState) {
+				metrics.circuitState.Set(float64(state), name)
+			}
+			metrics.circuitState.Set(float64(breakerClosed), name)
+		}
+
+		upstreams[u.name] = u
+		upstreamOrder = append(upstreamOrder, u)
+	}
+
+	if len(upstreamOrder) == 0 {
+		return nil, fmt.Errorf("at least one upstream is required")
+	}
+
+	clients, err := newClients(cfg.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	keyLimiters, modelLimiters := newRateLimiters(cfg, now)
+
+	keyBudgets, teamBudgets, err := newBudgets(cfg, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateFallbacks(cfg); err != nil {
+		return nil, err
+	}
+
+	retry, err := newRetryPolicy(cfg.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil {
+		previousClients := byName(previousCfg.Clients, func(c config.Client) string { return c.Name })
+		currentClients := byName(cfg.Clients, func(c config.Client) string { return c.Name })
+		carryOver(keyLimiters, previous.keyLimiters, func(name string) bool {
+			return reflect.DeepEqual(previousClients[name].RateLimit, currentClients[name].RateLimit)
+		})
+		carryOver(modelLimiters, previous.modelLimiters, func(model string) bool {
+			return previousCfg.ModelRateLimits[model] == cfg.ModelRateLimits[model]
+		})
+		carryOver(keyBudgets, previous.keyBudgets, func(name string) bool {
+			return reflect.DeepEqual(previousClients[name].Budget, currentClients[name].Budget)
+		})
+
+		previousTeams := byName(previousCfg.Teams, func(t config.Team) string { return t.Name })
+		currentTeams := byName(cfg.Teams, func(t config.Team) string { return t.Name })
+		carryOver(teamBudgets, previous.teamBudgets, func(name string) bool {
+			return reflect.DeepEqual(previousTeams[name].Budget, currentTeams[name].Budget)
+		})
+	}
+
+	return &proxyState{
+		config:          cfg,
+		upstreams:       upstreams,
+		upstreamOrder:   upstreamOrder,
+		defaultUpstream: upstreamOrder[0],
+		modelMappings:   cfg.ModelMappings,
+		fallbacks:       cfg.Fallbacks,
+		clients:         clients,
+		keyLimiters:     keyLimiters,
+		modelLimiters:   modelLimiters,
+		keyBudgets:      keyBudgets,
+		teamBudgets:     teamBudgets,
+		retry:           retry,
+	}, nil
+}
+
+// byName indexes configuration entries by name.
+func byName[T any](entries []T, name func(T) string) map[string]T {
+	indexed := make(map[string]T, len(entries))
+	for _, entry := range entries {
+		indexed[name(entry)] = entry
+	}
+	return indexed
+}
+
+// carryOver replaces the entries of current whose configuration is
+// unchanged with the previous ones, so that their state survives a reload.
+func carryOver[T any](current, previous map[string]T, unchanged func(name string) bool) {
+	for name := range current {
+		if entry, ok := previous[name]; ok && unchanged(name) {
+			current[name] = entry
+		}
+	}
+}
+
+// pinState serves each request with the state current when it arrived.
+func (p *ProxyServer) pinState(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), stateContextKey, p.current.Load())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// state returns the state a request is served with: the one pinned when it
+// arrived, or the current one outside the pinState middleware.
+func (p *ProxyServer) state(ctx context.Context) *proxyState {
+	if s, ok := ctx.Value(stateContextKey).(*proxyState); ok {
+		return s
+	}
+	return p.current.Load()
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+)
+
+// trace records a server span per request, continuing the caller's trace
+// when it sent a traceparent header.
+func (p *ProxyServer) trace(next http.Handler) http.Handler {
+	if p.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeLabel(r.URL.Path)
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := p.tracer.Start(ctx, r.Method+" "+route, tracing.SpanKindServer)
+		defer span.End()
+
+		wrappedWriter := &wrappedWriter{ResponseWriter: w}
+		next.ServeHTTP(wrappedWriter, r.WithContext(ctx))
+
+		status := wrappedWriter.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		span.SetAttributes(
+			tracing.String("http.request.method", r.Method),
+			tracing.String("http.route", route),
+			tracing.String("url.path", r.URL.Path),
+			tracing.Int("http.response.status_code", status),
+		)
+		if info := callInfoFromContext(ctx); info != nil && info.model != "" {
+			span.SetAttributes(
+				tracing.String("gen_ai.request.model", info.model),
+				tracing.Bool("llm_proxy.stream", info.stream),
+			)
+		}
+		if name := clientName(ctx); name != "" {
+			span.SetAttributes(tracing.String("llm_proxy.client", name))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(status))
+		}
+	})
+}
+
+// startUpstreamSpan starts the client span of a call to an upstream.
+func (p *ProxyServer) startUpstreamSpan(ctx context.Context, route route, protocol string, stream bool) (context.Context, *tracing.Span) {
+	ctx, span := p.tracer.Start(ctx, "chat "+route.model, tracing.SpanKindClient)
+	span.SetAttributes(
+		tracing.String("gen_ai.operation.name", "chat"),
+		tracing.String("gen_ai.system", protocol),
+		tracing.String("gen_ai.request.model", route.model),
+		tracing.String("llm_proxy.upstream", route.upstream.name),
+		tracing.Bool("llm_proxy.stream", stream),
+	)
+	return ctx, span
+}
+
+// finishUpstreamSpan records the outcome of a completed upstream call.
+// firstEvent is zero for calls that were not streamed.
+func finishUpstreamSpan(span *tracing.Span, responseModel string, u usage.Usage, firstEvent time.Time) {
+	if span == nil {
+		return
+	}
+
+	if responseModel != "" {
+		span.SetAttributes(tracing.String("gen_ai.response.model", responseModel))
+	}
+	if !u.IsZero() {
+		span.SetAttributes(
+			tracing.Int("gen_ai.usage.input_tokens", u.InputTokens),
+			tracing.Int("gen_ai.usage.output_tokens", u.OutputTokens),
+			tracing.Int("gen_ai.usage.cache_read.input_tokens", u.CacheReadTokens),
+			tracing.Int("gen_ai.usage.cache_creation.input_tokens", u.CacheWriteTokens),
+		)
+	}
+	if !firstEvent.IsZero() {
+		span.SetAttributes(
+			tracing.Float("gen_ai.response.time_to_first_chunk", firstEvent.Sub(span.StartTime).Seconds()),
+			tracing.Float("llm_proxy.stream.duration", time.Since(span.StartTime).Seconds()),
+		)
+	}
+}
+
+// responseModel returns the model reported by an upstream response body or
+// stream event, including the message of an Anthropic message_start event.
+func responseModel(data []byte) string {
+	var payload struct {
+		Model   string `json:"model"`
+		Message *struct {
+			Model string `json:"model"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return ""
+	}
+	if payload.Model == "" && payload.Message != nil {
+		return payload.Message.Model
+	}
+	return payload.Model
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+type upstream struct {
+	name      string
+	pool      *endpointPool
+	authStyle string
+	protocol  string
+	breaker   *circuitBreaker
+	// rejectsStreamOptions is set once the upstream answered a streaming
+	// request with 400 only while it carried stream_options.
+	rejectsStreamOptions atomic.Bool
+}
+
+func newUpstream(cfg config.Upstream) (*upstream, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("upstream name is required")
+	}
+
+	authStyle := cfg.AuthStyle
+	switch authStyle {
+	case "":
+		authStyle = config.AuthStyleBearer
+		if cfg.Protocol == config.ProtocolAnthropic {
+			authStyle = config.AuthStyleXAPIKey
+		}
+	case config.AuthStyleBearer, config.AuthStyleXAPIKey:
+	default:
+		return nil, fmt.Errorf("invalid auth style for %s: %s", cfg.Name, cfg.AuthStyle)
+	}
+
+	switch cfg.Protocol {
+	case "", config.ProtocolOpenAI, config.ProtocolAnthropic:
+	default:
+		return nil, fmt.Errorf("invalid protocol for %s: %s", cfg.Name, cfg.Protocol)
+	}
+
+	pool, err := newEndpointPool(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstream{
+		name:      cfg.Name,
+		pool:      pool,
+		authStyle: authStyle,
+		protocol:  cfg.Protocol,
+	}, nil
+}
+
+// protocolFor returns the protocol to use upstream for a request in the
+// client's protocol.
+func (u *upstream) protocolFor(clientProtocol string) string {
+	if u.protocol == "" {
+		return clientProtocol
+	}
+	return u.protocol
+}
+
+// setAuth replaces any client credentials with the API key of the endpoint.
+func (u *upstream) setAuth(header http.Header, e *endpoint) {
+	header.Del("Authorization")
+	header.Del("X-Api-Key")
+
+	if e.apiKey == "" {
+		return
+	}
+
+	switch u.authStyle {
+	case config.AuthStyleXAPIKey:
+		header.Set("X-Api-Key", e.apiKey)
+	default:
+		header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+}
+
+// route is the resolved destination of a request for a local model name.
+type route struct {
+	upstream *upstream
+	model    string
+}
+
+// String returns the route in the "upstream/model" mapping syntax.
+func (r route) String() string {
+	return r.upstream.name + "/" + r.model
+}
+
+// resolveRoute maps a local model name to an upstream and upstream model.
+// Mapping values of the form "upstream/model" select a named upstream; any
+// other value, or an unmapped model, goes to the default upstream.
+func (s *proxyState) resolveRoute(model string) route {
+	mapped, exists := s.modelMappings[model]
+	if !exists {
+		return route{upstream: s.defaultUpstream, model: model}
+	}
+	return s.targetRoute(mapped)
+}
+
+// targetRoute resolves a mapping value of the form "upstream/model", or a
+// bare model name served by the default upstream.
+func (s *proxyState) targetRoute(target string) route {
+	if name, upstreamModel, found := strings.Cut(target, "/"); found {
+		if u, ok := s.upstreams[name]; ok {
+			return route{upstream: u, model: upstreamModel}
+		}
+	}
+
+	return route{upstream: s.defaultUpstream, model: target}
+}
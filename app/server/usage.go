@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/translate"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+)
+
+// streamTap collects the usage, model and timing of upstream stream events,
+// and their text for audited calls, before handing them to the wrapped
+// converter.
+type streamTap struct {
+	translate.StreamConverter
+	audit      *auditCall
+	usage      usage.Usage
+	model      string
+	firstEvent time.Time
+}
+
+func (t *streamTap) Convert(event translate.Event) []translate.Event {
+	if t.firstEvent.IsZero() {
+		t.firstEvent = time.Now()
+	}
+	if t.model == "" {
+		t.model = responseModel(event.Data)
+	}
+	if u, ok := usage.Parse(event.Data); ok {
+		t.usage = t.usage.Merge(u)
+	}
+	if t.audit != nil {
+		t.audit.addText(eventText(event.Data))
+	}
+	return t.StreamConverter.Convert(event)
+}
+
+// recordUsage stores the usage of a completed call and settles the rate
+// limit tokens reserved for it against the actual usage.
+func (p *ProxyServer) recordUsage(r *http.Request, route route, model string, u usage.Usage) {
+	ctx := context.WithoutCancel(r.Context())
+
+	p.observeUsage(ctx, u)
+	auditCallFromContext(ctx).setUsage(u)
+
+	if reservation := rateReservationFromContext(ctx); reservation != nil && !u.IsZero() {
+		reservation.settle(u.Total())
+	}
+
+	record := usage.Record{
+		Time:          time.Now(),
+		Client:        clientName(ctx),
+		Model:         model,
+		UpstreamModel: route.model,
+		Upstream:      route.upstream.name,
+		Usage:         u,
+	}
+	if err := p.usageStore.Record(ctx, record); err != nil {
+		slog.ErrorContext(ctx, "Failed to record usage", "error", err)
+	}
+
+	p.chargeBudgets(ctx, clientFromContext(ctx), route, model, u)
+}
@@ -0,0 +1,270 @@
+// Package tracing records spans of proxied calls and exports them to an
+// OpenTelemetry collector over OTLP/HTTP, propagating W3C trace context.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanKind is the OTLP span kind.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is the OTLP span status code.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a span attribute. Values are strings, bools, ints or
+// float64s.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Float(key string, value float64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// TraceFlags are the W3C trace flags of a span.
+type TraceFlags byte
+
+// FlagsSampled marks a trace as sampled by the caller.
+const FlagsSampled TraceFlags = 0x01
+
+// SpanContext is the part of a span propagated to other services.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	TraceFlags TraceFlags
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Span is a timed operation. A nil span is valid and records nothing, so
+// that callers need not check whether tracing is enabled.
+type Span struct {
+	mu       sync.Mutex
+	exporter Exporter
+	ended    bool
+
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanID
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    []Attribute
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes = append(s.Attributes, attrs...)
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.StatusCode = StatusError
+	s.StatusMessage = message
+}
+
+// End finishes the span and hands it to the exporter. Later calls are
+// ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	s.exporter.ExportSpan(s)
+}
+
+// Exporter receives ended spans.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer starts spans. A nil tracer starts nil spans.
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type contextKey int
+
+const (
+	spanContextKey contextKey = iota
+	remoteContextKey
+)
+
+// Start begins a span, child of the span or remote parent in ctx, and
+// returns a context carrying it. A child keeps the trace flags of its
+// parent; a new trace is sampled.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		exporter:  t.exporter,
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+	}
+
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.TraceFlags = parent.TraceFlags
+		span.Parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.SpanContext.TraceID[:])
+		span.SpanContext.TraceFlags = FlagsSampled
+	}
+	_, _ = rand.Read(span.SpanContext.SpanID[:])
+
+	return context.WithValue(ctx, spanContextKey, span), span
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the context of the current span, or of
+// the remote parent extracted from an incoming request.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext, true
+	}
+	sc, ok := ctx.Value(remoteContextKey).(SpanContext)
+	return sc, ok
+}
+
+// Extract returns a context carrying the remote parent described by the
+// traceparent header, when it is valid.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get("Traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteContextKey, sc)
+}
+
+// Inject sets the traceparent header to the current span of ctx, leaving the
+// header untouched when there is none.
+func Inject(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set("Traceparent", FormatTraceparent(span.SpanContext))
+	}
+}
+
+// FormatTraceparent returns the W3C traceparent header value of a span.
+func FormatTraceparent(sc SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, byte(sc.TraceFlags))
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.TraceFlags = TraceFlags(flags[0])
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
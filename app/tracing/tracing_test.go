@@ -0,0 +1,130 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/app/tracing/tracingtest"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"future version with extra fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"extra fields in version 00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := tracing.ParseTraceparent(tt.value)
+			if ok != tt.valid {
+				t.Fatalf("Expected valid %v, got %v", tt.valid, ok)
+			}
+			if ok && sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("Expected trace ID 4bf92f3577b34da6a3ce929d0e0e4736, got %s", sc.TraceID)
+			}
+		})
+	}
+}
+
+type discardExporter struct{}
+
+func (discardExporter) ExportSpan(*tracing.Span) {}
+
+func TestTraceFlags(t *testing.T) {
+	tracer := tracing.NewTracer(discardExporter{})
+	tests := []struct {
+		name        string
+		traceparent string
+		flags       string
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "01"},
+		{"unsampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "00"},
+		{"unknown flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", "03"},
+		{"new trace", "", "01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			header.Set("Traceparent", tt.traceparent)
+			ctx, _ := tracer.Start(tracing.Extract(context.Background(), header), "span", tracing.SpanKindServer)
+
+			outgoing := make(http.Header)
+			tracing.Inject(ctx, outgoing)
+			if got := outgoing.Get("Traceparent"); !strings.HasSuffix(got, "-"+tt.flags) {
+				t.Errorf("Expected trace flags %s, got %s", tt.flags, got)
+			}
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	collector := tracingtest.NewCollector()
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	exporter := tracing.NewOTLPExporter(config.Tracing{Endpoint: server.URL, ServiceName: "test-proxy"}, nil)
+	tracer := tracing.NewTracer(exporter)
+
+	header := make(http.Header)
+	header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracing.Extract(context.Background(), header)
+
+	ctx, parent := tracer.Start(ctx, "parent", tracing.SpanKindServer)
+	childCtx, child := tracer.Start(ctx, "child", tracing.SpanKindClient)
+	child.SetAttributes(tracing.String("gen_ai.request.model", "gpt-4o"), tracing.Int("gen_ai.usage.input_tokens", 12), tracing.Float("ratio", 0.5), tracing.Bool("stream", true))
+	child.SetError("upstream failed")
+
+	outgoing := make(http.Header)
+	tracing.Inject(childCtx, outgoing)
+	if expected := tracing.FormatTraceparent(child.SpanContext); outgoing.Get("Traceparent") != expected {
+		t.Errorf("Expected traceparent %s, got %s", expected, outgoing.Get("Traceparent"))
+	}
+
+	child.End()
+	parent.End()
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down exporter: %v", err)
+	}
+
+	spans := collector.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	got, gotParent := spans[0], spans[1]
+	if got.Name != "child" || got.Kind != tracing.SpanKindClient || got.Service != "test-proxy" {
+		t.Errorf("Unexpected child span: %+v", got)
+	}
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || gotParent.TraceID != got.TraceID {
+		t.Errorf("Expected spans to continue the remote trace, got %s and %s", got.TraceID, gotParent.TraceID)
+	}
+	if gotParent.ParentSpanID != "00f067aa0ba902b7" || got.ParentSpanID != gotParent.SpanID {
+		t.Errorf("Expected child of parent of remote span, got parents %s and %s", got.ParentSpanID, gotParent.ParentSpanID)
+	}
+	if got.StatusCode != tracing.StatusError {
+		t.Errorf("Expected error status, got %d", got.StatusCode)
+	}
+
+	expected := map[string]any{"gen_ai.request.model": "gpt-4o", "gen_ai.usage.input_tokens": int64(12), "ratio": 0.5, "stream": true}
+	for key, value := range expected {
+		if got.Attributes[key] != value {
+			t.Errorf("Expected attribute %s=%v, got %v", key, value, got.Attributes[key])
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package tracingtest provides an in-memory OpenTelemetry collector for
+// tests of code that exports spans.
+package tracingtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+)
+
+// CollectedSpan is a span as received by a Collector.
+type CollectedSpan struct {
+	Service      string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         tracing.SpanKind
+	Attributes   map[string]any
+	StatusCode   tracing.StatusCode
+}
+
+// The parts of an OTLP/HTTP JSON export request read by the Collector.
+type (
+	exportRequest struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []attribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []span `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	span struct {
+		TraceID      string           `json:"traceId"`
+		SpanID       string           `json:"spanId"`
+		ParentSpanID string           `json:"parentSpanId"`
+		Name         string           `json:"name"`
+		Kind         tracing.SpanKind `json:"kind"`
+		Attributes   []attribute      `json:"attributes"`
+		Status       struct {
+			Code tracing.StatusCode `json:"code"`
+		} `json:"status"`
+	}
+
+	attribute struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue *string  `json:"stringValue"`
+			BoolValue   *bool    `json:"boolValue"`
+			IntValue    *string  `json:"intValue"`
+			DoubleValue *float64 `json:"doubleValue"`
+		} `json:"value"`
+	}
+)
+
+// Collector is a stand-in for an OpenTelemetry collector that accepts
+// OTLP/HTTP JSON exports and keeps the spans in memory. Serve it with
+// httptest.NewServer and point a tracing.OTLPExporter at its URL.
+type Collector struct {
+	mu    sync.Mutex
+	spans []CollectedSpan
+}
+
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid export request", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range req.ResourceSpans {
+		service, _ := decodeAttributes(resourceSpans.Resource.Attributes)["service.name"].(string)
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans = append(c.spans, CollectedSpan{
+					Service:      service,
+					TraceID:      span.TraceID,
+					SpanID:       span.SpanID,
+					ParentSpanID: span.ParentSpanID,
+					Name:         span.Name,
+					Kind:         span.Kind,
+					Attributes:   decodeAttributes(span.Attributes),
+					StatusCode:   span.Status.Code,
+				})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+}
+
+// Spans returns the spans received so far.
+func (c *Collector) Spans() []CollectedSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CollectedSpan(nil), c.spans...)
+}
+
+func decodeAttributes(attrs []attribute) map[string]any {
+	decoded := make(map[string]any, len(attrs))
+	for _, attr := range attrs {
+		switch v := attr.Value; {
+		case v.StringValue != nil:
+			decoded[attr.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			decoded[attr.Key] = *v.BoolValue
+		case v.IntValue != nil:
+			n, _ := strconv.ParseInt(*v.IntValue, 10, 64)
+			decoded[attr.Key] = n
+		case v.DoubleValue != nil:
+			decoded[attr.Key] = *v.DoubleValue
+		default:
+			decoded[attr.Key] = nil
+		}
+	}
+	return decoded
+}
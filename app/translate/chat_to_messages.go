@@ -0,0 +1,292 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultMaxTokens is used when a chat completions request does not set a
+// token limit, since the messages API requires one.
+const defaultMaxTokens = 4096
+
+// ChatToMessagesRequest converts an OpenAI chat completions request body into
+// an Anthropic messages request body.
+func ChatToMessagesRequest(body []byte) ([]byte, error) {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid chat completions request: %w", err)
+	}
+
+	messagesReq := MessagesRequest{
+		Model:     req.Model,
+		MaxTokens: defaultMaxTokens,
+		TopP:      req.TopP,
+		Stream:    req.Stream,
+	}
+
+	switch {
+	case req.MaxCompletionTokens != nil:
+		messagesReq.MaxTokens = *req.MaxCompletionTokens
+	case req.MaxTokens != nil:
+		messagesReq.MaxTokens = *req.MaxTokens
+	}
+
+	// OpenAI accepts temperatures up to 2, Anthropic only up to 1.
+	if req.Temperature != nil {
+		temperature := min(*req.Temperature, 1)
+		messagesReq.Temperature = &temperature
+	}
+
+	if len(req.Stop) > 0 {
+		stop, err := stopSequences(req.Stop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop: %w", err)
+		}
+		messagesReq.StopSequences = stop
+	}
+
+	if req.User != "" {
+		messagesReq.Metadata = &Metadata{UserID: req.User}
+	}
+
+	var system []string
+	for _, message := range req.Messages {
+		if message.Role == "system" || message.Role == "developer" {
+			system = append(system, contentText(message.Content))
+			continue
+		}
+
+		converted, err := anthropicMessageFromChat(message)
+		if err != nil {
+			return nil, err
+		}
+		// The messages API rejects messages without content, such as an
+		// assistant turn with empty content and no tool calls.
+		if blocks, _ := contentBlocks(converted.Content); len(blocks) == 0 {
+			continue
+		}
+
+		// Consecutive messages of the same role are merged, which also
+		// groups the results of parallel tool calls into one user message.
+		last := len(messagesReq.Messages) - 1
+		if last >= 0 && messagesReq.Messages[last].Role == converted.Role {
+			previous, _ := contentBlocks(messagesReq.Messages[last].Content)
+			current, _ := contentBlocks(converted.Content)
+			messagesReq.Messages[last].Content = rawJSON(append(previous, current...))
+			continue
+		}
+		messagesReq.Messages = append(messagesReq.Messages, converted)
+	}
+
+	if len(system) > 0 {
+		messagesReq.System = rawJSON(strings.Join(system, "\n"))
+	}
+
+	for _, tool := range req.Tools {
+		inputSchema := tool.Function.Parameters
+		if len(inputSchema) == 0 {
+			inputSchema = json.RawMessage(`{"type":"object"}`)
+		}
+		messagesReq.Tools = append(messagesReq.Tools, AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+
+	if len(req.ToolChoice) > 0 {
+		toolChoice, err := anthropicToolChoice(req.ToolChoice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool_choice: %w", err)
+		}
+		messagesReq.ToolChoice = toolChoice
+	}
+
+	if req.ParallelToolCalls != nil && !*req.ParallelToolCalls && len(messagesReq.Tools) > 0 {
+		if messagesReq.ToolChoice == nil {
+			messagesReq.ToolChoice = &ToolChoice{Type: "auto"}
+		}
+		messagesReq.ToolChoice.DisableParallelToolUse = true
+	}
+
+	return json.Marshal(messagesReq)
+}
+
+func stopSequences(stop json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(stop, &single); err == nil {
+		return []string{single}, nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(stop, &multiple); err != nil {
+		return nil, err
+	}
+	return multiple, nil
+}
+
+func anthropicToolChoice(toolChoice json.RawMessage) (*ToolChoice, error) {
+	var mode string
+	if err := json.Unmarshal(toolChoice, &mode); err == nil {
+		switch mode {
+		case "required":
+			return &ToolChoice{Type: "any"}, nil
+		case "none":
+			return &ToolChoice{Type: "none"}, nil
+		default:
+			return &ToolChoice{Type: "auto"}, nil
+		}
+	}
+
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(toolChoice, &named); err != nil {
+		return nil, err
+	}
+	return &ToolChoice{Type: "tool", Name: named.Function.Name}, nil
+}
+
+func anthropicMessageFromChat(message ChatMessage) (AnthropicMessage, error) {
+	switch message.Role {
+	case "assistant":
+		blocks := []ContentBlock{}
+		if text := contentText(message.Content); text != "" {
+			blocks = append(blocks, ContentBlock{Type: "text", Text: text})
+		}
+		for _, call := range message.ToolCalls {
+			blocks = append(blocks, ContentBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Function.Name,
+				Input: toolInput(call.Function.Arguments),
+			})
+		}
+		return AnthropicMessage{Role: "assistant", Content: rawJSON(blocks)}, nil
+
+	case "tool":
+		return AnthropicMessage{
+			Role: "user",
+			Content: rawJSON([]ContentBlock{{
+				Type:      "tool_result",
+				ToolUseID: message.ToolCallID,
+				Content:   rawJSON(contentText(message.Content)),
+			}}),
+		}, nil
+
+	case "user":
+		blocks, err := userBlocks(message.Content)
+		if err != nil {
+			return AnthropicMessage{}, err
+		}
+		return AnthropicMessage{Role: "user", Content: rawJSON(blocks)}, nil
+	}
+
+	return AnthropicMessage{}, fmt.Errorf("unsupported message role: %s", message.Role)
+}
+
+func userBlocks(content json.RawMessage) ([]ContentBlock, error) {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []ContentBlock{{Type: "text", Text: text}}, nil
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return nil, fmt.Errorf("invalid user message content: %w", err)
+	}
+
+	blocks := make([]ContentBlock, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			// Empty text blocks are rejected by the messages API.
+			if part.Text != "" {
+				blocks = append(blocks, ContentBlock{Type: "text", Text: part.Text})
+			}
+		case "image_url":
+			if part.ImageURL != nil {
+				blocks = append(blocks, ContentBlock{Type: "image", Source: imageSource(part.ImageURL.URL)})
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// imageSource converts an image URL, which may be a base64 data URL, into a
+// messages API image source.
+func imageSource(imageURL string) *ImageSource {
+	if data, ok := strings.CutPrefix(imageURL, "data:"); ok {
+		if mediaType, encoded, found := strings.Cut(data, ";base64,"); found {
+			return &ImageSource{Type: "base64", MediaType: mediaType, Data: encoded}
+		}
+	}
+	return &ImageSource{Type: "url", URL: imageURL}
+}
+
+// MessagesToChatResponse converts a non-streaming messages response body
+// into a chat completions response body.
+func MessagesToChatResponse(body []byte) ([]byte, error) {
+	var resp MessagesResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid messages response: %w", err)
+	}
+
+	message := assistantChatMessage(resp.Content)
+
+	usage := chatUsage(resp.Usage)
+	chatResp := ChatCompletionResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []ChatChoice{{
+			Index:        0,
+			Message:      message,
+			FinishReason: FinishReasonFromStopReason(resp.StopReason),
+		}},
+		Usage: &usage,
+	}
+
+	return json.Marshal(chatResp)
+}
+
+// FinishReasonFromStopReason maps a messages API stop reason to a chat
+// completions finish reason.
+func FinishReasonFromStopReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// chatUsage converts messages API usage. Anthropic reports cache reads and
+// writes separately from input tokens, OpenAI includes them in prompt tokens.
+func chatUsage(usage AnthropicUsage) ChatUsage {
+	promptTokens := usage.InputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+
+	result := ChatUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      promptTokens + usage.OutputTokens,
+	}
+
+	if usage.CacheReadInputTokens > 0 {
+		result.PromptTokensDetails = &PromptTokensDetails{CachedTokens: usage.CacheReadInputTokens}
+	}
+
+	return result
+}
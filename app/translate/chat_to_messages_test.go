@@ -0,0 +1,207 @@
+package translate
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChatToMessagesRequest(t *testing.T) {
+	body := `{
+		"model": "gpt-4o",
+		"max_completion_tokens": 512,
+		"temperature": 1.5,
+		"stop": "END",
+		"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+		"messages": [
+			{"role": "system", "content": "You are helpful."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "Weather?"},
+				{"type": "image_url", "image_url": {"url": "data:image/jpeg;base64,aGVsbG8="}}
+			]},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Taipei\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Tokyo\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "Rainy"}
+		]
+	}`
+
+	result, err := ChatToMessagesRequest([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	var req MessagesRequest
+	if err := json.Unmarshal(result, &req); err != nil {
+		t.Fatalf("Failed to decode translated request: %v", err)
+	}
+
+	if req.MaxTokens != 512 {
+		t.Errorf("Expected max_tokens 512, got %d", req.MaxTokens)
+	}
+	if req.Temperature == nil || *req.Temperature != 1 {
+		t.Errorf("Expected temperature clamped to 1, got %v", req.Temperature)
+	}
+	if len(req.StopSequences) != 1 || req.StopSequences[0] != "END" {
+		t.Errorf("Expected stop_sequences [END], got %v", req.StopSequences)
+	}
+	if string(req.System) != `"You are helpful."` {
+		t.Errorf("Expected system prompt, got %s", req.System)
+	}
+	if req.ToolChoice == nil || req.ToolChoice.Type != "tool" || req.ToolChoice.Name != "get_weather" {
+		t.Errorf("Expected tool choice get_weather, got %+v", req.ToolChoice)
+	}
+	if len(req.Tools) != 1 || string(req.Tools[0].InputSchema) != `{"type":"object"}` {
+		t.Errorf("Expected get_weather tool with input schema, got %+v", req.Tools)
+	}
+
+	if len(req.Messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(req.Messages))
+	}
+
+	userBlocks, _ := contentBlocks(req.Messages[0].Content)
+	if len(userBlocks) != 2 || userBlocks[1].Source == nil || userBlocks[1].Source.MediaType != "image/jpeg" {
+		t.Errorf("Expected text and base64 image blocks, got %+v", userBlocks)
+	}
+
+	assistantBlocks, _ := contentBlocks(req.Messages[1].Content)
+	if len(assistantBlocks) != 2 || assistantBlocks[0].Type != "tool_use" || assistantBlocks[0].ID != "call_1" {
+		t.Errorf("Expected two tool_use blocks, got %+v", assistantBlocks)
+	}
+
+	resultBlocks, _ := contentBlocks(req.Messages[2].Content)
+	if req.Messages[2].Role != "user" || len(resultBlocks) != 2 || resultBlocks[1].ToolUseID != "call_2" {
+		t.Errorf("Expected tool results merged into one user message, got %+v", req.Messages[2])
+	}
+}
+
+func TestChatToMessagesRequestEmptyContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+		expected string
+	}{
+		{
+			name:     "empty assistant turn",
+			messages: `[{"role": "user", "content": "Hi"}, {"role": "assistant", "content": ""}, {"role": "user", "content": "Still there?"}]`,
+			expected: `[{"role":"user","content":[{"type":"text","text":"Hi"},{"type":"text","text":"Still there?"}]}]`,
+		},
+		{
+			name:     "null assistant content",
+			messages: `[{"role": "user", "content": "Hi"}, {"role": "assistant", "content": null}]`,
+			expected: `[{"role":"user","content":[{"type":"text","text":"Hi"}]}]`,
+		},
+		{
+			name:     "empty user text",
+			messages: `[{"role": "user", "content": ""}, {"role": "user", "content": "Hi"}]`,
+			expected: `[{"role":"user","content":[{"type":"text","text":"Hi"}]}]`,
+		},
+		{
+			name:     "empty text part",
+			messages: `[{"role": "user", "content": [{"type": "text", "text": ""}, {"type": "text", "text": "Hi"}]}]`,
+			expected: `[{"role":"user","content":[{"type":"text","text":"Hi"}]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ChatToMessagesRequest([]byte(`{"model": "gpt-4o", "messages": ` + tt.messages + `}`))
+			if err != nil {
+				t.Fatalf("Failed to translate request: %v", err)
+			}
+
+			var req struct {
+				Messages json.RawMessage `json:"messages"`
+			}
+			if err := json.Unmarshal(result, &req); err != nil {
+				t.Fatalf("Failed to decode translated request: %v", err)
+			}
+			if string(req.Messages) != tt.expected {
+				t.Errorf("Expected messages %s, got %s", tt.expected, req.Messages)
+			}
+		})
+	}
+}
+
+func TestChatToMessagesRequestDefaultMaxTokens(t *testing.T) {
+	result, err := ChatToMessagesRequest([]byte(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	var req MessagesRequest
+	if err := json.Unmarshal(result, &req); err != nil {
+		t.Fatalf("Failed to decode translated request: %v", err)
+	}
+	if req.MaxTokens != defaultMaxTokens {
+		t.Errorf("Expected max_tokens %d, got %d", defaultMaxTokens, req.MaxTokens)
+	}
+}
+
+func TestMessagesToChatResponse(t *testing.T) {
+	body := `{
+		"id": "msg_1",
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-sonnet-4",
+		"content": [
+			{"type": "text", "text": "Checking."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Taipei"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 10, "output_tokens": 20, "cache_read_input_tokens": 5, "cache_creation_input_tokens": 3}
+	}`
+
+	result, err := MessagesToChatResponse([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to translate response: %v", err)
+	}
+
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(result, &resp); err != nil {
+		t.Fatalf("Failed to decode translated response: %v", err)
+	}
+
+	if resp.Object != "chat.completion" {
+		t.Errorf("Expected object chat.completion, got %s", resp.Object)
+	}
+	if len(resp.Choices) != 1 {
+		t.Fatalf("Expected 1 choice, got %d", len(resp.Choices))
+	}
+
+	choice := resp.Choices[0]
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("Expected finish_reason tool_calls, got %s", choice.FinishReason)
+	}
+	if contentText(choice.Message.Content) != "Checking." {
+		t.Errorf("Expected content 'Checking.', got %s", choice.Message.Content)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Arguments != `{"city": "Taipei"}` {
+		t.Errorf("Expected get_weather tool call, got %+v", choice.Message.ToolCalls)
+	}
+
+	if resp.Usage == nil || resp.Usage.PromptTokens != 18 || resp.Usage.CompletionTokens != 20 || resp.Usage.TotalTokens != 38 {
+		t.Errorf("Expected usage 18/20/38, got %+v", resp.Usage)
+	}
+	if resp.Usage.PromptTokensDetails == nil || resp.Usage.PromptTokensDetails.CachedTokens != 5 {
+		t.Errorf("Expected 5 cached tokens, got %+v", resp.Usage.PromptTokensDetails)
+	}
+}
+
+func TestFinishReasonFromStopReason(t *testing.T) {
+	tests := map[string]string{
+		"end_turn":      "stop",
+		"stop_sequence": "stop",
+		"max_tokens":    "length",
+		"tool_use":      "tool_calls",
+		"refusal":       "content_filter",
+	}
+
+	for stopReason, expected := range tests {
+		if got := FinishReasonFromStopReason(stopReason); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, stopReason, got)
+		}
+	}
+}
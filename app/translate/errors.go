@@ -0,0 +1,90 @@
+package translate
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// OpenAIErrorBody returns an OpenAI-shaped error body.
+func OpenAIErrorBody(status int, message string) []byte {
+	return rawJSON(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    openAIErrorType(status),
+			"code":    nil,
+		},
+	})
+}
+
+// AnthropicErrorBody returns an Anthropic-shaped error body.
+func AnthropicErrorBody(status int, message string) []byte {
+	return rawJSON(map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    anthropicErrorType(status),
+			"message": message,
+		},
+	})
+}
+
+// ErrorMessage extracts the error message from an OpenAI or Anthropic error
+// body, falling back to the raw body text.
+func ErrorMessage(body []byte) string {
+	var errorBody struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorBody); err == nil && len(errorBody.Error) > 0 {
+		var detail struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(errorBody.Error, &detail); err == nil && detail.Message != "" {
+			return detail.Message
+		}
+
+		var message string
+		if err := json.Unmarshal(errorBody.Error, &message); err == nil && message != "" {
+			return message
+		}
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == 529:
+		return "overloaded_error"
+	case status >= http.StatusInternalServerError:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
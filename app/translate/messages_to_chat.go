@@ -0,0 +1,310 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MessagesToChatRequest converts an Anthropic messages request body into an
+// OpenAI chat completions request body.
+func MessagesToChatRequest(body []byte) ([]byte, error) {
+	var req MessagesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid messages request: %w", err)
+	}
+
+	chatReq := ChatCompletionRequest{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      req.Stream,
+	}
+
+	// Usage is only reported at the end of a chat completions stream when
+	// requested, and messages clients expect it in the final message_delta.
+	if req.Stream {
+		chatReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	if req.MaxTokens > 0 {
+		maxTokens := req.MaxTokens
+		chatReq.MaxTokens = &maxTokens
+	}
+
+	if len(req.StopSequences) > 0 {
+		chatReq.Stop = rawJSON(req.StopSequences)
+	}
+
+	if req.Metadata != nil {
+		chatReq.User = req.Metadata.UserID
+	}
+
+	if len(req.System) > 0 {
+		system, err := systemText(req.System)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system prompt: %w", err)
+		}
+		if system != "" {
+			chatReq.Messages = append(chatReq.Messages, ChatMessage{Role: "system", Content: rawJSON(system)})
+		}
+	}
+
+	for _, message := range req.Messages {
+		messages, err := chatMessagesFromAnthropic(message)
+		if err != nil {
+			return nil, err
+		}
+		chatReq.Messages = append(chatReq.Messages, messages...)
+	}
+
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, ChatTool{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto":
+			chatReq.ToolChoice = rawJSON("auto")
+		case "any":
+			chatReq.ToolChoice = rawJSON("required")
+		case "none":
+			chatReq.ToolChoice = rawJSON("none")
+		case "tool":
+			chatReq.ToolChoice = rawJSON(map[string]any{
+				"type":     "function",
+				"function": map[string]string{"name": req.ToolChoice.Name},
+			})
+		}
+
+		if req.ToolChoice.DisableParallelToolUse {
+			parallel := false
+			chatReq.ParallelToolCalls = &parallel
+		}
+	}
+
+	return json.Marshal(chatReq)
+}
+
+func systemText(system json.RawMessage) (string, error) {
+	blocks, err := contentBlocks(system)
+	if err != nil {
+		return "", err
+	}
+
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// chatMessagesFromAnthropic converts one messages API message into chat
+// messages. Tool results become separate tool messages placed before the
+// remaining user content, since they must directly follow the assistant
+// message that issued the tool calls.
+func chatMessagesFromAnthropic(message AnthropicMessage) ([]ChatMessage, error) {
+	blocks, err := contentBlocks(message.Content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s message content: %w", message.Role, err)
+	}
+
+	if message.Role == "assistant" {
+		return []ChatMessage{assistantChatMessage(blocks)}, nil
+	}
+
+	var messages []ChatMessage
+	var parts []ContentPart
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, ContentPart{Type: "text", Text: block.Text})
+		case "image":
+			if part, ok := imagePart(block.Source); ok {
+				parts = append(parts, part)
+			}
+		case "tool_result":
+			result, err := toolResultText(block)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, ChatMessage{
+				Role:       "tool",
+				ToolCallID: block.ToolUseID,
+				Content:    rawJSON(result),
+			})
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0].Type == "text":
+		messages = append(messages, ChatMessage{Role: message.Role, Content: rawJSON(parts[0].Text)})
+	case len(parts) > 0:
+		messages = append(messages, ChatMessage{Role: message.Role, Content: rawJSON(parts)})
+	}
+
+	return messages, nil
+}
+
+func assistantChatMessage(blocks []ContentBlock) ChatMessage {
+	message := ChatMessage{Role: "assistant"}
+
+	var text strings.Builder
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			message.ToolCalls = append(message.ToolCalls, ToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: FunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+
+	if text.Len() > 0 || len(message.ToolCalls) == 0 {
+		message.Content = rawJSON(text.String())
+	} else {
+		message.Content = json.RawMessage("null")
+	}
+
+	return message
+}
+
+func imagePart(source *ImageSource) (ContentPart, bool) {
+	if source == nil {
+		return ContentPart{}, false
+	}
+
+	switch source.Type {
+	case "base64":
+		return ContentPart{
+			Type:     "image_url",
+			ImageURL: &ImageURL{URL: "data:" + source.MediaType + ";base64," + source.Data},
+		}, true
+	case "url":
+		return ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: source.URL}}, true
+	}
+
+	return ContentPart{}, false
+}
+
+func toolResultText(block ContentBlock) (string, error) {
+	blocks, err := contentBlocks(block.Content)
+	if err != nil {
+		return "", fmt.Errorf("invalid tool_result content: %w", err)
+	}
+
+	texts := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		if b.Type == "text" {
+			texts = append(texts, b.Text)
+		}
+	}
+
+	text := strings.Join(texts, "\n")
+	if block.IsError {
+		text = "Error: " + text
+	}
+	return text, nil
+}
+
+// ChatToMessagesResponse converts a non-streaming chat completions response
+// body into a messages response body.
+func ChatToMessagesResponse(body []byte) ([]byte, error) {
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid chat completions response: %w", err)
+	}
+
+	messagesResp := MessagesResponse{
+		ID:      resp.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   resp.Model,
+		Content: []ContentBlock{},
+	}
+
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+
+		if text := contentText(choice.Message.Content); text != "" {
+			messagesResp.Content = append(messagesResp.Content, ContentBlock{Type: "text", Text: text})
+		}
+
+		for _, call := range choice.Message.ToolCalls {
+			messagesResp.Content = append(messagesResp.Content, ContentBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Function.Name,
+				Input: toolInput(call.Function.Arguments),
+			})
+		}
+
+		messagesResp.StopReason = StopReasonFromFinishReason(choice.FinishReason)
+	}
+
+	if resp.Usage != nil {
+		messagesResp.Usage = anthropicUsage(*resp.Usage)
+	}
+
+	return json.Marshal(messagesResp)
+}
+
+// toolInput returns tool call arguments as a JSON object, falling back to an
+// empty object when the upstream produced invalid JSON.
+func toolInput(arguments string) json.RawMessage {
+	var input map[string]any
+	if err := json.Unmarshal([]byte(arguments), &input); err != nil || input == nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// StopReasonFromFinishReason maps a chat completions finish reason to a
+// messages API stop reason.
+func StopReasonFromFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicUsage converts chat completions usage. Prompt tokens include
+// cached tokens in OpenAI usage but not in Anthropic usage.
+func anthropicUsage(usage ChatUsage) AnthropicUsage {
+	result := AnthropicUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+	}
+
+	if usage.PromptTokensDetails != nil {
+		result.CacheReadInputTokens = usage.PromptTokensDetails.CachedTokens
+		result.InputTokens -= usage.PromptTokensDetails.CachedTokens
+	}
+
+	return result
+}
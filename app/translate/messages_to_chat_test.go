@@ -0,0 +1,154 @@
+package translate
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessagesToChatRequest(t *testing.T) {
+	body := `{
+		"model": "claude-sonnet",
+		"max_tokens": 1024,
+		"system": [{"type": "text", "text": "You are helpful."}],
+		"stop_sequences": ["END"],
+		"tools": [{"name": "get_weather", "description": "Get weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is in this image?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGVsbG8="}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Let me check."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Taipei"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": "Sunny"},
+				{"type": "text", "text": "Thanks"}
+			]}
+		]
+	}`
+
+	result, err := MessagesToChatRequest([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(result, &req); err != nil {
+		t.Fatalf("Failed to decode translated request: %v", err)
+	}
+
+	if req.MaxTokens == nil || *req.MaxTokens != 1024 {
+		t.Errorf("Expected max_tokens 1024, got %v", req.MaxTokens)
+	}
+	if string(req.Stop) != `["END"]` {
+		t.Errorf("Expected stop [\"END\"], got %s", req.Stop)
+	}
+	if string(req.ToolChoice) != `"required"` {
+		t.Errorf("Expected tool_choice \"required\", got %s", req.ToolChoice)
+	}
+	if len(req.Tools) != 1 || req.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("Expected get_weather function tool, got %+v", req.Tools)
+	}
+
+	roles := make([]string, 0, len(req.Messages))
+	for _, message := range req.Messages {
+		roles = append(roles, message.Role)
+	}
+	expectedRoles := []string{"system", "user", "assistant", "tool", "user"}
+	if len(roles) != len(expectedRoles) {
+		t.Fatalf("Expected roles %v, got %v", expectedRoles, roles)
+	}
+	for i := range roles {
+		if roles[i] != expectedRoles[i] {
+			t.Fatalf("Expected roles %v, got %v", expectedRoles, roles)
+		}
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(req.Messages[1].Content, &parts); err != nil {
+		t.Fatalf("Expected user content parts, got %s", req.Messages[1].Content)
+	}
+	if len(parts) != 2 || parts[1].ImageURL == nil || parts[1].ImageURL.URL != "data:image/png;base64,aGVsbG8=" {
+		t.Errorf("Expected image data URL part, got %+v", parts)
+	}
+
+	assistant := req.Messages[2]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID != "toolu_1" {
+		t.Fatalf("Expected tool call toolu_1, got %+v", assistant.ToolCalls)
+	}
+	if assistant.ToolCalls[0].Function.Arguments != `{"city": "Taipei"}` {
+		t.Errorf("Expected tool call arguments, got %s", assistant.ToolCalls[0].Function.Arguments)
+	}
+
+	tool := req.Messages[3]
+	if tool.ToolCallID != "toolu_1" || contentText(tool.Content) != "Sunny" {
+		t.Errorf("Expected tool result for toolu_1, got %+v", tool)
+	}
+}
+
+func TestChatToMessagesResponse(t *testing.T) {
+	tests := []struct {
+		name               string
+		body               string
+		expectedStopReason string
+		expectedTypes      []string
+		expectedUsage      AnthropicUsage
+	}{
+		{
+			name: "text response",
+			body: `{"id": "chatcmpl-1", "model": "gpt-4o", "choices": [{"message": {"role": "assistant", "content": "Hello"}, "finish_reason": "stop"}],
+				"usage": {"prompt_tokens": 10, "completion_tokens": 5, "prompt_tokens_details": {"cached_tokens": 4}}}`,
+			expectedStopReason: "end_turn",
+			expectedTypes:      []string{"text"},
+			expectedUsage:      AnthropicUsage{InputTokens: 6, OutputTokens: 5, CacheReadInputTokens: 4},
+		},
+		{
+			name: "tool call response",
+			body: `{"id": "chatcmpl-2", "model": "gpt-4o", "choices": [{"message": {"role": "assistant", "content": null,
+				"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Taipei\"}"}}]},
+				"finish_reason": "tool_calls"}]}`,
+			expectedStopReason: "tool_use",
+			expectedTypes:      []string{"tool_use"},
+		},
+		{
+			name:               "truncated response",
+			body:               `{"id": "chatcmpl-3", "model": "gpt-4o", "choices": [{"message": {"role": "assistant", "content": "Hel"}, "finish_reason": "length"}]}`,
+			expectedStopReason: "max_tokens",
+			expectedTypes:      []string{"text"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ChatToMessagesResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("Failed to translate response: %v", err)
+			}
+
+			var resp MessagesResponse
+			if err := json.Unmarshal(result, &resp); err != nil {
+				t.Fatalf("Failed to decode translated response: %v", err)
+			}
+
+			if resp.Type != "message" || resp.Role != "assistant" {
+				t.Errorf("Expected assistant message, got type %s role %s", resp.Type, resp.Role)
+			}
+			if resp.StopReason != tt.expectedStopReason {
+				t.Errorf("Expected stop reason %s, got %s", tt.expectedStopReason, resp.StopReason)
+			}
+			if len(resp.Content) != len(tt.expectedTypes) {
+				t.Fatalf("Expected %d content blocks, got %d", len(tt.expectedTypes), len(resp.Content))
+			}
+			for i, block := range resp.Content {
+				if block.Type != tt.expectedTypes[i] {
+					t.Errorf("Expected block %d to be %s, got %s", i, tt.expectedTypes[i], block.Type)
+				}
+			}
+			if resp.Usage != tt.expectedUsage {
+				t.Errorf("Expected usage %+v, got %+v", tt.expectedUsage, resp.Usage)
+			}
+		})
+	}
+}
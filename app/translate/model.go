@@ -0,0 +1,66 @@
+package translate
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// RewriteModel replaces the model name in a response payload, both at the top
+// level and in the message of an Anthropic message_start event. The payload
+// is returned unchanged when it does not report the from model.
+func RewriteModel(data []byte, from, to string) []byte {
+	if from == to || !bytes.Contains(data, []byte(from)) {
+		return data
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return data
+	}
+
+	changed := rewriteModelField(payload, from, to)
+
+	if message, ok := payload["message"]; ok {
+		var inner map[string]json.RawMessage
+		if err := json.Unmarshal(message, &inner); err == nil && rewriteModelField(inner, from, to) {
+			payload["message"] = rawJSON(inner)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return data
+	}
+	return rawJSON(payload)
+}
+
+func rewriteModelField(payload map[string]json.RawMessage, from, to string) bool {
+	var model string
+	if err := json.Unmarshal(payload["model"], &model); err != nil || model != from {
+		return false
+	}
+	payload["model"] = rawJSON(to)
+	return true
+}
+
+// modelRewriteStream passes events through, rewriting the model name in
+// their payloads.
+type modelRewriteStream struct {
+	from string
+	to   string
+}
+
+// NewModelRewriteStream returns a converter for a stream in the client's own
+// protocol that reports the client's model name instead of the upstream's.
+func NewModelRewriteStream(from, to string) StreamConverter {
+	return &modelRewriteStream{from: from, to: to}
+}
+
+func (s *modelRewriteStream) Convert(event Event) []Event {
+	event.Data = RewriteModel(event.Data, s.from, s.to)
+	return []Event{event}
+}
+
+func (s *modelRewriteStream) Finish() []Event {
+	return nil
+}
@@ -0,0 +1,60 @@
+package translate
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRewriteModel(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{
+			name:     "chat completions chunk",
+			data:     `{"id":"chatcmpl-1","model":"gpt-4o","choices":[]}`,
+			expected: "alias",
+		},
+		{
+			name:     "message_start event",
+			data:     `{"type":"message_start","message":{"id":"msg_1","model":"gpt-4o"}}`,
+			expected: "alias",
+		},
+		{
+			name:     "different model is left alone",
+			data:     `{"id":"chatcmpl-1","model":"gpt-4o-2024-08-06","choices":[]}`,
+			expected: "gpt-4o-2024-08-06",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := RewriteModel([]byte(tt.data), "gpt-4o", "alias")
+
+			var payload struct {
+				Model   string `json:"model"`
+				Message struct {
+					Model string `json:"model"`
+				} `json:"message"`
+			}
+			if err := json.Unmarshal(result, &payload); err != nil {
+				t.Fatalf("Failed to decode rewritten payload: %v", err)
+			}
+
+			model := payload.Model
+			if model == "" {
+				model = payload.Message.Model
+			}
+			if model != tt.expected {
+				t.Errorf("Expected model %s, got %s", tt.expected, model)
+			}
+		})
+	}
+}
+
+func TestRewriteModelKeepsNonJSON(t *testing.T) {
+	if result := RewriteModel([]byte("[DONE]"), "gpt-4o", "alias"); string(result) != "[DONE]" {
+		t.Errorf("Expected [DONE] to be unchanged, got %s", result)
+	}
+}
@@ -0,0 +1,104 @@
+package translate
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Event is a server-sent event. Name is empty for events without an event
+// field, such as chat completions chunks.
+type Event struct {
+	Name string
+	Data []byte
+}
+
+// doneData marks the end of a chat completions stream.
+const doneData = "[DONE]"
+
+// IsDone reports whether the event is the chat completions end marker.
+func (e Event) IsDone() bool {
+	return string(e.Data) == doneData
+}
+
+// EventReader reads server-sent events from a stream.
+type EventReader struct {
+	scanner *bufio.Scanner
+}
+
+// maxEventLineSize bounds a single SSE line, which can hold a whole
+// tool call argument or a large usage payload.
+const maxEventLineSize = 4 << 20
+
+func NewEventReader(r io.Reader) *EventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventLineSize)
+	return &EventReader{scanner: scanner}
+}
+
+// Next returns the next event with data. It returns io.EOF once the stream
+// ends, flushing a final event that is not terminated by a blank line.
+func (r *EventReader) Next() (Event, error) {
+	var event Event
+	var data [][]byte
+	hasData := false
+
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+
+		if len(line) == 0 {
+			if hasData {
+				event.Data = bytes.Join(data, []byte("\n"))
+				return event, nil
+			}
+			event = Event{}
+			continue
+		}
+
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := strings.Cut(string(line), ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Name = value
+		case "data":
+			data = append(data, []byte(value))
+			hasData = true
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+
+	if hasData {
+		event.Data = bytes.Join(data, []byte("\n"))
+		return event, nil
+	}
+
+	return Event{}, io.EOF
+}
+
+// WriteEvent writes an event in SSE wire format.
+func WriteEvent(w io.Writer, event Event) error {
+	var buf bytes.Buffer
+	if event.Name != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event.Name)
+		buf.WriteByte('\n')
+	}
+	for line := range bytes.SplitSeq(event.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,52 @@
+package translate
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEventReader(t *testing.T) {
+	stream := ": keep-alive\n\n" +
+		"event: message_start\ndata: {\"type\":\"message_start\"}\n\n" +
+		"data: first\ndata: second\n\n" +
+		"data: [DONE]"
+
+	reader := NewEventReader(strings.NewReader(stream))
+
+	expected := []Event{
+		{Name: "message_start", Data: []byte(`{"type":"message_start"}`)},
+		{Data: []byte("first\nsecond")},
+		{Data: []byte("[DONE]")},
+	}
+
+	for i, want := range expected {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Event %d: unexpected error: %v", i, err)
+		}
+		if event.Name != want.Name || !bytes.Equal(event.Data, want.Data) {
+			t.Errorf("Event %d: expected %+v, got name=%q data=%q", i, want, event.Name, event.Data)
+		}
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteEvent(&buf, Event{Name: "ping", Data: []byte(`{"type":"ping"}`)}); err != nil {
+		t.Fatalf("Failed to write event: %v", err)
+	}
+	if err := WriteEvent(&buf, Event{Data: []byte("[DONE]")}); err != nil {
+		t.Fatalf("Failed to write event: %v", err)
+	}
+
+	expected := "event: ping\ndata: {\"type\":\"ping\"}\n\ndata: [DONE]\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
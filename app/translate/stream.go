@@ -0,0 +1,377 @@
+package translate
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"time"
+)
+
+// StreamConverter converts the events of an upstream stream into the events
+// of the client's protocol.
+type StreamConverter interface {
+	// Convert returns the client events for one upstream event.
+	Convert(event Event) []Event
+	// Finish returns the client events that close the stream. It is called
+	// once the upstream stream ends, even if it ended without its final
+	// events.
+	Finish() []Event
+}
+
+type chatChunk struct {
+	ID      string            `json:"id"`
+	Object  string            `json:"object"`
+	Created int64             `json:"created"`
+	Model   string            `json:"model"`
+	Choices []chatChunkChoice `json:"choices"`
+	Usage   *ChatUsage        `json:"usage,omitempty"`
+}
+
+type chatChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        chatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type chatDelta struct {
+	Role      string     `json:"role,omitempty"`
+	Content   *string    `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// anthropicEvent holds the fields of every messages stream event type.
+type anthropicEvent struct {
+	Type         string            `json:"type"`
+	Message      *MessagesResponse `json:"message,omitempty"`
+	Index        int               `json:"index"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        *anthropicDelta   `json:"delta,omitempty"`
+	Usage        *AnthropicUsage   `json:"usage,omitempty"`
+	Error        json.RawMessage   `json:"error,omitempty"`
+}
+
+type anthropicDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	PartialJSON  string  `json:"partial_json,omitempty"`
+	StopReason   string  `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+// chatToMessagesStream converts chat completions chunks into messages
+// stream events.
+type chatToMessagesStream struct {
+	model      string
+	started    bool
+	finished   bool
+	blockIndex int
+	blockType  string
+	toolBlocks map[int]int
+	stopReason string
+	usage      AnthropicUsage
+}
+
+// NewChatToMessagesStream returns a converter for an OpenAI upstream stream
+// serving a messages client. Events report the given model name.
+func NewChatToMessagesStream(model string) StreamConverter {
+	return &chatToMessagesStream{
+		model:      model,
+		blockIndex: -1,
+		toolBlocks: make(map[int]int),
+	}
+}
+
+func (s *chatToMessagesStream) Convert(event Event) []Event {
+	if s.finished {
+		return nil
+	}
+
+	if event.IsDone() {
+		return s.Finish()
+	}
+
+	var chunk chatChunk
+	if err := json.Unmarshal(event.Data, &chunk); err != nil {
+		return nil
+	}
+
+	var events []Event
+	if !s.started {
+		events = append(events, s.start(chunk.ID))
+	}
+
+	if chunk.Usage != nil {
+		s.usage = anthropicUsage(*chunk.Usage)
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+			if s.blockType != "text" {
+				events = append(events, s.startBlock(ContentBlock{Type: "text", Text: ""})...)
+			}
+			events = append(events, s.delta(s.blockIndex, anthropicDelta{Type: "text_delta", Text: *choice.Delta.Content}))
+		}
+
+		for _, call := range choice.Delta.ToolCalls {
+			callIndex := 0
+			if call.Index != nil {
+				callIndex = *call.Index
+			}
+
+			blockIndex, exists := s.toolBlocks[callIndex]
+			if !exists {
+				events = append(events, s.startBlock(ContentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: json.RawMessage("{}"),
+				})...)
+				blockIndex = s.blockIndex
+				s.toolBlocks[callIndex] = blockIndex
+			}
+
+			if call.Function.Arguments != "" {
+				events = append(events, s.delta(blockIndex, anthropicDelta{Type: "input_json_delta", PartialJSON: call.Function.Arguments}))
+			}
+		}
+
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			s.stopReason = StopReasonFromFinishReason(*choice.FinishReason)
+		}
+	}
+
+	return events
+}
+
+func (s *chatToMessagesStream) Finish() []Event {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+
+	var events []Event
+	if !s.started {
+		events = append(events, s.start(""))
+	}
+	indices := slices.Collect(maps.Values(s.toolBlocks))
+	if s.blockType == "text" {
+		indices = append(indices, s.blockIndex)
+	}
+	slices.Sort(indices)
+	for _, index := range indices {
+		events = append(events, s.stopBlock(index))
+	}
+
+	stopReason := s.stopReason
+	if stopReason == "" {
+		stopReason = "end_turn"
+	}
+
+	events = append(events,
+		anthropicStreamEvent("message_delta", map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil},
+			"usage": s.usage,
+		}),
+		anthropicStreamEvent("message_stop", map[string]any{"type": "message_stop"}),
+	)
+	return events
+}
+
+func (s *chatToMessagesStream) start(id string) Event {
+	s.started = true
+	return anthropicStreamEvent("message_start", map[string]any{
+		"type": "message_start",
+		"message": MessagesResponse{
+			ID:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   s.model,
+			Content: []ContentBlock{},
+		},
+	})
+}
+
+// startBlock starts a content block, stopping the text block in progress.
+// Tool use blocks stay open until the stream finishes, since providers may
+// interleave the argument chunks of parallel tool calls.
+func (s *chatToMessagesStream) startBlock(block ContentBlock) []Event {
+	var events []Event
+	if s.blockType == "text" {
+		events = append(events, s.stopBlock(s.blockIndex))
+	}
+	s.blockIndex++
+	s.blockType = block.Type
+	return append(events, anthropicStreamEvent("content_block_start", map[string]any{
+		"type":          "content_block_start",
+		"index":         s.blockIndex,
+		"content_block": block,
+	}))
+}
+
+func (s *chatToMessagesStream) stopBlock(index int) Event {
+	return anthropicStreamEvent("content_block_stop", map[string]any{
+		"type":  "content_block_stop",
+		"index": index,
+	})
+}
+
+func (s *chatToMessagesStream) delta(index int, delta anthropicDelta) Event {
+	return anthropicStreamEvent("content_block_delta", map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": delta,
+	})
+}
+
+func anthropicStreamEvent(name string, payload any) Event {
+	return Event{Name: name, Data: rawJSON(payload)}
+}
+
+// messagesToChatStream converts messages stream events into chat
+// completions chunks.
+type messagesToChatStream struct {
+	model        string
+	includeUsage bool
+	id           string
+	created      int64
+	finished     bool
+	toolCalls    map[int]int
+	usage        AnthropicUsage
+}
+
+// NewMessagesToChatStream returns a converter for an Anthropic upstream
+// stream serving a chat completions client. Chunks report the given model
+// name, and a final usage chunk is sent when includeUsage is set, matching
+// the stream_options.include_usage request option.
+func NewMessagesToChatStream(model string, includeUsage bool) StreamConverter {
+	return &messagesToChatStream{
+		model:        model,
+		includeUsage: includeUsage,
+		created:      time.Now().Unix(),
+		toolCalls:    make(map[int]int),
+	}
+}
+
+func (s *messagesToChatStream) Convert(event Event) []Event {
+	if s.finished {
+		return nil
+	}
+
+	var payload anthropicEvent
+	if err := json.Unmarshal(event.Data, &payload); err != nil {
+		return nil
+	}
+
+	switch payload.Type {
+	case "message_start":
+		if payload.Message != nil {
+			s.id = payload.Message.ID
+			s.usage = payload.Message.Usage
+		}
+		return []Event{s.chunk(chatDelta{Role: "assistant", Content: new(string)}, nil)}
+
+	case "content_block_start":
+		if payload.ContentBlock == nil || payload.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		callIndex := len(s.toolCalls)
+		s.toolCalls[payload.Index] = callIndex
+		return []Event{s.chunk(chatDelta{ToolCalls: []ToolCall{{
+			Index: &callIndex,
+			ID:    payload.ContentBlock.ID,
+			Type:  "function",
+			Function: FunctionCall{
+				Name:      payload.ContentBlock.Name,
+				Arguments: "",
+			},
+		}}}, nil)}
+
+	case "content_block_delta":
+		if payload.Delta == nil {
+			return nil
+		}
+		switch payload.Delta.Type {
+		case "text_delta":
+			text := payload.Delta.Text
+			return []Event{s.chunk(chatDelta{Content: &text}, nil)}
+		case "input_json_delta":
+			callIndex, exists := s.toolCalls[payload.Index]
+			if !exists {
+				return nil
+			}
+			return []Event{s.chunk(chatDelta{ToolCalls: []ToolCall{{
+				Index:    &callIndex,
+				Function: FunctionCall{Arguments: payload.Delta.PartialJSON},
+			}}}, nil)}
+		}
+
+	case "message_delta":
+		if payload.Usage != nil {
+			s.mergeUsage(*payload.Usage)
+		}
+		if payload.Delta != nil && payload.Delta.StopReason != "" {
+			finishReason := FinishReasonFromStopReason(payload.Delta.StopReason)
+			return []Event{s.chunk(chatDelta{}, &finishReason)}
+		}
+
+	case "message_stop":
+		return s.Finish()
+
+	case "error":
+		s.finished = true
+		return []Event{{Data: rawJSON(map[string]json.RawMessage{"error": payload.Error})}, {Data: []byte(doneData)}}
+	}
+
+	return nil
+}
+
+// mergeUsage applies message_delta usage, whose counts are cumulative and
+// only present for the fields the upstream reports at the end.
+func (s *messagesToChatStream) mergeUsage(usage AnthropicUsage) {
+	s.usage.OutputTokens = usage.OutputTokens
+	if usage.InputTokens > 0 {
+		s.usage.InputTokens = usage.InputTokens
+	}
+	if usage.CacheReadInputTokens > 0 {
+		s.usage.CacheReadInputTokens = usage.CacheReadInputTokens
+	}
+	if usage.CacheCreationInputTokens > 0 {
+		s.usage.CacheCreationInputTokens = usage.CacheCreationInputTokens
+	}
+}
+
+func (s *messagesToChatStream) Finish() []Event {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+
+	var events []Event
+	if s.includeUsage {
+		usage := chatUsage(s.usage)
+		events = append(events, Event{Data: rawJSON(chatChunk{
+			ID:      s.id,
+			Object:  "chat.completion.chunk",
+			Created: s.created,
+			Model:   s.model,
+			Choices: []chatChunkChoice{},
+			Usage:   &usage,
+		})})
+	}
+	return append(events, Event{Data: []byte(doneData)})
+}
+
+func (s *messagesToChatStream) chunk(delta chatDelta, finishReason *string) Event {
+	return Event{Data: rawJSON(chatChunk{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []chatChunkChoice{{
+			Index:        0,
+			Delta:        delta,
+			FinishReason: finishReason,
+		}},
+	})}
+}
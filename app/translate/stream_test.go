@@ -0,0 +1,253 @@
+package translate
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func convertStream(t *testing.T, converter StreamConverter, stream string) []Event {
+	t.Helper()
+
+	var events []Event
+	reader := NewEventReader(strings.NewReader(stream))
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			break
+		}
+		events = append(events, converter.Convert(event)...)
+	}
+	return append(events, converter.Finish()...)
+}
+
+func TestChatToMessagesStream(t *testing.T) {
+	stream := `data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Let me "}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"check."}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Taipei\"}"}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":7,"total_tokens":19}}
+
+data: [DONE]
+
+`
+
+	events := convertStream(t, NewChatToMessagesStream("claude-sonnet"), stream)
+
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Name)
+	}
+	expected := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected events %v, got %v", expected, names)
+	}
+
+	var start struct {
+		Message MessagesResponse `json:"message"`
+	}
+	if err := json.Unmarshal(events[0].Data, &start); err != nil {
+		t.Fatalf("Failed to decode message_start: %v", err)
+	}
+	if start.Message.Model != "claude-sonnet" {
+		t.Errorf("Expected model claude-sonnet, got %s", start.Message.Model)
+	}
+
+	var toolStart struct {
+		Index        int          `json:"index"`
+		ContentBlock ContentBlock `json:"content_block"`
+	}
+	if err := json.Unmarshal(events[5].Data, &toolStart); err != nil {
+		t.Fatalf("Failed to decode content_block_start: %v", err)
+	}
+	if toolStart.Index != 1 || toolStart.ContentBlock.Type != "tool_use" || toolStart.ContentBlock.ID != "call_1" {
+		t.Errorf("Expected tool_use block call_1 at index 1, got %+v", toolStart)
+	}
+
+	var argsDelta anthropicEvent
+	if err := json.Unmarshal(events[6].Data, &argsDelta); err != nil {
+		t.Fatalf("Failed to decode content_block_delta: %v", err)
+	}
+	if argsDelta.Delta.Type != "input_json_delta" || argsDelta.Delta.PartialJSON != `{"city":` {
+		t.Errorf("Expected input_json_delta, got %+v", argsDelta.Delta)
+	}
+
+	var messageDelta anthropicEvent
+	if err := json.Unmarshal(events[9].Data, &messageDelta); err != nil {
+		t.Fatalf("Failed to decode message_delta: %v", err)
+	}
+	if messageDelta.Delta.StopReason != "tool_use" {
+		t.Errorf("Expected stop_reason tool_use, got %s", messageDelta.Delta.StopReason)
+	}
+	if messageDelta.Usage == nil || messageDelta.Usage.InputTokens != 12 || messageDelta.Usage.OutputTokens != 7 {
+		t.Errorf("Expected usage 12/7, got %+v", messageDelta.Usage)
+	}
+}
+
+func TestChatToMessagesStreamInterleavedToolCalls(t *testing.T) {
+	stream := `data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"get_time","arguments":""}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Checking."}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"{\"zone\":\"UTC\"}"}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Taipei\"}"}}]}}]}
+
+data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+
+	events := convertStream(t, NewChatToMessagesStream("claude-sonnet"), stream)
+
+	blockTypes := make(map[int]string)
+	stopped := make(map[int]bool)
+	inputs := make(map[int]string)
+	for _, event := range events {
+		var payload anthropicEvent
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			t.Fatalf("Failed to decode %s: %v", event.Name, err)
+		}
+
+		switch event.Name {
+		case "content_block_start":
+			if _, exists := blockTypes[payload.Index]; exists {
+				t.Errorf("Expected block %d to start once", payload.Index)
+			}
+			blockTypes[payload.Index] = payload.ContentBlock.Type
+		case "content_block_delta":
+			if _, exists := blockTypes[payload.Index]; !exists || stopped[payload.Index] {
+				t.Errorf("Expected delta for block %d between its start and stop", payload.Index)
+			}
+			inputs[payload.Index] += payload.Delta.PartialJSON + payload.Delta.Text
+		case "content_block_stop":
+			if stopped[payload.Index] {
+				t.Errorf("Expected block %d to stop once", payload.Index)
+			}
+			stopped[payload.Index] = true
+		}
+	}
+
+	expectedTypes := map[int]string{0: "tool_use", 1: "tool_use", 2: "text"}
+	expectedInputs := map[int]string{0: `{"city":"Taipei"}`, 1: `{"zone":"UTC"}`, 2: "Checking."}
+	for index, blockType := range expectedTypes {
+		if blockTypes[index] != blockType || !stopped[index] {
+			t.Errorf("Expected stopped %s block at index %d, got %q (stopped %v)", blockType, index, blockTypes[index], stopped[index])
+		}
+		if inputs[index] != expectedInputs[index] {
+			t.Errorf("Expected block %d to carry %s, got %s", index, expectedInputs[index], inputs[index])
+		}
+	}
+}
+
+func TestMessagesToChatStream(t *testing.T) {
+	stream := `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4","content":[],"usage":{"input_tokens":25,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":\"Taipei\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":15}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+	events := convertStream(t, NewMessagesToChatStream("gpt-4o", true), stream)
+	if len(events) != 7 {
+		t.Fatalf("Expected 7 events, got %d", len(events))
+	}
+
+	var chunks []chatChunk
+	for _, event := range events[:len(events)-1] {
+		if event.Name != "" {
+			t.Errorf("Expected unnamed event, got %s", event.Name)
+		}
+		var chunk chatChunk
+		if err := json.Unmarshal(event.Data, &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk %s: %v", event.Data, err)
+		}
+		if chunk.Model != "gpt-4o" || chunk.ID != "msg_1" || chunk.Object != "chat.completion.chunk" {
+			t.Errorf("Unexpected chunk header %+v", chunk)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if chunks[0].Choices[0].Delta.Role != "assistant" {
+		t.Errorf("Expected first chunk to carry the assistant role, got %+v", chunks[0].Choices[0].Delta)
+	}
+	if content := chunks[1].Choices[0].Delta.Content; content == nil || *content != "Hello" {
+		t.Errorf("Expected text delta 'Hello', got %v", content)
+	}
+
+	toolCall := chunks[2].Choices[0].Delta.ToolCalls
+	if len(toolCall) != 1 || toolCall[0].ID != "toolu_1" || toolCall[0].Index == nil || *toolCall[0].Index != 0 {
+		t.Errorf("Expected tool call toolu_1 at index 0, got %+v", toolCall)
+	}
+	if args := chunks[3].Choices[0].Delta.ToolCalls; len(args) != 1 || args[0].Function.Arguments != `{"city":"Taipei"}` {
+		t.Errorf("Expected tool call arguments delta, got %+v", args)
+	}
+
+	finishReason := chunks[4].Choices[0].FinishReason
+	if finishReason == nil || *finishReason != "tool_calls" {
+		t.Errorf("Expected finish_reason tool_calls, got %v", finishReason)
+	}
+
+	usage := chunks[5].Usage
+	if usage == nil || usage.PromptTokens != 25 || usage.CompletionTokens != 15 || len(chunks[5].Choices) != 0 {
+		t.Errorf("Expected final usage chunk 25/15, got %+v", chunks[5])
+	}
+
+	if !events[len(events)-1].IsDone() {
+		t.Errorf("Expected stream to end with [DONE], got %s", events[len(events)-1].Data)
+	}
+}
+
+func TestMessagesToChatStreamWithoutUsage(t *testing.T) {
+	stream := "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+
+	events := convertStream(t, NewMessagesToChatStream("gpt-4o", false), stream)
+	if len(events) != 1 || !events[0].IsDone() {
+		t.Errorf("Expected only [DONE], got %d events", len(events))
+	}
+}
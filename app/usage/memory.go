@@ -0,0 +1,87 @@
+package usage
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryRetention bounds how long the memory store keeps records, enough to
+// cover a monthly budget window.
+const memoryRetention = 32 * 24 * time.Hour
+
+// MemoryStore keeps usage records in memory. Records are lost on restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Record(_ context.Context, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := record.Time.Add(-memoryRetention)
+	if len(s.records) > 0 && s.records[0].Time.Before(cutoff) {
+		index, _ := slices.BinarySearchFunc(s.records, cutoff, func(r Record, t time.Time) int {
+			return r.Time.Compare(t)
+		})
+		s.records = slices.Delete(s.records, 0, index)
+	}
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+type summaryKey struct {
+	client, model, upstreamModel, upstream string
+}
+
+func (s *MemoryStore) Summarize(_ context.Context, filter Filter) ([]Summary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := make(map[summaryKey]*Summary)
+	for _, record := range s.records {
+		if !filter.matches(record) {
+			continue
+		}
+
+		key := summaryKey{record.Client, record.Model, record.UpstreamModel, record.Upstream}
+		summary, ok := totals[key]
+		if !ok {
+			summary = &Summary{
+				Client:        record.Client,
+				Model:         record.Model,
+				UpstreamModel: record.UpstreamModel,
+				Upstream:      record.Upstream,
+			}
+			totals[key] = summary
+		}
+		summary.Requests++
+		summary.Usage = summary.Usage.Add(record.Usage)
+	}
+
+	summaries := make([]Summary, 0, len(totals))
+	for _, summary := range totals {
+		summaries = append(summaries, *summary)
+	}
+	slices.SortFunc(summaries, func(a, b Summary) int {
+		return cmp.Or(
+			cmp.Compare(a.Client, b.Client),
+			cmp.Compare(a.Model, b.Model),
+			cmp.Compare(a.UpstreamModel, b.UpstreamModel),
+			cmp.Compare(a.Upstream, b.Upstream),
+		)
+	})
+	return summaries, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
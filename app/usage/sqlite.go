@@ -0,0 +1,120 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS usage_records (
+	id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+	time               INTEGER NOT NULL,
+	client             TEXT    NOT NULL,
+	model              TEXT    NOT NULL,
+	upstream_model     TEXT    NOT NULL,
+	upstream           TEXT    NOT NULL,
+	input_tokens       INTEGER NOT NULL,
+	output_tokens      INTEGER NOT NULL,
+	cache_read_tokens  INTEGER NOT NULL,
+	cache_write_tokens INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS usage_records_time ON usage_records (time);
+`
+
+// SQLiteStore keeps usage records in a SQLite database file.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens or creates the database file at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage database %s: %w", path, err)
+	}
+
+	// SQLite serializes writers; a single connection avoids busy errors.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize usage database %s: %w", path, err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Record(ctx context.Context, record Record) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO usage_records (time, client, model, upstream_model, upstream,
+			input_tokens, output_tokens, cache_read_tokens, cache_write_tokens)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Time.UnixNano(), record.Client, record.Model, record.UpstreamModel, record.Upstream,
+		record.InputTokens, record.OutputTokens, record.CacheReadTokens, record.CacheWriteTokens,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Summarize(ctx context.Context, filter Filter) ([]Summary, error) {
+	var conditions []string
+	var args []any
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if filter.Client != "" {
+		conditions = append(conditions, "client = ?")
+		args = append(args, filter.Client)
+	}
+	if filter.Model != "" {
+		conditions = append(conditions, "model = ?")
+		args = append(args, filter.Model)
+	}
+
+	query := `
+		SELECT client, model, upstream_model, upstream, COUNT(*),
+			SUM(input_tokens), SUM(output_tokens), SUM(cache_read_tokens), SUM(cache_write_tokens)
+		FROM usage_records`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += `
+		GROUP BY client, model, upstream_model, upstream
+		ORDER BY client, model, upstream_model, upstream`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	summaries := []Summary{}
+	for rows.Next() {
+		var summary Summary
+		if err := rows.Scan(
+			&summary.Client, &summary.Model, &summary.UpstreamModel, &summary.Upstream, &summary.Requests,
+			&summary.InputTokens, &summary.OutputTokens, &summary.CacheReadTokens, &summary.CacheWriteTokens,
+		); err != nil {
+			return nil, fmt.Errorf("failed to read usage summary: %w", err)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,177 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// Usage is the token usage of one call. InputTokens excludes cached input,
+// which is counted in CacheReadTokens and CacheWriteTokens.
+type Usage struct {
+	InputTokens      int `json:"inputTokens"`
+	OutputTokens     int `json:"outputTokens"`
+	CacheReadTokens  int `json:"cacheReadTokens"`
+	CacheWriteTokens int `json:"cacheWriteTokens"`
+}
+
+// Total returns the number of tokens processed, cached or not.
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens + u.CacheReadTokens + u.CacheWriteTokens
+}
+
+// IsZero reports whether no usage was reported.
+func (u Usage) IsZero() bool {
+	return u == Usage{}
+}
+
+// Merge combines usage reported at several points of a stream. Counts are
+// cumulative, so the largest value of each field wins.
+func (u Usage) Merge(other Usage) Usage {
+	return Usage{
+		InputTokens:      max(u.InputTokens, other.InputTokens),
+		OutputTokens:     max(u.OutputTokens, other.OutputTokens),
+		CacheReadTokens:  max(u.CacheReadTokens, other.CacheReadTokens),
+		CacheWriteTokens: max(u.CacheWriteTokens, other.CacheWriteTokens),
+	}
+}
+
+// Cost returns the price of the usage in dollars.
+func (u Usage) Cost(price config.Price) float64 {
+	return (float64(u.InputTokens)*price.Input +
+		float64(u.OutputTokens)*price.Output +
+		float64(u.CacheReadTokens)*price.CacheRead +
+		float64(u.CacheWriteTokens)*price.CacheWrite) / 1_000_000
+}
+
+// Add returns the sum of two usages.
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		InputTokens:      u.InputTokens + other.InputTokens,
+		OutputTokens:     u.OutputTokens + other.OutputTokens,
+		CacheReadTokens:  u.CacheReadTokens + other.CacheReadTokens,
+		CacheWriteTokens: u.CacheWriteTokens + other.CacheWriteTokens,
+	}
+}
+
+type rawUsage struct {
+	// OpenAI
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+
+	// Anthropic
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+func (r rawUsage) normalize() Usage {
+	if r.PromptTokens > 0 || r.CompletionTokens > 0 {
+		u := Usage{
+			InputTokens:  r.PromptTokens,
+			OutputTokens: r.CompletionTokens,
+		}
+		if r.PromptTokensDetails != nil {
+			u.CacheReadTokens = r.PromptTokensDetails.CachedTokens
+			u.InputTokens -= r.PromptTokensDetails.CachedTokens
+		}
+		return u
+	}
+
+	return Usage{
+		InputTokens:      r.InputTokens,
+		OutputTokens:     r.OutputTokens,
+		CacheReadTokens:  r.CacheReadInputTokens,
+		CacheWriteTokens: r.CacheCreationInputTokens,
+	}
+}
+
+// Parse extracts token usage from an OpenAI or Anthropic response body or
+// stream event payload, including the message of an Anthropic message_start
+// event. It reports false when the payload carries no usage.
+func Parse(data []byte) (Usage, bool) {
+	var payload struct {
+		Usage   *rawUsage `json:"usage"`
+		Message *struct {
+			Usage *rawUsage `json:"usage"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Usage{}, false
+	}
+
+	switch {
+	case payload.Usage != nil:
+		return payload.Usage.normalize(), true
+	case payload.Message != nil && payload.Message.Usage != nil:
+		return payload.Message.Usage.normalize(), true
+	}
+	return Usage{}, false
+}
+
+// Record is the usage of one proxied call.
+type Record struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	Model         string    `json:"model"`
+	UpstreamModel string    `json:"upstreamModel"`
+	Upstream      string    `json:"upstream"`
+	Usage
+}
+
+// Filter selects records. Zero fields match everything; Until is exclusive.
+type Filter struct {
+	Since  time.Time
+	Until  time.Time
+	Client string
+	Model  string
+}
+
+func (f Filter) matches(record Record) bool {
+	return (f.Since.IsZero() || !record.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || record.Time.Before(f.Until)) &&
+		(f.Client == "" || record.Client == f.Client) &&
+		(f.Model == "" || record.Model == f.Model)
+}
+
+// Summary is the total usage of a client, model and upstream combination.
+type Summary struct {
+	Client        string `json:"client"`
+	Model         string `json:"model"`
+	UpstreamModel string `json:"upstreamModel"`
+	Upstream      string `json:"upstream"`
+	Requests      int    `json:"requests"`
+	Usage
+}
+
+// Store persists usage records.
+type Store interface {
+	Record(ctx context.Context, record Record) error
+	// Summarize returns usage totals grouped by client, model, upstream
+	// model and upstream, ordered by those fields.
+	Summarize(ctx context.Context, filter Filter) ([]Summary, error)
+	Close() error
+}
+
+// Open returns the usage store selected by the configuration, defaulting to
+// the memory store.
+func Open(cfg config.Usage) (Store, error) {
+	switch cfg.Store {
+	case "", config.UsageStoreMemory:
+		return NewMemoryStore(), nil
+	case config.UsageStoreSQLite:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("usage.path is required for the sqlite store")
+		}
+		return OpenSQLiteStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("invalid usage store: %s", cfg.Store)
+	}
+}
@@ -0,0 +1,111 @@
+package usage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected Usage
+		ok       bool
+	}{
+		{
+			name:     "openai response",
+			data:     `{"usage":{"prompt_tokens":100,"completion_tokens":20,"prompt_tokens_details":{"cached_tokens":30}}}`,
+			expected: Usage{InputTokens: 70, OutputTokens: 20, CacheReadTokens: 30},
+			ok:       true,
+		},
+		{
+			name:     "anthropic response",
+			data:     `{"usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":200,"cache_creation_input_tokens":50}}`,
+			expected: Usage{InputTokens: 10, OutputTokens: 5, CacheReadTokens: 200, CacheWriteTokens: 50},
+			ok:       true,
+		},
+		{
+			name:     "anthropic message_start",
+			data:     `{"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}`,
+			expected: Usage{InputTokens: 12, OutputTokens: 1},
+			ok:       true,
+		},
+		{
+			name: "chunk without usage",
+			data: `{"choices":[{"delta":{"content":"Hi"}}],"usage":null}`,
+		},
+		{
+			name: "invalid json",
+			data: `[DONE]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Parse([]byte(tt.data))
+			if ok != tt.ok {
+				t.Fatalf("Expected ok %v, got %v", tt.ok, ok)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStore_Summarize(t *testing.T) {
+	sqliteStore, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatalf("Failed to open sqlite store: %v", err)
+	}
+	defer func() {
+		_ = sqliteStore.Close()
+	}()
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": sqliteStore,
+	}
+
+	now := time.Now()
+	records := []Record{
+		{Time: now.Add(-2 * time.Hour), Client: "alice", Model: "claude", UpstreamModel: "claude-4", Upstream: "anthropic", Usage: Usage{InputTokens: 1, OutputTokens: 2}},
+		{Time: now.Add(-time.Hour), Client: "alice", Model: "claude", UpstreamModel: "claude-4", Upstream: "anthropic", Usage: Usage{InputTokens: 10, OutputTokens: 20, CacheReadTokens: 5}},
+		{Time: now, Client: "bob", Model: "gpt", UpstreamModel: "gpt-4o", Upstream: "openai", Usage: Usage{InputTokens: 100, CacheWriteTokens: 7}},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, record := range records {
+				if err := store.Record(ctx, record); err != nil {
+					t.Fatalf("Failed to record usage: %v", err)
+				}
+			}
+
+			summaries, err := store.Summarize(ctx, Filter{})
+			if err != nil {
+				t.Fatalf("Failed to summarize usage: %v", err)
+			}
+			if len(summaries) != 2 {
+				t.Fatalf("Expected 2 summaries, got %d", len(summaries))
+			}
+			if summaries[0].Client != "alice" || summaries[0].Requests != 2 || summaries[0].Usage != (Usage{InputTokens: 11, OutputTokens: 22, CacheReadTokens: 5}) {
+				t.Errorf("Unexpected summary for alice: %+v", summaries[0])
+			}
+			if summaries[1].Client != "bob" || summaries[1].Upstream != "openai" || summaries[1].CacheWriteTokens != 7 {
+				t.Errorf("Unexpected summary for bob: %+v", summaries[1])
+			}
+
+			summaries, err = store.Summarize(ctx, Filter{Since: now.Add(-90 * time.Minute), Client: "alice"})
+			if err != nil {
+				t.Fatalf("Failed to summarize usage: %v", err)
+			}
+			if len(summaries) != 1 || summaries[0].Requests != 1 || summaries[0].InputTokens != 10 {
+				t.Errorf("Expected only the recent alice record, got %+v", summaries)
+			}
+		})
+	}
+}
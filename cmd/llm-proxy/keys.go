@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// keys manages the client keys of the configuration file.
+func keys(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: llm-proxy keys create|revoke [flags]\n")
+		return 2
+	}
+
+	switch args[0] {
+	case "create":
+		return createKey(args[1:])
+	case "revoke":
+		return revokeKey(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown keys command %q\n", args[0])
+		return 2
+	}
+}
+
+// createKey adds a client with a newly generated key to the configuration
+// file and prints the key. A running proxy picks it up on its next reload.
+func createKey(args []string) int {
+	flags, configFile := newFlagSet("keys create")
+	name := flags.String("name", "", "name of the client (required)")
+	team := flags.String("team", "", "team whose budget the key counts against")
+	models := flags.String("models", "", "comma-separated local model names or patterns the key may use (default: all)")
+	_ = flags.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "--name is required")
+		return 2
+	}
+
+	client := config.Client{
+		Name: *name,
+		Key:  config.NewKey(),
+		Team: *team,
+	}
+	if *models != "" {
+		client.Models = strings.Split(*models, ",")
+	}
+
+	if err := editConfig(*configFile, func(editor *config.Editor) error {
+		return editor.AddEntry("clients", client)
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println(client.Key)
+	return 0
+}
+
+// revokeKey removes a client from the configuration file.
+func revokeKey(args []string) int {
+	flags, configFile := newFlagSet("keys revoke")
+	name := flags.String("name", "", "name of the client (required)")
+	_ = flags.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "--name is required")
+		return 2
+	}
+
+	if err := editConfig(*configFile, func(editor *config.Editor) error {
+		removed, err := editor.RemoveEntry("clients", *name)
+		if err == nil && !removed {
+			err = fmt.Errorf("no client named %q", *name)
+		}
+		return err
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("Revoked the key of %s\n", *name)
+	return 0
+}
+
+// editConfig applies edit to the configuration file and saves it, unless
+// the result is invalid.
+func editConfig(configFile string, edit func(editor *config.Editor) error) error {
+	path := configPath(configFile)
+	editor, err := config.Edit(path)
+	if err != nil {
+		return err
+	}
+	if err := edit(editor); err != nil {
+		return err
+	}
+
+	if _, err := editor.Save(); err != nil {
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) {
+			return fmt.Errorf("%s was not changed:\n%w", path, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -1,62 +1,72 @@
 package main
 
 import (
-	"context"
-	"log/slog"
+	"flag"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"strings"
 
-	"github.com/omegaatt36/llm-proxy/app/server"
 	"github.com/omegaatt36/llm-proxy/config"
 )
 
-func main() {
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, nil)))
+const configUsage = "path to the configuration file (default: search ./config.yaml, /etc/llm-proxy/config.yaml, ~/.llm-proxy/config.yaml)"
 
-	config, err := config.Load()
-	if err != nil {
-		slog.Error("Failed to load configuration", "error", err)
-		os.Exit(1)
-	}
+const usageText = `Usage: llm-proxy [command] [flags]
 
-	if config.LogLevel != "" {
-		var level slog.Level
-		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
-			slog.Error("Invalid log level", "level", config.LogLevel, "error", err)
-			os.Exit(1)
-		}
+Commands:
+  serve          run the proxy (default)
+  validate       check the configuration file
+  models         list the effective model mappings
+  keys create    add a client key to the configuration file
+  keys revoke    remove a client key from the configuration file
+  usage report   print recorded token usage and cost
+  version        print the version
 
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: level,
-		})))
-	}
+Every command accepts --config. Run "llm-proxy <command> -h" for its flags.
+`
 
-	slog.Debug("Configuration loaded", "config", config)
-	slog.Info("Model mappings", "mappings", config.ModelMappings)
+// commands are the subcommands by name. Each returns the exit code.
+var commands = map[string]func(args []string) int{
+	"serve":    serve,
+	"validate": validate,
+	"models":   models,
+	"keys":     keys,
+	"usage":    usageCommand,
+	"version":  printVersion,
+}
 
-	proxyServer, err := server.NewProxyServer(config, nil)
-	if err != nil {
-		slog.Error("Failed to create proxy server", "error", err)
-		os.Exit(1)
+func main() {
+	// Without a command, or with only flags, the proxy is served, as
+	// before subcommands existed.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	if err := proxyServer.Start(ctx); err != nil {
-		slog.Error("Failed to start proxy server", "error", err)
-		os.Exit(1)
+	if name == "help" {
+		fmt.Print(usageText)
+		return
 	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usageText)
+		os.Exit(2)
+	}
+	os.Exit(command(args))
+}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	sig := <-sigChan
-	slog.Info("Received signal, shutting down...", "signal", sig)
+// newFlagSet returns the flags of a command, including the --config flag
+// shared by all commands.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	return flags, flags.String("config", "", configUsage)
+}
 
-	// Cancel context to gracefully shutdown
-	cancel()
-	<-time.After(time.Second * 3)
+// configPath returns the --config value, or the first configuration file
+// found in the default locations.
+func configPath(configFile string) string {
+	if configFile != "" {
+		return configFile
+	}
+	return config.Path()
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// models prints the upstream and upstream model each mapped local model is
+// sent to, followed by its fallbacks.
+func models(args []string) int {
+	flags, configFile := newFlagSet("models")
+	_ = flags.Parse(args)
+
+	cfg, err := config.Load(configPath(*configFile))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	names := slices.Sorted(maps.Keys(cfg.ModelMappings))
+	for model := range cfg.Fallbacks {
+		if _, mapped := cfg.ModelMappings[model]; !mapped {
+			names = append(names, model)
+		}
+	}
+	slices.Sort(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LOCAL MODEL\tUPSTREAM\tUPSTREAM MODEL\tFALLBACKS")
+	for _, model := range names {
+		target, mapped := cfg.ModelMappings[model]
+		if !mapped {
+			target = model
+		}
+		upstream, upstreamModel := cfg.Route(target)
+
+		fallbacks := make([]string, 0, len(cfg.Fallbacks[model]))
+		for _, fallback := range cfg.Fallbacks[model] {
+			upstream, upstreamModel := cfg.Route(fallback)
+			fallbacks = append(fallbacks, upstream+"/"+upstreamModel)
+		}
+		if len(fallbacks) == 0 {
+			fallbacks = append(fallbacks, "-")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", model, upstream, upstreamModel, strings.Join(fallbacks, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if upstream, _ := cfg.Route(""); upstream != "" {
+		fmt.Printf("\nOther models are sent unchanged to %s.\n", upstream)
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/audit"
+	"github.com/omegaatt36/llm-proxy/app/redact"
+	"github.com/omegaatt36/llm-proxy/app/server"
+	"github.com/omegaatt36/llm-proxy/app/tracing"
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 2 * time.Second
+
+// serve runs the proxy until it receives SIGINT or SIGTERM, reloading the
+// configuration on SIGHUP and when the file changes.
+func serve(args []string) int {
+	var logLevel slog.LevelVar
+	redactor := redact.New()
+	slog.SetDefault(newLogger(config.LogFormatText, &logLevel, redactor))
+
+	flags, configFile := newFlagSet("serve")
+	_ = flags.Parse(args)
+	configPath := configPath(*configFile)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+
+	logLevel.Set(cfg.Level())
+	if cfg.LogFormat != "" {
+		slog.SetDefault(newLogger(cfg.LogFormat, &logLevel, redactor))
+	}
+	if err := redactor.Configure(cfg.Redaction); err != nil {
+		slog.Error("Failed to configure redaction", "error", err)
+		return 1
+	}
+
+	slog.Debug("Configuration loaded", "config", cfg)
+	slog.Info("Model mappings", "mappings", cfg.ModelMappings)
+
+	usageStore, err := usage.Open(cfg.Usage)
+	if err != nil {
+		slog.Error("Failed to open usage store", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := usageStore.Close(); err != nil {
+			slog.Error("Failed to close usage store", "error", err)
+		}
+	}()
+
+	opts := []server.Option{
+		server.WithUsageStore(usageStore),
+		server.WithConfigFile(configPath),
+		server.WithLogLevel(&logLevel),
+		server.WithRedactor(redactor),
+	}
+	if cfg.Tracing.Endpoint != "" {
+		exporter := tracing.NewOTLPExporter(cfg.Tracing, nil)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := exporter.Shutdown(ctx); err != nil {
+				slog.Error("Failed to flush spans", "error", err)
+			}
+		}()
+		opts = append(opts, server.WithTracer(tracing.NewTracer(exporter)))
+		slog.Info("Exporting traces", "endpoint", cfg.Tracing.Endpoint)
+	}
+
+	if cfg.Audit.Path != "" {
+		auditLog, err := audit.Open(cfg.Audit, redactor)
+		if err != nil {
+			slog.Error("Failed to open audit log", "error", err)
+			return 1
+		}
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				slog.Error("Failed to close audit log", "error", err)
+			}
+		}()
+		opts = append(opts, server.WithAuditLog(auditLog))
+		slog.Info("Writing audit log", "path", cfg.Audit.Path)
+	}
+
+	proxyServer, err := server.NewProxyServer(cfg, nil, opts...)
+	if err != nil {
+		slog.Error("Failed to create proxy server", "error", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := proxyServer.Start(ctx); err != nil {
+		slog.Error("Failed to start proxy server", "error", err)
+		return 1
+	}
+
+	reload := func() {
+		if err := proxyServer.ReloadFile(); err != nil {
+			slog.Error("Failed to reload configuration", "error", err)
+		}
+	}
+
+	if configPath != "" {
+		go config.Watch(ctx, configPath, configPollInterval, func() {
+			slog.Info("Configuration file changed, reloading", "path", configPath)
+			reload()
+		})
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			slog.Info("Received SIGHUP, reloading configuration")
+			reload()
+			continue
+		}
+
+		slog.Info("Received signal, shutting down...", "signal", sig)
+		break
+	}
+
+	// Cancel context to gracefully shutdown
+	cancel()
+	<-time.After(time.Second * 3)
+	return 0
+}
+
+// newLogger returns a logger writing text or JSON records to stdout, tagged
+// with the ID of the request being handled and redacted.
+func newLogger(format string, level *slog.LevelVar, redactor *redact.Redactor) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, options)
+	if format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+	return slog.New(redact.NewHandler(server.NewLogHandler(handler), redactor))
+}
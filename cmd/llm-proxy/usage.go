@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omegaatt36/llm-proxy/app/usage"
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// dateLayout is the format of the --since and --until dates.
+const dateLayout = "2006-01-02"
+
+// usageCommand reads the usage store of the configuration.
+func usageCommand(args []string) int {
+	if len(args) == 0 || args[0] != "report" {
+		fmt.Fprintf(os.Stderr, "usage: llm-proxy usage report [flags]\n")
+		return 2
+	}
+	return usageReport(args[1:])
+}
+
+// usageReport prints the recorded token usage and cost per client, model
+// and upstream.
+func usageReport(args []string) int {
+	flags, configFile := newFlagSet("usage report")
+	since := flags.String("since", "", "first day to include, as YYYY-MM-DD in UTC (default: the start of the current month)")
+	until := flags.String("until", "", "day to stop before, as YYYY-MM-DD in UTC (default: no end)")
+	client := flags.String("client", "", "only report this client")
+	model := flags.String("model", "", "only report this local model")
+	_ = flags.Parse(args)
+
+	cfg, err := config.Load(configPath(*configFile))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cfg.Usage.Store != config.UsageStoreSQLite {
+		fmt.Fprintln(os.Stderr, "usage is only kept in the proxy's memory; set usage.store to sqlite to report it")
+		return 1
+	}
+
+	now := time.Now().UTC()
+	filter := usage.Filter{
+		Since:  time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		Client: *client,
+		Model:  *model,
+	}
+	if *since != "" {
+		if filter.Since, err = time.Parse(dateLayout, *since); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --since: %v\n", err)
+			return 2
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.Parse(dateLayout, *until); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --until: %v\n", err)
+			return 2
+		}
+	}
+
+	store, err := usage.Open(cfg.Usage)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	summaries, err := store.Summarize(context.Background(), filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tMODEL\tUPSTREAM\tREQUESTS\tINPUT\tOUTPUT\tCACHE READ\tCACHE WRITE\tCOST")
+	var total usage.Summary
+	var totalCost float64
+	for _, s := range summaries {
+		cost := s.Cost(cfg.Price(s.UpstreamModel, s.Model))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t$%.4f\n",
+			s.Client, s.Model, s.Upstream+"/"+s.UpstreamModel, s.Requests,
+			s.InputTokens, s.OutputTokens, s.CacheReadTokens, s.CacheWriteTokens, cost)
+
+		total.Requests += s.Requests
+		total.Usage = total.Usage.Add(s.Usage)
+		totalCost += cost
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t%d\t%d\t%d\t%d\t%d\t$%.4f\n",
+		total.Requests, total.InputTokens, total.OutputTokens, total.CacheReadTokens, total.CacheWriteTokens, totalCost)
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
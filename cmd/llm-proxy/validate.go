@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/omegaatt36/llm-proxy/config"
+)
+
+// validate checks a configuration file, printing every problem with its
+// line, and returns the exit code: 1 for an invalid configuration.
+func validate(args []string) int {
+	flags, configFile := newFlagSet("validate")
+	_ = flags.Parse(args)
+	configPath := configPath(*configFile)
+
+	if _, err := config.Load(configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if configPath == "" {
+		configPath = "environment"
+	}
+	fmt.Printf("%s: configuration is valid\n", configPath)
+	return 0
+}
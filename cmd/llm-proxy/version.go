@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+// Otherwise the module version recorded by the Go toolchain is printed.
+var version = ""
+
+// printVersion prints the version and the Go version it was built with.
+func printVersion([]string) int {
+	v := version
+	if v == "" {
+		v = "dev"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+	}
+
+	fmt.Printf("llm-proxy %s %s\n", v, runtime.Version())
+	return 0
+}
@@ -1,43 +1,453 @@
 package config
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
+// Authentication styles used when sending the API key to an upstream.
+const (
+	AuthStyleBearer  = "bearer"
+	AuthStyleXAPIKey = "x-api-key"
+)
+
+// Protocols an upstream can speak. An upstream without a protocol accepts
+// both chat completions and messages requests as-is.
+const (
+	ProtocolOpenAI    = "openai"
+	ProtocolAnthropic = "anthropic"
+)
+
+// Endpoint selection strategies of a pooled upstream.
+const (
+	StrategyRoundRobin     = "round-robin"
+	StrategyLeastInFlight  = "least-in-flight"
+	StrategyLeastRecent429 = "least-recent-429"
+)
+
+// maskedPrefix replaces the hidden characters of masked secrets.
+const maskedPrefix = "****"
+
+// Usage stores.
+const (
+	UsageStoreMemory = "memory"
+	UsageStoreSQLite = "sqlite"
+)
+
+// Built-in redaction rules.
+const (
+	RedactAPIKeys     = "apiKey"
+	RedactEmails      = "email"
+	RedactCreditCards = "creditCard"
+	RedactJWTs        = "jwt"
+)
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Budget windows.
+const (
+	BudgetWindowDaily   = "daily"
+	BudgetWindowMonthly = "monthly"
+)
+
+// DefaultUpstreamName is the name given to the upstream configured through
+// the legacy upstreamURL/upstreamAPIKey fields.
+const DefaultUpstreamName = "default"
+
 type Config struct {
-	Port           string            `yaml:"port"`
-	UpstreamURL    string            `yaml:"upstreamURL"`
-	UpstreamAPIKey string            `yaml:"upstreamAPIKey"`
-	ModelMappings  map[string]string `yaml:"modelMappings"`
-	LogLevel       string            `yaml:"logLevel"`
+	Port            string               `yaml:"port"`
+	UpstreamURL     string               `yaml:"upstreamURL"`
+	UpstreamAPIKey  string               `yaml:"upstreamAPIKey"`
+	Upstreams       []Upstream           `yaml:"upstreams"`
+	ModelMappings   map[string]string    `yaml:"modelMappings"`
+	Fallbacks       map[string][]string  `yaml:"fallbacks"`
+	Clients         []Client             `yaml:"clients"`
+	ModelRateLimits map[string]RateLimit `yaml:"modelRateLimits"`
+	Teams           []Team               `yaml:"teams"`
+	Prices          map[string]Price     `yaml:"prices"`
+	Usage           Usage                `yaml:"usage"`
+	Tracing         Tracing              `yaml:"tracing"`
+	Retry           Retry                `yaml:"retry"`
+	CircuitBreaker  CircuitBreaker       `yaml:"circuitBreaker"`
+	Admin           Admin                `yaml:"admin"`
+	Audit           Audit                `yaml:"audit"`
+	Redaction       Redaction            `yaml:"redaction"`
+	LogLevel        string               `yaml:"logLevel"`
+	LogFormat       string               `yaml:"logFormat"`
+}
+
+// Upstream is a named LLM provider that model mappings can target with the
+// "upstream/model" syntax.
+type Upstream struct {
+	Name      string `yaml:"name"`
+	BaseURL   string `yaml:"baseURL"`
+	APIKey    string `yaml:"apiKey"`
+	AuthStyle string `yaml:"authStyle"`
+	Protocol  string `yaml:"protocol"`
+	// Endpoints pools several base URLs and keys for the upstream, used
+	// instead of BaseURL and APIKey, which fill in the fields an endpoint
+	// leaves empty.
+	Endpoints []Endpoint `yaml:"endpoints"`
+	// Strategy selects an endpoint for each call: round-robin (default),
+	// least-in-flight or least-recent-429.
+	Strategy string `yaml:"strategy"`
+	// BenchDuration is how long an endpoint answering 401 or 429 is left
+	// out of the pool, unless a 429 asks to retry later.
+	BenchDuration time.Duration `yaml:"benchDuration"`
+}
+
+// Endpoint is a base URL and key of a pooled upstream. Weight sets its
+// share of the calls, 1 by default.
+type Endpoint struct {
+	BaseURL string `yaml:"baseURL"`
+	APIKey  string `yaml:"apiKey"`
+	Weight  int    `yaml:"weight"`
+}
+
+// Client is a virtual API key that callers present to the proxy instead of
+// an upstream key. When no clients are configured, the proxy accepts every
+// request.
+type Client struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Models lists the local model names the key may use, as exact names
+	// or glob patterns such as "claude-*". An empty list allows every model.
+	Models    []string   `yaml:"models"`
+	RateLimit *RateLimit `yaml:"rateLimit"`
+	// Team names the team whose budget the key's spend also counts against.
+	Team   string  `yaml:"team"`
+	Budget *Budget `yaml:"budget"`
+}
+
+// Team groups client keys under a shared budget.
+type Team struct {
+	Name   string  `yaml:"name"`
+	Budget *Budget `yaml:"budget"`
+}
+
+// Budget is a dollar spend limit per daily or monthly window, in UTC. Crossing
+// the soft limit only warns; requests are refused once the hard limit is
+// reached. A zero limit is not enforced.
+type Budget struct {
+	Window    string  `yaml:"window"`
+	SoftLimit float64 `yaml:"softLimit"`
+	HardLimit float64 `yaml:"hardLimit"`
+}
+
+// Price is the cost of a model in dollars per million tokens.
+type Price struct {
+	Input      float64 `yaml:"input"`
+	Output     float64 `yaml:"output"`
+	CacheRead  float64 `yaml:"cacheRead"`
+	CacheWrite float64 `yaml:"cacheWrite"`
+}
+
+// RateLimit is a token-bucket limit. A zero value leaves the corresponding
+// dimension unlimited.
+type RateLimit struct {
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	TokensPerMinute   int `yaml:"tokensPerMinute"`
+}
+
+// Usage selects where token usage records are kept.
+type Usage struct {
+	Store string `yaml:"store"`
+	Path  string `yaml:"path"`
+}
+
+// Tracing exports spans to an OpenTelemetry collector over OTLP/HTTP. It is
+// disabled without an endpoint.
+type Tracing struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, such as
+	// "http://localhost:4318". Spans are posted to its /v1/traces path.
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"serviceName"`
+}
+
+// Retry re-sends upstream calls answered with 429, 502, 503 or 529, or
+// dropped by a connection reset. Retries are disabled when MaxRetries is
+// zero.
+type Retry struct {
+	MaxRetries     int           `yaml:"maxRetries"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+// CircuitBreaker stops sending requests to an upstream once the share of
+// failed calls within a window reaches FailureRate, until a probe call
+// succeeds after CoolDown. It is disabled when FailureRate is zero.
+type CircuitBreaker struct {
+	FailureRate float64       `yaml:"failureRate"`
+	MinRequests int           `yaml:"minRequests"`
+	Window      time.Duration `yaml:"window"`
+	CoolDown    time.Duration `yaml:"coolDown"`
+}
+
+// Admin serves the /admin API on a port of its own, separate from the proxied
+// endpoints. It is disabled without a port.
+type Admin struct {
+	Port string `yaml:"port"`
+	// Token is the bearer token admin requests must present.
+	Token string `yaml:"token"`
+	// DashboardToken is a read-only token, accepted by /admin/stats only.
+	DashboardToken string `yaml:"dashboardToken"`
+}
+
+// Audit writes a JSON line per completion call, with its request and
+// response, to a file rotated by size. It is disabled without a path.
+type Audit struct {
+	Path string `yaml:"path"`
+	// SampleRate is the share of calls recorded, between 0 and 1. Every
+	// call is recorded when it is zero.
+	SampleRate float64 `yaml:"sampleRate"`
+	// MaxBodySize bounds the bytes kept of each request and response body.
+	MaxBodySize int `yaml:"maxBodySize"`
+	// MaxFileSize is the size in bytes at which the file is rotated, and
+	// MaxFiles the number of rotated files kept.
+	MaxFileSize int64 `yaml:"maxFileSize"`
+	MaxFiles    int   `yaml:"maxFiles"`
+}
+
+// Redaction masks secrets and personal data in log records and audit
+// records. The built-in rules cover API keys and bearer tokens, email
+// addresses, credit card numbers and JWTs.
+type Redaction struct {
+	// Patterns are regular expressions whose matches are redacted as well.
+	Patterns []string `yaml:"patterns"`
+	// Disable lists built-in rules that are not applied.
+	Disable []string `yaml:"disable"`
+}
+
+// AllUpstreams returns the configured upstreams, with the legacy
+// upstreamURL entry first when it is set. The first upstream receives
+// requests for models that are not mapped to a named upstream.
+func (c *Config) AllUpstreams() []Upstream {
+	upstreams := make([]Upstream, 0, len(c.Upstreams)+1)
+	if c.UpstreamURL != "" {
+		upstreams = append(upstreams, Upstream{
+			Name:    DefaultUpstreamName,
+			BaseURL: c.UpstreamURL,
+			APIKey:  c.UpstreamAPIKey,
+		})
+	}
+
+	return append(upstreams, c.Upstreams...)
+}
+
+// Route resolves a modelMappings or fallbacks value to the upstream and
+// model it targets: "upstream/model" for a configured upstream, or a bare
+// model name served by the first upstream.
+func (c *Config) Route(target string) (upstream, model string) {
+	upstreams := c.AllUpstreams()
+	if name, upstreamModel, found := strings.Cut(target, "/"); found {
+		for _, u := range upstreams {
+			if u.Name == name {
+				return name, upstreamModel
+			}
+		}
+	}
+
+	if len(upstreams) > 0 {
+		upstream = upstreams[0].Name
+	}
+	return upstream, target
+}
+
+// Price returns the price of a call, looked up by upstream model name first
+// and local model name second. Unpriced models cost nothing.
+func (c *Config) Price(upstreamModel, model string) Price {
+	if price, ok := c.Prices[upstreamModel]; ok {
+		return price
+	}
+	return c.Prices[model]
+}
+
+// NewKey returns a random client key.
+func NewKey() string {
+	return "sk-proxy-" + rand.Text()
 }
 
-func Load() (*Config, error) {
+// Level returns the slog level named by LogLevel, info when it is empty or
+// invalid.
+func (c *Config) Level() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// LogValue logs the configuration with its keys and tokens masked.
+func (c *Config) LogValue() slog.Value {
+	masked := *c
+	masked.UpstreamAPIKey = MaskSecret(c.UpstreamAPIKey)
+	masked.Upstreams = slices.Clone(c.Upstreams)
+	for i := range masked.Upstreams {
+		u := &masked.Upstreams[i]
+		u.APIKey = MaskSecret(u.APIKey)
+		u.Endpoints = slices.Clone(u.Endpoints)
+		for j := range u.Endpoints {
+			u.Endpoints[j].APIKey = MaskSecret(u.Endpoints[j].APIKey)
+		}
+	}
+	masked.Clients = slices.Clone(c.Clients)
+	for i := range masked.Clients {
+		masked.Clients[i].Key = MaskSecret(masked.Clients[i].Key)
+	}
+	masked.Tracing.Headers = maps.Clone(c.Tracing.Headers)
+	for name, value := range masked.Tracing.Headers {
+		masked.Tracing.Headers[name] = MaskSecret(value)
+	}
+	masked.Admin.Token = MaskSecret(c.Admin.Token)
+	masked.Admin.DashboardToken = MaskSecret(c.Admin.DashboardToken)
+
+	// A type without LogValue, so that the copy is logged as is.
+	type config Config
+	return slog.AnyValue(config(masked))
+}
+
+// MaskSecret hides all but the last four characters of a secret, and all of
+// a secret too short to show any.
+func MaskSecret(secret string) string {
+	if len(secret) <= 8 {
+		if secret == "" {
+			return ""
+		}
+		return maskedPrefix
+	}
+	return maskedPrefix + secret[len(secret)-4:]
+}
+
+// Path returns the first configuration file found in the default
+// locations, or an empty string when there is none.
+func Path() string {
 	configPaths := []string{
 		"./config.yaml",
 		"/etc/llm-proxy/config.yaml",
 		os.Getenv("HOME") + "/.llm-proxy/config.yaml",
 	}
 
+	for _, path := range configPaths {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// Load reads the configuration file at path, or only the environment when
+// path is empty. ${NAME} references in string values are replaced with
+// environment variables, and LLM_PROXY_* environment variables override
+// the fields they name. Unknown fields and invalid values are reported as
+// a *ValidationError with the lines they appear on.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		return parse("", nil)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("config file %s does not exist", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	return parse(path, data)
+}
+
+// parse decodes, completes from the environment and validates the
+// configuration read from path.
+func parse(path string, data []byte) (*Config, error) {
 	var config = Config{
 		Port: "4000",
 	}
 
-	for _, path := range configPaths {
-		if data, err := os.ReadFile(path); err == nil {
-			if err := yaml.Unmarshal(data, &config); err != nil {
-				return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
-			}
-			break
+	if path != "" {
+		if err := yaml.UnmarshalWithOptions(data, &config, yaml.Strict()); err != nil {
+			return nil, decodeError(path, err)
 		}
 	}
 
-	if config.UpstreamURL == "" {
-		return nil, fmt.Errorf("upstream_url is required")
+	if err := interpolate(reflect.ValueOf(&config).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(reflect.ValueOf(&config).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		var validationErr *ValidationError
+		if path != "" && errors.As(err, &validationErr) {
+			validationErr.locate(path, data)
+		}
+		return nil, err
 	}
 
 	return &config, nil
 }
+
+// decodeError reports a YAML syntax error or unknown field with its line,
+// suggesting the intended field for misspelled ones such as upstream_url.
+func decodeError(path string, err error) error {
+	var yamlErr yaml.Error
+	if !errors.As(err, &yamlErr) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	fieldErr := &FieldError{Message: yamlErr.GetMessage()}
+	if tk := yamlErr.GetToken(); tk != nil {
+		fieldErr.Line = tk.Position.Line
+
+		var unknownErr *yaml.UnknownFieldError
+		if errors.As(err, &unknownErr) {
+			if suggestion, ok := fieldSuggestion(tk.Value); ok {
+				fieldErr.Message += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+		}
+	}
+	return &ValidationError{File: path, Errors: []*FieldError{fieldErr}}
+}
+
+// fieldSuggestion returns the configuration field a misspelled one most
+// likely means, comparing names without case, "_" and "-".
+func fieldSuggestion(name string) (string, bool) {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(s))
+	}
+
+	want := normalize(name)
+	var found string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map:
+			walk(t.Elem())
+		case reflect.Struct:
+			for i := range t.NumField() {
+				field := t.Field(i)
+				if key := yamlName(field); found == "" && normalize(key) == want {
+					found = key
+				}
+				walk(field.Type)
+			}
+		}
+	}
+	walk(reflect.TypeFor[Config]())
+	return found, found != ""
+}
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_Environment(t *testing.T) {
+	path := writeConfig(t, `
+upstreamURL: "https://api.example.com"
+upstreamAPIKey: "${TEST_UPSTREAM_KEY}"
+upstreams:
+  - name: my-provider
+    baseURL: "https://${TEST_HOST}/v1"
+clients:
+  - name: alice
+    key: "sk-proxy-alice"
+modelMappings:
+  gpt-fast: "${TEST_MODEL}"
+retry:
+  maxRetries: 1
+`)
+
+	t.Setenv("TEST_UPSTREAM_KEY", "sk-from-env")
+	t.Setenv("TEST_HOST", "llm.example.com")
+	t.Setenv("TEST_MODEL", "gpt-4o-mini")
+	t.Setenv("LLM_PROXY_PORT", "8080")
+	t.Setenv("LLM_PROXY_RETRY_MAX_RETRIES", "3")
+	t.Setenv("LLM_PROXY_RETRY_MAX_BACKOFF", "10s")
+	t.Setenv("LLM_PROXY_UPSTREAMS_MY_PROVIDER_API_KEY", "sk-provider")
+	t.Setenv("LLM_PROXY_CLIENTS_ALICE_BUDGET_HARD_LIMIT", "25")
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.UpstreamAPIKey != "sk-from-env" {
+		t.Errorf("Expected interpolated upstream key, got %q", config.UpstreamAPIKey)
+	}
+	if config.Upstreams[0].BaseURL != "https://llm.example.com/v1" {
+		t.Errorf("Expected interpolated base URL, got %q", config.Upstreams[0].BaseURL)
+	}
+	if config.ModelMappings["gpt-fast"] != "gpt-4o-mini" {
+		t.Errorf("Expected interpolated mapping, got %q", config.ModelMappings["gpt-fast"])
+	}
+	if config.Port != "8080" {
+		t.Errorf("Expected port override 8080, got %q", config.Port)
+	}
+	if config.Retry.MaxRetries != 3 || config.Retry.MaxBackoff != 10*time.Second {
+		t.Errorf("Expected retry overrides, got %+v", config.Retry)
+	}
+	if config.Upstreams[0].APIKey != "sk-provider" {
+		t.Errorf("Expected upstream key override, got %q", config.Upstreams[0].APIKey)
+	}
+	if config.Clients[0].Budget == nil || config.Clients[0].Budget.HardLimit != 25 {
+		t.Errorf("Expected client budget override, got %+v", config.Clients[0].Budget)
+	}
+	if config.Clients[0].RateLimit != nil {
+		t.Errorf("Expected unset rate limit to stay nil, got %+v", config.Clients[0].RateLimit)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     func(t *testing.T) string
+		env      map[string]string
+		expected string
+	}{
+		{
+			name:     "missing explicit file",
+			path:     func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing.yaml") },
+			expected: "does not exist",
+		},
+		{
+			name: "unset reference",
+			path: func(t *testing.T) string {
+				return writeConfig(t, `upstreamURL: "https://api.example.com"
+upstreamAPIKey: "${TEST_UNSET_KEY}"`)
+			},
+			expected: "environment variable TEST_UNSET_KEY referenced by upstreamAPIKey is not set",
+		},
+		{
+			name:     "invalid override",
+			path:     func(t *testing.T) string { return writeConfig(t, `upstreamURL: "https://api.example.com"`) },
+			env:      map[string]string{"LLM_PROXY_RETRY_MAX_RETRIES": "many"},
+			expected: "invalid LLM_PROXY_RETRY_MAX_RETRIES",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := Load(tt.path(t))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoad_EnvironmentOnly(t *testing.T) {
+	t.Setenv("LLM_PROXY_UPSTREAM_URL", "https://api.example.com")
+
+	config, err := Load("")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config.UpstreamURL != "https://api.example.com" || config.Port != "4000" {
+		t.Errorf("Expected upstream from the environment and default port, got %q and %q", config.UpstreamURL, config.Port)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"upstreamAPIKey": "UPSTREAM_API_KEY",
+		"upstreamURL":    "UPSTREAM_URL",
+		"baseURL":        "BASE_URL",
+		"maxRetries":     "MAX_RETRIES",
+		"my-provider":    "MY_PROVIDER",
+		"logLevel":       "LOG_LEVEL",
+	}
+
+	for name, expected := range tests {
+		if got := envName(name); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, name, got)
+		}
+	}
+}
+
+func TestLoad_Validation(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name: "unknown field",
+			content: `port: "4000"
+upstream_url: "https://api.example.com"
+`,
+			expected: []string{`config.yaml:2: unknown field "upstream_url", did you mean "upstreamURL"?`},
+		},
+		{
+			name: "semantic errors",
+			content: `upstreamURL: "ftp://api.example.com"
+upstreams:
+  - name: openai
+    baseURL: "https://api.openai.com"
+    strategy: random
+  - name: openai
+    baseURL: "https://api.openai.com"
+modelMappings:
+  a: b
+  b: c
+  c: a
+  claude.sonnet: "openai/claude"
+fallbacks:
+  claude.sonnet:
+    - "openai/claude"
+    - "default/claude"
+    - ""
+clients:
+  - name: alice
+    key: "sk-proxy"
+    team: research
+    budget:
+      window: weekly
+logLevel: verbose
+logFormat: xml
+admin:
+  port: "4000"
+audit:
+  sampleRate: 5
+redaction:
+  patterns:
+    - "("
+  disable: [phone]
+`,
+			expected: []string{
+				`config.yaml:1: upstreamURL: URL scheme must be http or https, got "ftp://api.example.com"`,
+				`config.yaml:5: upstreams[0].strategy: must be one of round-robin, least-in-flight, least-recent-429, got "random"`,
+				`config.yaml:6: upstreams[1].name: duplicate upstream name "openai"`,
+				`config.yaml:9: modelMappings.a: mapping cycle a -> b -> c -> a`,
+				`config.yaml:15: fallbacks.claude.sonnet[0]: unreachable: openai/claude is already tried before`,
+				`config.yaml:17: fallbacks.claude.sonnet[2]: must not be empty`,
+				`config.yaml:21: clients[0].team: unknown team "research"`,
+				`config.yaml:23: clients[0].budget.window: must be one of daily, monthly, got "weekly"`,
+				`config.yaml:27: admin.port: must differ from port 4000`,
+				`config.yaml:27: admin.token: is required with an admin port`,
+				`config.yaml:29: audit.sampleRate: must be between 0 and 1, got 5`,
+				"config.yaml:32: redaction.patterns[0]: invalid regular expression: error parsing regexp: missing closing ): `(`",
+				`config.yaml:33: redaction.disable[0]: must be one of apiKey, email, creditCard, jwt, got "phone"`,
+				`config.yaml:24: logLevel: must be debug, info, warn or error, got "verbose"`,
+				`config.yaml:25: logFormat: must be one of text, json, got "xml"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.content)
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("Expected validation error")
+			}
+
+			expected := strings.ReplaceAll(strings.Join(tt.expected, "\n"), "config.yaml", path)
+			if err.Error() != expected {
+				t.Errorf("Expected errors:\n%s\ngot:\n%s", expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestConfig_LogValue(t *testing.T) {
+	config := &Config{
+		UpstreamURL:    "https://api.example.com",
+		UpstreamAPIKey: "sk-upstream-secret",
+		Upstreams: []Upstream{{
+			Name:      "anthropic",
+			APIKey:    "sk-ant-secret",
+			Endpoints: []Endpoint{{BaseURL: "https://api.anthropic.com", APIKey: "sk-ant-endpoint"}},
+		}},
+		Clients: []Client{{Name: "alice", Key: "sk-proxy-alice"}},
+		Tracing: Tracing{Headers: map[string]string{"Authorization": "Bearer collector-token"}},
+		Admin:   Admin{Token: "admin-token", DashboardToken: "short"},
+	}
+
+	var buf strings.Builder
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("Configuration loaded", "config", config)
+
+	for _, secret := range []string{"sk-upstream-secret", "sk-ant-secret", "sk-ant-endpoint", "sk-proxy-alice", "collector-token", "admin-token", "short"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("Expected %s to be masked, got %s", secret, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "****cret") || !strings.Contains(buf.String(), "https://api.example.com") {
+		t.Errorf("Expected masked keys and other fields to be logged, got %s", buf.String())
+	}
+	if config.UpstreamAPIKey != "sk-upstream-secret" || config.Upstreams[0].Endpoints[0].APIKey != "sk-ant-endpoint" ||
+		config.Clients[0].Key != "sk-proxy-alice" || config.Tracing.Headers["Authorization"] != "Bearer collector-token" {
+		t.Errorf("Expected the configuration to be left unchanged, got %+v", config)
+	}
+}
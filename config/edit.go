@@ -0,0 +1,266 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// Editor changes entries of a configuration file while keeping its
+// comments, order and formatting.
+type Editor struct {
+	path string
+	file *ast.File
+}
+
+// Edit opens the configuration file at path for editing.
+func Edit(path string) (*Editor, error) {
+	if path == "" {
+		return nil, errors.New("no configuration file to edit; the configuration comes from the environment")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	file, err := parser.ParseBytes(data, parser.ParseComments)
+	if err != nil {
+		return nil, decodeError(path, err)
+	}
+	if len(file.Docs) == 0 || file.Docs[0].Body == nil {
+		return nil, fmt.Errorf("config file %s is empty", path)
+	}
+	return &Editor{path: path, file: file}, nil
+}
+
+// AddEntry appends entry to the list of named entries in section, such as
+// clients, creating the section when the file has none.
+func (e *Editor) AddEntry(section string, entry any) error {
+	if err := e.merge(section, []any{entry}); err != nil {
+		return err
+	}
+	return e.reparse()
+}
+
+// Entry decodes the entry named name in the list in section into v, as
+// written in the file, before ${NAME} references are replaced. It reports
+// false when there is no such entry.
+func (e *Editor) Entry(section, name string, v any) (bool, error) {
+	list, i, err := e.findEntry(section, name)
+	if err != nil || i < 0 {
+		return false, err
+	}
+	return true, yaml.NodeToValue(list.Values[i], v)
+}
+
+// SetEntry replaces the entry named name in the list in section, keeping
+// its position, or appends entry when there is none.
+func (e *Editor) SetEntry(section, name string, entry any) error {
+	_, i, err := e.findEntry(section, name)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return e.AddEntry(section, entry)
+	}
+
+	node, err := valueToNode(entry)
+	if err != nil {
+		return err
+	}
+	if err := (&yaml.PathBuilder{}).Root().Child(section).Index(uint(i)).Build().ReplaceWithNode(e.file, node); err != nil {
+		return err
+	}
+	return e.reparse()
+}
+
+// RemoveEntry removes the entry named name from the list in section. It
+// reports false when there is no such entry.
+func (e *Editor) RemoveEntry(section, name string) (bool, error) {
+	list, i, err := e.findEntry(section, name)
+	if err != nil || i < 0 {
+		return false, err
+	}
+	list.Values = append(list.Values[:i], list.Values[i+1:]...)
+	if len(list.Values) == 0 {
+		return true, e.removeSection(section)
+	}
+	return true, nil
+}
+
+// SetValue sets key to value in the map in section, such as modelMappings,
+// creating the section when the file has none.
+func (e *Editor) SetValue(section, key string, value any) error {
+	if err := e.merge(section, map[string]any{key: value}); err != nil {
+		return err
+	}
+	return e.reparse()
+}
+
+// RemoveValue removes key from the map in section. It reports false when
+// the key is not set.
+func (e *Editor) RemoveValue(section, key string) (bool, error) {
+	node, err := e.section(section)
+	if node == nil || err != nil {
+		return false, err
+	}
+	m, ok := node.(*ast.MappingNode)
+	if !ok {
+		return false, fmt.Errorf("%s is not a map", section)
+	}
+
+	for i, value := range m.Values {
+		var name string
+		if err := yaml.NodeToValue(value.Key, &name); err != nil {
+			return false, err
+		}
+		if name == key {
+			m.Values = append(m.Values[:i], m.Values[i+1:]...)
+			if len(m.Values) == 0 {
+				return true, e.removeSection(section)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Save validates the edited configuration and writes it back to the file,
+// replacing it at once so that a reload never sees a partial write. It
+// returns the new configuration, or a *ValidationError leaving the file
+// untouched.
+func (e *Editor) Save() (*Config, error) {
+	data := []byte(e.file.String())
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	cfg, err := parse(e.path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(e.path), "."+filepath.Base(e.path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write config file %s: %w", e.path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write config file %s: %w", e.path, err)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write config file %s: %w", e.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write config file %s: %w", e.path, err)
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return nil, fmt.Errorf("failed to write config file %s: %w", e.path, err)
+	}
+	return cfg, nil
+}
+
+// section returns the node of a top-level section, or nil when the file
+// does not have it.
+func (e *Editor) section(name string) (ast.Node, error) {
+	node, err := (&yaml.PathBuilder{}).Root().Child(name).Build().FilterFile(e.file)
+	if yaml.IsNotFoundNodeError(err) {
+		return nil, nil
+	}
+	return node, err
+}
+
+// merge adds the entries of value, a list or map, to a section, replacing
+// map values with the same key. A missing or empty section is added at the
+// end of the file.
+func (e *Editor) merge(section string, value any) error {
+	existing, err := e.section(section)
+	if err != nil {
+		return err
+	}
+
+	p := (&yaml.PathBuilder{}).Root().Child(section).Build()
+	if existing == nil || existing.Type() == ast.NullType {
+		if err := e.removeSection(section); err != nil {
+			return err
+		}
+		value = map[string]any{section: value}
+		p = (&yaml.PathBuilder{}).Root().Build()
+	}
+
+	node, err := valueToNode(value)
+	if err != nil {
+		return err
+	}
+	return p.MergeFromNode(e.file, node)
+}
+
+// reparse parses the edited file again. Nodes built from values do not
+// decode like parsed ones, so entries are looked up in a parsed tree.
+func (e *Editor) reparse() error {
+	file, err := parser.ParseBytes([]byte(e.file.String()), parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	return nil
+}
+
+// removeSection removes a top-level section from the file, if present.
+func (e *Editor) removeSection(name string) error {
+	root, ok := e.file.Docs[0].Body.(*ast.MappingNode)
+	if !ok {
+		return fmt.Errorf("config file %s is not a map", e.path)
+	}
+	for i, value := range root.Values {
+		if value.Key.String() == name {
+			root.Values = append(root.Values[:i], root.Values[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// findEntry returns the list of a section and the index of the entry named
+// name in it, or -1 when there is none.
+func (e *Editor) findEntry(section, name string) (*ast.SequenceNode, int, error) {
+	node, err := e.section(section)
+	if node == nil || err != nil || node.Type() == ast.NullType {
+		return nil, -1, err
+	}
+	list, ok := node.(*ast.SequenceNode)
+	if !ok {
+		return nil, -1, fmt.Errorf("%s is not a list", section)
+	}
+
+	for i, value := range list.Values {
+		var entry struct {
+			Name string `yaml:"name"`
+		}
+		if err := yaml.NodeToValue(value, &entry); err != nil {
+			return nil, -1, err
+		}
+		if entry.Name == name {
+			return list, i, nil
+		}
+	}
+	return list, -1, nil
+}
+
+// valueToNode encodes a value in the block style of the example
+// configuration, leaving out empty fields.
+func valueToNode(v any) (ast.Node, error) {
+	return yaml.ValueToNode(v, yaml.OmitEmpty(), yaml.IndentSequence(true))
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEditor(t *testing.T) {
+	path := writeConfig(t, `# Proxy settings
+upstreamURL: "https://api.example.com" # default upstream
+
+# Virtual keys
+clients:
+  - name: alice
+    key: "sk-proxy-alice"
+  - name: bob
+    key: "sk-proxy-bob"
+`)
+
+	editor, err := Edit(path)
+	if err != nil {
+		t.Fatalf("Failed to edit config: %v", err)
+	}
+	if err := editor.AddEntry("clients", Client{Name: "carol", Key: "sk-proxy-carol", Models: []string{"gpt-*"}}); err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	if removed, err := editor.RemoveEntry("clients", "alice"); err != nil || !removed {
+		t.Fatalf("Expected alice to be removed, got %v, %v", removed, err)
+	}
+	if removed, _ := editor.RemoveEntry("clients", "dave"); removed {
+		t.Error("Expected no client named dave")
+	}
+	if err := editor.AddEntry("teams", Team{Name: "research"}); err != nil {
+		t.Fatalf("Failed to add team: %v", err)
+	}
+
+	config, err := editor.Save()
+	if err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if len(config.Clients) != 2 || config.Clients[0].Name != "bob" || config.Clients[1].Name != "carol" {
+		t.Errorf("Expected clients bob and carol, got %+v", config.Clients)
+	}
+	if len(config.Teams) != 1 || config.Teams[0].Name != "research" {
+		t.Errorf("Expected team research, got %+v", config.Teams)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	for _, expected := range []string{"# Proxy settings", "# default upstream", "# Virtual keys", "- gpt-*"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected saved file to contain %q, got:\n%s", expected, data)
+		}
+	}
+	if strings.Contains(string(data), "budget") {
+		t.Errorf("Expected empty fields to be omitted, got:\n%s", data)
+	}
+
+	// An edit leaving the configuration invalid is not saved.
+	if err := editor.AddEntry("clients", Client{Name: "bob", Key: "sk-proxy-bob2"}); err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	if _, err := editor.Save(); err == nil || !strings.Contains(err.Error(), `duplicate client name "bob"`) {
+		t.Errorf("Expected duplicate client error, got %v", err)
+	}
+	if unchanged, _ := os.ReadFile(path); string(unchanged) != string(data) {
+		t.Errorf("Expected invalid edit to leave the file unchanged, got:\n%s", unchanged)
+	}
+}
+
+func TestEditor_Maps(t *testing.T) {
+	path := writeConfig(t, `upstreamURL: "https://api.example.com"
+upstreams:
+  - name: anthropic
+    baseURL: "https://api.anthropic.com"
+    apiKey: "${TEST_ANTHROPIC_KEY}"
+  - name: openai
+    baseURL: "https://api.openai.com"
+modelMappings:
+  gpt-fast: gpt-4o-mini
+`)
+	t.Setenv("TEST_ANTHROPIC_KEY", "sk-ant")
+
+	editor, err := Edit(path)
+	if err != nil {
+		t.Fatalf("Failed to edit config: %v", err)
+	}
+
+	var written Upstream
+	if found, err := editor.Entry("upstreams", "anthropic", &written); err != nil || !found {
+		t.Fatalf("Expected the anthropic upstream, got %v, %v", found, err)
+	}
+	if written.APIKey != "${TEST_ANTHROPIC_KEY}" {
+		t.Errorf("Expected the key as written, got %q", written.APIKey)
+	}
+
+	written.BaseURL = "https://eu.anthropic.com"
+	if err := editor.SetEntry("upstreams", "anthropic", written); err != nil {
+		t.Fatalf("Failed to set upstream: %v", err)
+	}
+	if err := editor.SetValue("modelMappings", "gpt-fast", "openai/gpt-4.1-mini"); err != nil {
+		t.Fatalf("Failed to set mapping: %v", err)
+	}
+	if err := editor.SetValue("fallbacks", "gpt-fast", []string{"anthropic/claude-haiku"}); err != nil {
+		t.Fatalf("Failed to set fallbacks: %v", err)
+	}
+	if removed, err := editor.RemoveValue("modelMappings", "claude"); err != nil || removed {
+		t.Errorf("Expected no mapping for claude, got %v, %v", removed, err)
+	}
+
+	config, err := editor.Save()
+	if err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if config.Upstreams[0].Name != "anthropic" || config.Upstreams[0].BaseURL != "https://eu.anthropic.com" || config.Upstreams[0].APIKey != "sk-ant" {
+		t.Errorf("Expected the anthropic upstream changed in place, got %+v", config.Upstreams)
+	}
+	if config.ModelMappings["gpt-fast"] != "openai/gpt-4.1-mini" || len(config.Fallbacks["gpt-fast"]) != 1 {
+		t.Errorf("Expected the mapping and fallbacks set, got %v and %v", config.ModelMappings, config.Fallbacks)
+	}
+
+	if removed, err := editor.RemoveValue("modelMappings", "gpt-fast"); err != nil || !removed {
+		t.Fatalf("Expected gpt-fast to be removed, got %v, %v", removed, err)
+	}
+	if config, err = editor.Save(); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if len(config.ModelMappings) != 0 {
+		t.Errorf("Expected no mappings, got %v", config.ModelMappings)
+	}
+}
+
+func TestConfig_Route(t *testing.T) {
+	config := &Config{
+		UpstreamURL: "https://api.example.com",
+		Upstreams:   []Upstream{{Name: "anthropic", BaseURL: "https://api.anthropic.com"}},
+	}
+
+	tests := map[string][2]string{
+		"anthropic/claude-sonnet-4": {"anthropic", "claude-sonnet-4"},
+		"gpt-4o":                    {"default", "gpt-4o"},
+		"meta/llama-3":              {"default", "meta/llama-3"},
+	}
+	for target, expected := range tests {
+		if upstream, model := config.Route(target); upstream != expected[0] || model != expected[1] {
+			t.Errorf("Expected %s to route to %v, got %s/%s", target, expected, upstream, model)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// envPrefix prefixes the environment variables overriding configuration
+// fields.
+const envPrefix = "LLM_PROXY"
+
+// envReference matches ${NAME} references to environment variables.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// interpolate replaces ${NAME} references in every string value of the
+// configuration with the value of the environment variable NAME. References
+// to unset variables are an error, so that a missing secret is not silently
+// sent as an empty key.
+func interpolate(v reflect.Value, field string) error {
+	switch v.Kind() {
+	case reflect.String:
+		var missing string
+		expanded := envReference.ReplaceAllStringFunc(v.String(), func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return value
+		})
+		if missing != "" {
+			return fmt.Errorf("environment variable %s referenced by %s is not set", missing, field)
+		}
+		v.SetString(expanded)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return interpolate(v.Elem(), field)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if err := interpolate(v.Field(i), joinField(field, yamlName(v.Type().Field(i)))); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			if err := interpolate(v.Index(i), fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			// Map values are not addressable, so interpolate a copy.
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			if err := interpolate(value, fmt.Sprintf("%s[%v]", field, iter.Key())); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides configuration fields with LLM_PROXY_* environment
+// variables, named after the field path in upper snake case: for example
+// LLM_PROXY_UPSTREAM_API_KEY or LLM_PROXY_RETRY_MAX_RETRIES. Entries of
+// upstreams, clients and teams are addressed by name, as in
+// LLM_PROXY_UPSTREAMS_OPENAI_API_KEY. Maps and other lists are left to
+// ${NAME} interpolation.
+func applyEnv(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return applyEnv(v.Elem(), name)
+		}
+		// Only allocate optional sections, such as a budget, that the
+		// environment sets.
+		if hasEnvPrefix(name + "_") {
+			value := reflect.New(v.Type().Elem())
+			if err := applyEnv(value.Elem(), name); err != nil {
+				return err
+			}
+			v.Set(value)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if err := applyEnv(v.Field(i), name+"_"+envName(yamlName(v.Type().Field(i)))); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		if _, ok := v.Type().Elem().FieldByName("Name"); !ok {
+			return nil
+		}
+		for i := range v.Len() {
+			entry := v.Index(i)
+			if err := applyEnv(entry, name+"_"+envName(entry.FieldByName("Name").String())); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+	default:
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		if err := setValue(v, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setValue parses an environment variable into a scalar field.
+func setValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// hasEnvPrefix reports whether any environment variable starts with prefix.
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlName returns the yaml key of a struct field.
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// envName converts a yaml key or entry name to upper snake case, keeping
+// acronyms together: "upstreamAPIKey" becomes "UPSTREAM_API_KEY" and
+// "my-provider" becomes "MY_PROVIDER".
+func envName(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			b.WriteByte('_')
+			continue
+		}
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,413 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// FieldError is a problem with one configuration field.
+type FieldError struct {
+	// Path locates the field, as in upstreams[0].baseURL. It is empty for
+	// problems with the file as a whole.
+	Path string
+	// Line is the line of the field in the configuration file, or 0 when it
+	// is not known, as for fields set by the environment.
+	Line    int
+	Message string
+
+	segments fieldPath
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	// File is the configuration file, or empty for a configuration built
+	// from the environment alone.
+	File   string
+	Errors []*FieldError
+}
+
+// Error returns one "file:line: path: message" line per problem.
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		var b strings.Builder
+		if e.File != "" {
+			b.WriteString(e.File)
+			if fieldErr.Line > 0 {
+				fmt.Fprintf(&b, ":%d", fieldErr.Line)
+			}
+			b.WriteString(": ")
+		}
+		if fieldErr.Path != "" {
+			b.WriteString(fieldErr.Path + ": ")
+		}
+		b.WriteString(fieldErr.Message)
+		lines = append(lines, b.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fieldPath locates a field by its keys (strings) and list indexes (ints).
+type fieldPath []any
+
+func (p fieldPath) child(name string) fieldPath {
+	return append(slices.Clip(p), name)
+}
+
+func (p fieldPath) index(i int) fieldPath {
+	return append(slices.Clip(p), i)
+}
+
+// String returns the path as in upstreams[0].baseURL.
+func (p fieldPath) String() string {
+	var b strings.Builder
+	for _, segment := range p {
+		switch segment := segment.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", segment)
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(segment)
+		}
+	}
+	return b.String()
+}
+
+// yamlPath returns the path for looking the field up in a YAML document.
+func (p fieldPath) yamlPath() *yaml.Path {
+	builder := (&yaml.PathBuilder{}).Root()
+	for _, segment := range p {
+		switch segment := segment.(type) {
+		case int:
+			builder = builder.Index(uint(segment))
+		case string:
+			builder = builder.Child(segment)
+		}
+	}
+	return builder.Build()
+}
+
+// validator collects the problems of a configuration.
+type validator struct {
+	errors []*FieldError
+}
+
+func (v *validator) addf(p fieldPath, format string, args ...any) {
+	v.errors = append(v.errors, &FieldError{Path: p.String(), Message: fmt.Sprintf(format, args...), segments: p})
+}
+
+func (v *validator) nonNegative(p fieldPath, value float64) {
+	if value < 0 {
+		v.addf(p, "must not be negative")
+	}
+}
+
+func (v *validator) oneOf(p fieldPath, value string, allowed ...string) {
+	if value != "" && !slices.Contains(allowed, value) {
+		v.addf(p, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+}
+
+func (v *validator) url(p fieldPath, value string) {
+	u, err := url.Parse(value)
+	switch {
+	case err != nil:
+		v.addf(p, "invalid URL: %v", err)
+	case u.Scheme != "http" && u.Scheme != "https":
+		v.addf(p, "URL scheme must be http or https, got %q", value)
+	case u.Host == "":
+		v.addf(p, "URL has no host: %q", value)
+	}
+}
+
+// Validate checks the configuration for invalid values and inconsistencies
+// between sections. It returns a *ValidationError listing every problem.
+func (c *Config) Validate() error {
+	v := &validator{}
+	var root fieldPath
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		v.addf(root.child("port"), "must be a port number, got %q", c.Port)
+	}
+
+	if c.UpstreamURL == "" && len(c.Upstreams) == 0 {
+		v.addf(root.child("upstreamURL"), "upstreamURL or upstreams is required")
+	}
+	if c.UpstreamURL != "" {
+		v.url(root.child("upstreamURL"), c.UpstreamURL)
+	}
+	c.validateUpstreams(v, root.child("upstreams"))
+	c.validateMappings(v, root.child("modelMappings"))
+	c.validateFallbacks(v, root.child("fallbacks"))
+
+	teams := make(map[string]bool, len(c.Teams))
+	for i, t := range c.Teams {
+		p := root.child("teams").index(i)
+		switch {
+		case t.Name == "":
+			v.addf(p.child("name"), "is required")
+		case teams[t.Name]:
+			v.addf(p.child("name"), "duplicate team name %q", t.Name)
+		}
+		teams[t.Name] = true
+		validateBudget(v, p.child("budget"), t.Budget)
+	}
+
+	names := make(map[string]bool, len(c.Clients))
+	keys := make(map[string]bool, len(c.Clients))
+	for i, client := range c.Clients {
+		p := root.child("clients").index(i)
+		switch {
+		case client.Name == "":
+			v.addf(p.child("name"), "is required")
+		case names[client.Name]:
+			v.addf(p.child("name"), "duplicate client name %q", client.Name)
+		}
+		names[client.Name] = true
+
+		switch {
+		case client.Key == "":
+			v.addf(p.child("key"), "is required")
+		case keys[client.Key]:
+			v.addf(p.child("key"), "duplicate key")
+		}
+		keys[client.Key] = true
+
+		for j, pattern := range client.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.addf(p.child("models").index(j), "invalid model pattern %q", pattern)
+			}
+		}
+		if client.Team != "" && !teams[client.Team] {
+			v.addf(p.child("team"), "unknown team %q", client.Team)
+		}
+		if client.RateLimit != nil {
+			validateRateLimit(v, p.child("rateLimit"), *client.RateLimit)
+		}
+		validateBudget(v, p.child("budget"), client.Budget)
+	}
+
+	for _, model := range slices.Sorted(maps.Keys(c.ModelRateLimits)) {
+		validateRateLimit(v, root.child("modelRateLimits").child(model), c.ModelRateLimits[model])
+	}
+
+	for _, model := range slices.Sorted(maps.Keys(c.Prices)) {
+		p, price := root.child("prices").child(model), c.Prices[model]
+		v.nonNegative(p.child("input"), price.Input)
+		v.nonNegative(p.child("output"), price.Output)
+		v.nonNegative(p.child("cacheRead"), price.CacheRead)
+		v.nonNegative(p.child("cacheWrite"), price.CacheWrite)
+	}
+
+	v.oneOf(root.child("usage").child("store"), c.Usage.Store, UsageStoreMemory, UsageStoreSQLite)
+	if c.Usage.Store == UsageStoreSQLite && c.Usage.Path == "" {
+		v.addf(root.child("usage").child("path"), "is required for the sqlite store")
+	}
+
+	if c.Tracing.Endpoint != "" {
+		v.url(root.child("tracing").child("endpoint"), c.Tracing.Endpoint)
+	}
+
+	retry := root.child("retry")
+	v.nonNegative(retry.child("maxRetries"), float64(c.Retry.MaxRetries))
+	v.nonNegative(retry.child("initialBackoff"), float64(c.Retry.InitialBackoff))
+	v.nonNegative(retry.child("maxBackoff"), float64(c.Retry.MaxBackoff))
+	if c.Retry.MaxBackoff > 0 && c.Retry.InitialBackoff > c.Retry.MaxBackoff {
+		v.addf(retry.child("initialBackoff"), "exceeds maxBackoff %s", c.Retry.MaxBackoff)
+	}
+
+	breaker := root.child("circuitBreaker")
+	if c.CircuitBreaker.FailureRate < 0 || c.CircuitBreaker.FailureRate > 1 {
+		v.addf(breaker.child("failureRate"), "must be between 0 and 1, got %g", c.CircuitBreaker.FailureRate)
+	}
+	v.nonNegative(breaker.child("minRequests"), float64(c.CircuitBreaker.MinRequests))
+	v.nonNegative(breaker.child("window"), float64(c.CircuitBreaker.Window))
+	v.nonNegative(breaker.child("coolDown"), float64(c.CircuitBreaker.CoolDown))
+
+	if c.Admin.Port != "" {
+		admin := root.child("admin")
+		if port, err := strconv.Atoi(c.Admin.Port); err != nil || port < 1 || port > 65535 {
+			v.addf(admin.child("port"), "must be a port number, got %q", c.Admin.Port)
+		} else if c.Admin.Port == c.Port {
+			v.addf(admin.child("port"), "must differ from port %s", c.Port)
+		}
+		if c.Admin.Token == "" {
+			v.addf(admin.child("token"), "is required with an admin port")
+		}
+	}
+
+	audit := root.child("audit")
+	if c.Audit.SampleRate < 0 || c.Audit.SampleRate > 1 {
+		v.addf(audit.child("sampleRate"), "must be between 0 and 1, got %g", c.Audit.SampleRate)
+	}
+	v.nonNegative(audit.child("maxBodySize"), float64(c.Audit.MaxBodySize))
+	v.nonNegative(audit.child("maxFileSize"), float64(c.Audit.MaxFileSize))
+	v.nonNegative(audit.child("maxFiles"), float64(c.Audit.MaxFiles))
+
+	redaction := root.child("redaction")
+	for i, pattern := range c.Redaction.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.addf(redaction.child("patterns").index(i), "invalid regular expression: %v", err)
+		}
+	}
+	for i, name := range c.Redaction.Disable {
+		v.oneOf(redaction.child("disable").index(i), name, RedactAPIKeys, RedactEmails, RedactCreditCards, RedactJWTs)
+	}
+
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			v.addf(root.child("logLevel"), "must be debug, info, warn or error, got %q", c.LogLevel)
+		}
+	}
+	v.oneOf(root.child("logFormat"), c.LogFormat, LogFormatText, LogFormatJSON)
+
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+func (c *Config) validateUpstreams(v *validator, p fieldPath) {
+	names := make(map[string]bool)
+	if c.UpstreamURL != "" {
+		names[DefaultUpstreamName] = true
+	}
+
+	for i, u := range c.Upstreams {
+		p := p.index(i)
+		switch {
+		case u.Name == "":
+			v.addf(p.child("name"), "is required")
+		case names[u.Name]:
+			v.addf(p.child("name"), "duplicate upstream name %q", u.Name)
+		case strings.Contains(u.Name, "/"):
+			v.addf(p.child("name"), "must not contain \"/\", got %q", u.Name)
+		}
+		names[u.Name] = true
+
+		if u.BaseURL != "" {
+			v.url(p.child("baseURL"), u.BaseURL)
+		} else if len(u.Endpoints) == 0 {
+			v.addf(p.child("baseURL"), "is required")
+		}
+		for j, e := range u.Endpoints {
+			endpoint := p.child("endpoints").index(j)
+			if e.BaseURL != "" {
+				v.url(endpoint.child("baseURL"), e.BaseURL)
+			} else if u.BaseURL == "" {
+				v.addf(endpoint.child("baseURL"), "is required without an upstream baseURL")
+			}
+			v.nonNegative(endpoint.child("weight"), float64(e.Weight))
+		}
+
+		v.oneOf(p.child("authStyle"), u.AuthStyle, AuthStyleBearer, AuthStyleXAPIKey)
+		v.oneOf(p.child("protocol"), u.Protocol, ProtocolOpenAI, ProtocolAnthropic)
+		v.oneOf(p.child("strategy"), u.Strategy, StrategyRoundRobin, StrategyLeastInFlight, StrategyLeastRecent429)
+		v.nonNegative(p.child("benchDuration"), float64(u.BenchDuration))
+	}
+}
+
+// validateMappings rejects empty mappings and mappings that lead back to
+// themselves, such as a mapped to b and b mapped to a. Mapped names are not
+// resolved again, so such cycles are always a mistake.
+func (c *Config) validateMappings(v *validator, p fieldPath) {
+	for _, model := range slices.Sorted(maps.Keys(c.ModelMappings)) {
+		target := c.ModelMappings[model]
+		if model == "" || target == "" {
+			v.addf(p.child(model), "model names must not be empty")
+			continue
+		}
+
+		chain := []string{model}
+		for next := target; next != chain[len(chain)-1]; next = c.ModelMappings[next] {
+			if _, mapped := c.ModelMappings[next]; !mapped {
+				break
+			}
+			if slices.Contains(chain, next) {
+				// Report each cycle once, at its first model in name order.
+				if slices.Min(chain[slices.Index(chain, next):]) == model {
+					v.addf(p.child(model), "mapping cycle %s -> %s", strings.Join(chain, " -> "), next)
+				}
+				break
+			}
+			chain = append(chain, next)
+		}
+	}
+}
+
+// validateFallbacks rejects empty fallback targets and targets that can
+// never serve a request because the same route was already tried.
+func (c *Config) validateFallbacks(v *validator, p fieldPath) {
+	route := func(target string) string {
+		upstream, model := c.Route(target)
+		return upstream + "/" + model
+	}
+
+	for _, model := range slices.Sorted(maps.Keys(c.Fallbacks)) {
+		primary, mapped := c.ModelMappings[model]
+		if !mapped {
+			primary = model
+		}
+		tried := []string{route(primary)}
+
+		for i, target := range c.Fallbacks[model] {
+			p := p.child(model).index(i)
+			if target == "" {
+				v.addf(p, "must not be empty")
+				continue
+			}
+			if r := route(target); slices.Contains(tried, r) {
+				v.addf(p, "unreachable: %s is already tried before", r)
+			} else {
+				tried = append(tried, r)
+			}
+		}
+	}
+}
+
+func validateRateLimit(v *validator, p fieldPath, limit RateLimit) {
+	v.nonNegative(p.child("requestsPerMinute"), float64(limit.RequestsPerMinute))
+	v.nonNegative(p.child("tokensPerMinute"), float64(limit.TokensPerMinute))
+}
+
+func validateBudget(v *validator, p fieldPath, b *Budget) {
+	if b == nil {
+		return
+	}
+	v.oneOf(p.child("window"), b.Window, BudgetWindowDaily, BudgetWindowMonthly)
+	v.nonNegative(p.child("softLimit"), b.SoftLimit)
+	v.nonNegative(p.child("hardLimit"), b.HardLimit)
+}
+
+// locate fills in the file and line numbers of a validation error from the
+// configuration file it was loaded from. Fields missing from the file are
+// located at their closest parent that is present.
+func (e *ValidationError) locate(file string, data []byte) {
+	e.File = file
+	doc, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return
+	}
+
+	for _, fieldErr := range e.Errors {
+		for p := fieldErr.segments; len(p) > 0; p = p[:len(p)-1] {
+			if node, err := p.yamlPath().FilterFile(doc); err == nil && node != nil {
+				fieldErr.Line = node.GetToken().Position.Line
+				break
+			}
+		}
+	}
+}
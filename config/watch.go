@@ -0,0 +1,41 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls the file at path every interval and calls onChange whenever
+// its modification time or size changes, until ctx is done. A file that is
+// briefly missing, as while an editor replaces it, is picked up again once
+// it reappears.
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+
+		modTime, size = info.ModTime(), info.Size()
+		onChange()
+	}
+}